@@ -0,0 +1,22 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// The admin HTTP API, served on --admin-addr when it is set.
+// Each feature registers its own /api/ routes on the mux. The API
+// has no authentication of its own, so it should only be bound
+// to a trusted interface such as 127.0.0.1.
+func serveAdmin(addr string, mux *http.ServeMux) {
+	log.Println("Admin API listening on", addr)
+	log.Print(http.ListenAndServe(addr, mux))
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
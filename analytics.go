@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Usage statistics for capacity planning: for each day, who sent
+// messages, how many were sent and in which hours. Days are in the
+// server's local time. With --analytics-file the statistics are saved
+// as JSON every analyticsSaveInterval and on shutdown, and loaded
+// again on startup. Days older than analyticsRetentionDays are
+// dropped, so the statistics don't grow forever. The admin API serves
+//
+//	GET /api/analytics/daily?date=YYYY-MM-DD   one day, today by default
+//	GET /api/analytics/weekly                  the last seven days
+
+const (
+	analyticsDateLayout    = "2006-01-02"
+	analyticsSaveInterval  = time.Hour
+	analyticsRetentionDays = 90
+)
+
+type DayStats struct {
+	UniqueUsers  map[string]struct{} `json:"unique_users"`
+	MessageCount int                 `json:"message_count"`
+	HourlyVolume [24]int             `json:"hourly_volume"`
+}
+
+type Analytics struct {
+	mu         sync.Mutex
+	DailyStats map[string]*DayStats `json:"daily_stats"` // keyed by YYYY-MM-DD
+	path       string               // empty to keep the statistics in memory only
+}
+
+// Creates the statistics, loading any saved to path.
+func newAnalytics(path string) (*Analytics, error) {
+	a := &Analytics{DailyStats: make(map[string]*DayStats), path: path}
+	if path == "" {
+		return a, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return a, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, a); err != nil {
+		return nil, err
+	}
+	a.expire(time.Now())
+	return a, nil
+}
+
+// Counts a message sent by sender at the given time.
+func (a *Analytics) record(sender string, at time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	date := at.Format(analyticsDateLayout)
+	day, ok := a.DailyStats[date]
+	if !ok {
+		// a new day, so the oldest may now be past keeping
+		a.expire(at)
+		day = &DayStats{UniqueUsers: make(map[string]struct{})}
+		a.DailyStats[date] = day
+	}
+	day.UniqueUsers[sender] = struct{}{}
+	day.MessageCount++
+	day.HourlyVolume[at.Hour()]++
+}
+
+// Drops the days more than analyticsRetentionDays before now.
+// Called with the mutex held, or before the statistics are shared.
+func (a *Analytics) expire(now time.Time) {
+	// dates in this layout sort in time order as strings
+	oldest := now.AddDate(0, 0, -analyticsRetentionDays).Format(analyticsDateLayout)
+	for date := range a.DailyStats {
+		if date < oldest {
+			delete(a.DailyStats, date)
+		}
+	}
+}
+
+// Writes the statistics to the analytics file, if there is one.
+func (a *Analytics) save() error {
+	if a.path == "" {
+		return nil
+	}
+	a.mu.Lock()
+	data, err := json.Marshal(a)
+	a.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// write then rename, so a crash never leaves half a file
+	tmp := a.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, a.path)
+}
+
+// Saves the statistics every interval, forever.
+func (a *Analytics) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := a.save(); err != nil {
+			log.Print("Saving analytics: ", err)
+		}
+	}
+}
+
+// The JSON form of one day on the admin API.
+type daySummary struct {
+	Date         string   `json:"date"`
+	UniqueUsers  int      `json:"unique_users"`
+	Users        []string `json:"users"`
+	MessageCount int      `json:"message_count"`
+	HourlyVolume [24]int  `json:"hourly_volume"`
+	PeakHour     int      `json:"peak_hour"` // -1 on a day without messages
+}
+
+// Summarises a day, which may have had no messages.
+// Called with the mutex held.
+func (a *Analytics) summary(date string) daySummary {
+	summary := daySummary{Date: date, Users: []string{}, PeakHour: -1}
+	day, ok := a.DailyStats[date]
+	if !ok {
+		return summary
+	}
+	for user := range day.UniqueUsers {
+		summary.Users = append(summary.Users, user)
+	}
+	slices.Sort(summary.Users)
+	summary.UniqueUsers = len(summary.Users)
+	summary.MessageCount = day.MessageCount
+	summary.HourlyVolume = day.HourlyVolume
+	for hour, count := range day.HourlyVolume {
+		if count > 0 && (summary.PeakHour < 0 || count > day.HourlyVolume[summary.PeakHour]) {
+			summary.PeakHour = hour
+		}
+	}
+	return summary
+}
+
+func (a *Analytics) register(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/analytics/daily", func(w http.ResponseWriter, r *http.Request) {
+		date := r.URL.Query().Get("date")
+		if date == "" {
+			date = time.Now().Format(analyticsDateLayout)
+		} else if _, err := time.Parse(analyticsDateLayout, date); err != nil {
+			http.Error(w, "date must be YYYY-MM-DD", http.StatusBadRequest)
+			return
+		}
+
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		writeJSON(w, http.StatusOK, a.summary(date))
+	})
+
+	mux.HandleFunc("GET /api/analytics/weekly", func(w http.ResponseWriter, r *http.Request) {
+		type week struct {
+			Days         []daySummary `json:"days"` // oldest first, ending today
+			UniqueUsers  int          `json:"unique_users"`
+			MessageCount int          `json:"message_count"`
+		}
+
+		a.mu.Lock()
+		defer a.mu.Unlock()
+
+		var result week
+		users := make(map[string]struct{})
+		today := time.Now()
+		for i := 6; i >= 0; i-- {
+			day := a.summary(today.AddDate(0, 0, -i).Format(analyticsDateLayout))
+			for _, user := range day.Users {
+				users[user] = struct{}{}
+			}
+			result.MessageCount += day.MessageCount
+			result.Days = append(result.Days, day)
+		}
+		result.UniqueUsers = len(users)
+		writeJSON(w, http.StatusOK, result)
+	})
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAnalyticsDailySummary(t *testing.T) {
+	a, err := newAnalytics("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	day := time.Date(2024, 5, 1, 0, 0, 0, 0, time.Local)
+	a.record("alice", day.Add(9*time.Hour))
+	a.record("bob", day.Add(9*time.Hour+30*time.Minute))
+	a.record("alice", day.Add(14*time.Hour))
+
+	a.mu.Lock()
+	summary := a.summary("2024-05-01")
+	a.mu.Unlock()
+	if summary.UniqueUsers != 2 || summary.MessageCount != 3 || summary.PeakHour != 9 {
+		t.Errorf("summary = %+v, want 2 users, 3 messages, peak hour 9", summary)
+	}
+	if summary.HourlyVolume[9] != 2 || summary.HourlyVolume[14] != 1 {
+		t.Errorf("hourly volume = %v", summary.HourlyVolume)
+	}
+
+	a.mu.Lock()
+	empty := a.summary("2024-05-02")
+	a.mu.Unlock()
+	if empty.PeakHour != -1 || empty.MessageCount != 0 || empty.Users == nil {
+		t.Errorf("summary of a quiet day = %+v", empty)
+	}
+}
+
+func TestAnalyticsRetention(t *testing.T) {
+	a, err := newAnalytics("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	old := now.AddDate(0, 0, -analyticsRetentionDays-1)
+	kept := now.AddDate(0, 0, -analyticsRetentionDays+1)
+	a.record("alice", old)
+	a.record("alice", kept)
+	a.record("alice", now) // a new day expires the old one
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := a.DailyStats[old.Format(analyticsDateLayout)]; ok {
+		t.Error("a day past the retention window was kept")
+	}
+	if _, ok := a.DailyStats[kept.Format(analyticsDateLayout)]; !ok {
+		t.Error("a day inside the retention window was dropped")
+	}
+}
+
+func TestAnalyticsSaveAndLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "analytics.json")
+	a, err := newAnalytics(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.record("alice", time.Now())
+	a.record("alice", time.Now().AddDate(0, 0, -analyticsRetentionDays-5))
+	if err := a.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := newAnalytics(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.DailyStats) != 1 {
+		t.Errorf("loaded %d days, want only today's", len(loaded.DailyStats))
+	}
+}
+
+func TestAnalyticsAPI(t *testing.T) {
+	a, _ := newAnalytics("")
+	a.record("alice", time.Now())
+	a.record("bob", time.Now().AddDate(0, 0, -3))
+	mux := http.NewServeMux()
+	a.register(mux)
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/api/analytics/daily?date=yesterday", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("bad date: status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/api/analytics/weekly", nil))
+	var week struct {
+		Days         []daySummary `json:"days"`
+		UniqueUsers  int          `json:"unique_users"`
+		MessageCount int          `json:"message_count"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&week); err != nil {
+		t.Fatal(err)
+	}
+	if len(week.Days) != 7 || week.UniqueUsers != 2 || week.MessageCount != 2 {
+		t.Errorf("week = %d days, %d users, %d messages; want 7, 2, 2", len(week.Days), week.UniqueUsers, week.MessageCount)
+	}
+}
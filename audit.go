@@ -0,0 +1,97 @@
+package main
+
+import (
+	"container/list"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// A per-user activity trail for compliance: when each username joined
+// and left, and when it was kicked or migrated to another server. The
+// last userAuditLimit events of each user are kept in memory, for the
+// userAuditUsers users active most recently, since guests get a new
+// name each time they connect. They are served by
+//
+//	GET /api/users/{username}/audit
+//
+// oldest first, or 404 if nothing is recorded for the username.
+
+const (
+	userAuditLimit = 1000  // events kept per user
+	userAuditUsers = 10000 // users kept, dropping the longest inactive
+)
+
+const (
+	auditJoin     = "join"
+	auditLeave    = "leave"
+	auditKicked   = "kicked"
+	auditMigrated = "migrated"
+)
+
+type UserEvent struct {
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+type userAuditLog struct {
+	mu     sync.Mutex
+	users  map[string]*list.Element // by username, in recent
+	recent *list.List               // of *userAudit, most recently active first
+}
+
+type userAudit struct {
+	username string
+	events   []UserEvent
+}
+
+func newUserAuditLog() *userAuditLog {
+	return &userAuditLog{users: make(map[string]*list.Element), recent: list.New()}
+}
+
+func (l *userAuditLog) record(username string, action string, detail string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	element, ok := l.users[username]
+	if ok {
+		l.recent.MoveToFront(element)
+	} else {
+		element = l.recent.PushFront(&userAudit{username: username})
+		l.users[username] = element
+		if l.recent.Len() > userAuditUsers {
+			oldest := l.recent.Remove(l.recent.Back()).(*userAudit)
+			delete(l.users, oldest.username)
+		}
+	}
+
+	audit := element.Value.(*userAudit)
+	audit.events = append(audit.events, UserEvent{Time: time.Now(), Action: action, Detail: detail})
+	if len(audit.events) > userAuditLimit {
+		audit.events = audit.events[len(audit.events)-userAuditLimit:]
+	}
+}
+
+// Returns a copy of a user's events, oldest first, reporting
+// false if none are recorded.
+func (l *userAuditLog) events(username string) ([]UserEvent, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	element, ok := l.users[username]
+	if !ok {
+		return nil, false
+	}
+	return append([]UserEvent(nil), element.Value.(*userAudit).events...), true
+}
+
+func (l *userAuditLog) register(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/users/{username}/audit", func(w http.ResponseWriter, r *http.Request) {
+		events, ok := l.events(r.PathValue("username"))
+		if !ok {
+			http.Error(w, "no events for that user", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, events)
+	})
+}
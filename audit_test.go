@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestUserAuditLogKeepsLastEvents(t *testing.T) {
+	audit := newUserAuditLog()
+	for i := 0; i < userAuditLimit+10; i++ {
+		audit.record("alice", auditJoin, strconv.Itoa(i))
+	}
+	events, ok := audit.events("alice")
+	if !ok || len(events) != userAuditLimit {
+		t.Fatalf("kept %d events, want %d", len(events), userAuditLimit)
+	}
+	if events[0].Detail != "10" {
+		t.Errorf("oldest kept event is %q, want %q", events[0].Detail, "10")
+	}
+}
+
+// Guests get a new name on every connection, so the users kept are
+// capped, dropping whoever has been inactive longest.
+func TestUserAuditLogCapsUsers(t *testing.T) {
+	audit := newUserAuditLog()
+	audit.record("alice", auditJoin, "")
+	audit.record("bob", auditJoin, "")
+	for i := 0; i < userAuditUsers-2; i++ {
+		audit.record("Guest-"+strconv.Itoa(i), auditJoin, "")
+	}
+	audit.record("alice", auditLeave, "") // alice is active again; bob is now the oldest
+	audit.record("carol", auditJoin, "")
+
+	if _, ok := audit.events("bob"); ok {
+		t.Error("the longest inactive user was kept")
+	}
+	if events, ok := audit.events("alice"); !ok || len(events) != 2 {
+		t.Errorf("alice has %d events, want 2", len(events))
+	}
+	if audit.recent.Len() != userAuditUsers || len(audit.users) != userAuditUsers {
+		t.Errorf("keeping %d users, want %d", audit.recent.Len(), userAuditUsers)
+	}
+}
+
+func TestUserAuditAPI(t *testing.T) {
+	audit := newUserAuditLog()
+	audit.record("alice", auditJoin, "from 10.0.0.1:5000")
+	audit.record("alice", auditKicked, "slow consumer")
+	mux := http.NewServeMux()
+	audit.register(mux)
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/api/users/alice/audit", nil))
+	var events []UserEvent
+	if err := json.NewDecoder(w.Body).Decode(&events); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || events[0].Action != auditJoin || events[1].Action != auditKicked {
+		t.Errorf("events = %+v", events)
+	}
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/api/users/nobody/audit", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("unknown user: status %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
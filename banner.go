@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// The program version, set at build time with
+//
+//	go build -ldflags "-X main.Version=1.2.3"
+var Version = "dev"
+
+// Prints a summary of the server's configuration in a box,
+// such as:
+//
+//	+------------------------------+
+//	| chat server dev              |
+//	+------------------------------+
+//	| Listening   0.0.0.0:8011     |
+//	| TLS         off              |
+//	| ...                          |
+//	+------------------------------+
+func printBanner(w io.Writer, config serverConfig, listenAddr string, tlsAddr string) {
+	tls := "off"
+	if tlsAddr != "" {
+		tls = tlsAddr
+	}
+	history := "unlimited"
+	if config.historyMaxAge > 0 {
+		history = "last " + config.historyMaxAge.String()
+	}
+	admin := "off"
+	if config.adminAddr != "" {
+		admin = config.adminAddr
+	}
+
+	title := "chat server " + Version
+	rows := [][2]string{
+		{"Listening", listenAddr},
+		{"TLS", tls},
+		{"Transport", config.transport},
+		{"History", history},
+		{"Admin API", admin},
+	}
+
+	width := len(title)
+	lines := make([]string, len(rows))
+	for i, row := range rows {
+		lines[i] = fmt.Sprintf("%-11s %s", row[0], row[1])
+		width = max(width, len(lines[i]))
+	}
+
+	border := "+" + strings.Repeat("-", width+2) + "+\n"
+	fmt.Fprint(w, border)
+	fmt.Fprintf(w, "| %-*s |\n", width, title)
+	fmt.Fprint(w, border)
+	for _, line := range lines {
+		fmt.Fprintf(w, "| %-*s |\n", width, line)
+	}
+	fmt.Fprint(w, border)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrintBanner(t *testing.T) {
+	var b strings.Builder
+	config := serverConfig{transport: "tcp", historyMaxAge: time.Hour, adminAddr: "127.0.0.1:9090"}
+	printBanner(&b, config, "0.0.0.0:8011", "0.0.0.0:8443")
+	banner := b.String()
+
+	for _, want := range []string{
+		"| chat server " + Version,
+		"| Listening   0.0.0.0:8011",
+		"| TLS         0.0.0.0:8443",
+		"| Transport   tcp",
+		"| History     last 1h0m0s",
+		"| Admin API   127.0.0.1:9090",
+	} {
+		if !strings.Contains(banner, want) {
+			t.Errorf("banner doesn't include %q:\n%s", want, banner)
+		}
+	}
+
+	// a box, every line the same width
+	lines := strings.Split(strings.TrimSuffix(banner, "\n"), "\n")
+	for _, line := range lines {
+		if len(line) != len(lines[0]) {
+			t.Errorf("line %q is %d wide, want %d", line, len(line), len(lines[0]))
+		}
+	}
+	for _, i := range []int{0, 2, len(lines) - 1} {
+		if border := lines[i]; !strings.HasPrefix(border, "+-") || !strings.HasSuffix(border, "-+") {
+			t.Errorf("line %d is %q, want a border", i, border)
+		}
+	}
+}
+
+func TestPrintBannerDefaults(t *testing.T) {
+	var b strings.Builder
+	printBanner(&b, serverConfig{transport: "lp"}, "127.0.0.1:8011", "")
+	for _, want := range []string{"TLS         off", "History     unlimited", "Admin API   off", "Transport   lp"} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("banner doesn't include %q:\n%s", want, b.String())
+		}
+	}
+}
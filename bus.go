@@ -0,0 +1,108 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Carries messages from the connections that send them to everything
+// that consumes them. Publishers write to a single queue; a fan-out
+// goroutine copies each message to every subscriber's channel, so the
+// broadcaster and anything added later each see every message. The
+// server runs a second bus for the messages the broadcaster lets
+// through, which the Slack notifier subscribes to.
+//
+// Fan-out waits on a full subscriber rather than dropping, so a slow
+// subscriber eventually backs the queue up into publish. Subscribers
+// that mustn't hold up the others, such as integrations waiting on a
+// remote service, subscribe with subscribeLossy and miss messages
+// instead when they fall behind.
+type MessageBus struct {
+	publishChannel chan messagePacket
+	dropped        atomic.Uint64 // messages lossy subscribers were too far behind to get
+
+	mu          sync.Mutex
+	subscribers []busSubscriber
+}
+
+type busSubscriber struct {
+	messages chan messagePacket
+	lossy    bool // drop messages when full rather than wait
+}
+
+// How many messages a subscriber can fall behind before it starts
+// holding up the other subscribers, or a lossy one missing messages.
+const busSubscriberBuffer = 64
+
+// Creates a bus whose publish queue holds queueSize messages
+// and starts its fan-out goroutine.
+func newMessageBus(queueSize int) *MessageBus {
+	bus := &MessageBus{publishChannel: make(chan messagePacket, queueSize)}
+	go bus.run()
+	return bus
+}
+
+// Returns a channel that receives a copy of every message published
+// from now on. Subscribe before anything is published to see it all.
+func (b *MessageBus) subscribe() <-chan messagePacket {
+	return b.addSubscriber(false)
+}
+
+// Like subscribe, but messages are dropped for this subscriber while
+// its channel is full, so it never holds up the other subscribers.
+func (b *MessageBus) subscribeLossy() <-chan messagePacket {
+	return b.addSubscriber(true)
+}
+
+func (b *MessageBus) addSubscriber(lossy bool) <-chan messagePacket {
+	messages := make(chan messagePacket, busSubscriberBuffer)
+
+	b.mu.Lock()
+	b.subscribers = append(b.subscribers, busSubscriber{messages: messages, lossy: lossy})
+	b.mu.Unlock()
+	return messages
+}
+
+// Queues a message, waiting for room if the queue is full.
+func (b *MessageBus) publish(packet messagePacket) {
+	b.publishChannel <- packet
+}
+
+// The error sent to a client whose message tryPublish dropped. The
+// stress test tells these apart from other errors by it.
+const serverBusyText = "server is busy, message dropped"
+
+// Queues a message if there is room, reporting false if it was dropped.
+func (b *MessageBus) tryPublish(packet messagePacket) bool {
+	select {
+	case b.publishChannel <- packet:
+		return true
+	default:
+		return false
+	}
+}
+
+// The number of messages waiting to be fanned out.
+func (b *MessageBus) pending() int {
+	return len(b.publishChannel)
+}
+
+func (b *MessageBus) run() {
+	for packet := range b.publishChannel {
+		b.mu.Lock()
+		subscribers := b.subscribers
+		b.mu.Unlock()
+
+		for _, subscriber := range subscribers {
+			if !subscriber.lossy {
+				subscriber.messages <- packet
+				continue
+			}
+			select {
+			case subscriber.messages <- packet:
+			default:
+				b.dropped.Add(1)
+			}
+		}
+	}
+}
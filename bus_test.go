@@ -0,0 +1,110 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A lossy subscriber that never reads, like a Slack notifier stuck
+// on retries, must not stop the broadcaster getting every message.
+func TestBusLossySubscriberDoesNotBlock(t *testing.T) {
+	bus := newMessageBus(16)
+	// subscribed first, so each message has been offered to it by
+	// the time the broadcaster gets it
+	bus.subscribeLossy() // never read
+	broadcasts := bus.subscribe()
+
+	const messages = busSubscriberBuffer * 4
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < messages; i++ {
+			bus.publish(messagePacket{text: "hello"})
+		}
+	}()
+
+	timeout := time.After(5 * time.Second)
+	for i := 0; i < messages; i++ {
+		select {
+		case <-broadcasts:
+		case <-timeout:
+			t.Fatalf("broadcaster got %d of %d messages", i, messages)
+		}
+	}
+	<-done
+
+	if want := uint64(messages - busSubscriberBuffer); bus.dropped.Load() != want {
+		t.Errorf("dropped %d messages, want %d", bus.dropped.Load(), want)
+	}
+}
+
+func TestBusSubscribersSeeEveryMessage(t *testing.T) {
+	bus := newMessageBus(16)
+	first := bus.subscribe()
+	second := bus.subscribe()
+
+	bus.publish(messagePacket{text: "one"})
+	bus.publish(messagePacket{text: "two"})
+
+	for _, messages := range []<-chan messagePacket{first, second} {
+		for _, want := range []string{"one", "two"} {
+			if packet := <-messages; packet.text != want {
+				t.Errorf("got %q, want %q", packet.text, want)
+			}
+		}
+	}
+}
+
+func TestBusTryPublishWhenFull(t *testing.T) {
+	bus := &MessageBus{publishChannel: make(chan messagePacket, 1)} // not running, so nothing drains it
+	if !bus.tryPublish(messagePacket{}) {
+		t.Fatal("tryPublish failed on an empty queue")
+	}
+	if bus.tryPublish(messagePacket{}) {
+		t.Error("tryPublish succeeded on a full queue")
+	}
+	if bus.pending() != 1 {
+		t.Errorf("pending() = %d, want 1", bus.pending())
+	}
+}
+
+// With several publishers at once, every subscriber gets every message,
+// each publisher's in the order it sent them.
+func TestBusConcurrentPublishers(t *testing.T) {
+	const publishers, messages = 10, 100
+	bus := newMessageBus(16)
+	subscribers := []<-chan messagePacket{bus.subscribe(), bus.subscribe()}
+
+	for p := 0; p < publishers; p++ {
+		go func() {
+			for i := 0; i < messages; i++ {
+				bus.publish(messagePacket{source: strconv.Itoa(p), text: strconv.Itoa(i)})
+			}
+		}()
+	}
+
+	var wg sync.WaitGroup
+	for _, subscriber := range subscribers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			next := make(map[string]int)
+			timeout := time.After(5 * time.Second)
+			for received := 0; received < publishers*messages; received++ {
+				select {
+				case packet := <-subscriber:
+					if want := strconv.Itoa(next[packet.source]); packet.text != want {
+						t.Errorf("publisher %s's message %s arrived when %s was next", packet.source, packet.text, want)
+					}
+					next[packet.source]++
+				case <-timeout:
+					t.Errorf("got %d of %d messages", received, publishers*messages)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
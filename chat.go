@@ -14,14 +14,26 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/template"
+	"time"
 )
 
 // This function starts a new server session by listening
@@ -45,79 +57,485 @@ type messagePacket struct {
 	text   string
 	source string // this should be the connection address
 	sender string // connection's username
+
+	timestamp   time.Time // set when the message is broadcast
+	contentType string    // see contentTypes; empty for text/plain
+	tags        map[string]string
+	seq         int // numbers messages in the order they're broadcast; see messageHistory
 }
 
 type user struct {
-	connection net.Conn
+	connection *queuedConn
 	username   string
+	anonymous  bool // connected without a username and given a guest name
+	stats      *userStats
+
+	clientVersion string       // from the client's hello, if it sent one
+	multicast     *atomic.Bool // set once the client confirms it has joined the multicast group
+	flags         []string     // reputation labels of the client's network, such as "proxy"
+}
+
+// Options for server mode, filled in from the command line.
+type serverConfig struct {
+	listenAddr      string // interface to bind, "0.0.0.0" for all IPv4 or "::" for all IPv6
+	port            int
+	tlsPort         int // 0 disables the TLS listener
+	tlsCert         string
+	tlsKey          string
+	tlsMinVersion   string // "1.2" or "1.3"
+	tlsCiphers      string // comma-separated cipher suite names, empty for Go's defaults
+	listenBacklog   int    // accept queue length, 0 for the system default
+	listenRcvbuf    int    // SO_RCVBUF of the listening sockets in bytes, 0 for the default
+	bindRetryCount  int    // times to retry a port that is in use at startup
+	bindRetryDelay  time.Duration
+	inheritFD       int
+	inheritTLSFD    int
+	transport       string // "tcp", "lp" (HTTP long-polling) or "multicast"
+	wireFormat      string // encoding offered to long-polling clients besides JSON: "json" or "gob"
+	keepAlive       time.Duration
+	allowAnonymous  bool // give clients with an empty username a guest name
+	queueSize       int  // capacity of the message bus
+	statsInterval   time.Duration
+	noBanner        bool
+	adminAddr       string // empty disables the admin HTTP API
+	connectionLog   string // NDJSON file of connection attempts, if set
+	emojiCodesFile  string // JSON map of :shortcode: to emoji, if set
+	sentimentDir    string // directory of sentiment lexicons, if set
+	slackWebhookURL string
+	slackChannel    string
+
+	contentScannerURL string // HTTP service that scans each message, if set
+	scannerFailOpen   bool   // let messages through when the scanner fails, rather than block them
+
+	minClientVersion string // clients announcing an older version are refused
+	maxPerIP         int    // concurrent connections allowed from one IP, 0 for no limit
+	autoKickSlow     bool   // disconnect users with more than slowThreshold lines waiting to be written
+	slowThreshold    uint
+	messageFormat    string // text/template for broadcast lines
+	welcomeMessage   string // text/template sent to each new user, if set
+	ipReputation     string // JSON file of network reputations, if set
+	multicastGroup   string // group address for the multicast transport
+	multicastPort    int
+	enablePprof      bool   // serve profiles on the admin API
+	pprofDir         string // where the admin API writes profiles to files
+	analyticsFile    string // JSON file the usage statistics are kept in, if set
+
+	historyMaxAge time.Duration // messages older than this aren't replayed, 0 to keep them all
+	restartExec   bool          // restart through the admin API by exec rather than exiting
+	rateLimit     int           // messages a client may send per rateWindow, 0 for no limit
+	rateWindow    time.Duration
 }
 
-func server(port int) {
-	ln, err := net.Listen("tcp4", ":"+strconv.Itoa(port))
+func server(config serverConfig) {
+	startedAt := time.Now()
+
+	// set by a restart through the admin API, and deferred first
+	// so that the other deferred clean-up happens before the exec
+	var reexec atomic.Bool
+	defer func() {
+		if reexec.Load() {
+			log.Fatal("Restart failed: ", execSelf())
+		}
+	}()
+
+	ln, err := listenWithRetry(config.listenAddr, config.port, config.inheritFD, config.listenBacklog, config.listenRcvbuf, config.bindRetryCount, config.bindRetryDelay)
 	if err != nil {
-		log.Print(err)
+		log.Fatal(err)
 	}
 
 	log.Println("Listening on", ln.Addr())
 
-	messageChannel := make(chan messagePacket)
+	// the TLS port shares the same pool, channel and history
+	var tlsListener net.Listener
+	var tlsConfig *tls.Config
+	if config.tlsPort > 0 {
+		cert, err := tls.LoadX509KeyPair(config.tlsCert, config.tlsKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		// both checked in main
+		minVersion, _ := parseTLSVersion(config.tlsMinVersion)
+		cipherSuites, _ := parseCipherSuites(config.tlsCiphers)
+		tlsConfig = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   minVersion,
+			CipherSuites: cipherSuites,
+		}
+
+		tlsListener, err = listenWithRetry(config.listenAddr, config.tlsPort, config.inheritTLSFD, config.listenBacklog, config.listenRcvbuf, config.bindRetryCount, config.bindRetryDelay)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Println("Listening for TLS on", tlsListener.Addr())
+	}
+
+	if !config.noBanner {
+		tlsAddr := ""
+		if tlsListener != nil {
+			tlsAddr = tlsListener.Addr().String()
+		}
+		printBanner(os.Stdout, config, ln.Addr().String(), tlsAddr)
+	}
+
+	// both checked in main
+	format, _ := parseMessageFormat(config.messageFormat)
+	welcome, _ := parseWelcomeMessage(config.welcomeMessage)
+
+	// subscribed up front so the broadcaster sees every message
+	bus := newMessageBus(config.queueSize)
+	broadcasts := bus.subscribe()
 	var threadGroup sync.WaitGroup
+	metrics := &serverMetrics{}
+	deadLetters := newDeadLetterQueue()
+
+	live := newLiveConfig(config)
+
+	analytics, err := newAnalytics(config.analyticsFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	go analytics.run(analyticsSaveInterval)
+	defer func() {
+		if err := analytics.save(); err != nil {
+			log.Print("Saving analytics: ", err)
+		}
+	}()
+
+	reputation, err := loadReputation(config.ipReputation)
+	if err != nil {
+		log.Fatal("Loading IP reputation: ", err)
+	}
+	if reputation != nil {
+		go reputation.watchReload()
+	}
 
 	// [address, <net.Conn obj>]
-	connectionPool := make(map[string]user)
+	connectionPool := newSafePool()
+	audit := newUserAuditLog()
 
-	var messageHistory []messagePacket
+	history := newMessageHistory(config.historyMaxAge)
+
+	connLog, err := newConnectionLog(config.connectionLog)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// the messages the broadcaster lets through, once the middleware
+	// and content scanner have seen them, for integrations to pass on
+	processed := newMessageBus(config.queueSize)
+	if config.slackWebhookURL != "" {
+		slack := newSlackNotifier(config.slackWebhookURL, config.slackChannel)
+		go slack.run(processed.subscribeLossy())
+	}
+
+	var middleware []Middleware
+	if config.emojiCodesFile != "" {
+		emoji, err := newEmojiMiddleware(config.emojiCodesFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		middleware = append(middleware, emoji)
+	}
+	if config.sentimentDir != "" {
+		sentiment, err := newSentimentPlugin(config.sentimentDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		middleware = append(middleware, sentiment)
+	}
+	var scanner ContentScanner = NoopScanner{}
+	if config.contentScannerURL != "" {
+		scanner = newHTTPScanner(config.contentScannerURL)
+		if config.scannerFailOpen {
+			scanner = failOpenScanner{scanner}
+		}
+	}
+
+	var lpClients *lpHub
+	if config.transport == "lp" {
+		format, _ := parseWireFormat(config.wireFormat) // checked with the flags
+		lpClients = newLPHub(format)
+	}
+
+	var multicast *multicastSender
+	if config.transport == "multicast" {
+		log.Print("Warning: the multicast transport is experimental")
+		multicast, err = newMulticastSender(multicastAddr(config))
+		if err != nil {
+			log.Fatal("Multicast: ", err)
+		}
+	}
+
+	// cancelled on SIGTERM, interrupt or a restart once the clients
+	// have left or drainTimeout has passed; closing the listeners
+	// makes the accept loops wait for the handlers to finish
+	var draining atomic.Bool
+	ctx, cancel := drainOnSignal(connectionPool, &draining)
+	defer cancel()
+	context.AfterFunc(ctx, func() {
+		log.Print("Shutting down")
+		ln.Close()
+		if tlsListener != nil {
+			tlsListener.Close()
+		}
+	})
+
+	if config.adminAddr != "" {
+		admin := http.NewServeMux()
+		newScheduleRunner(bus).register(admin)
+		registerUsersAPI(admin, connectionPool, audit)
+		audit.register(admin)
+		connLog.register(admin)
+		metrics.register(admin, bus, processed)
+		stats := newStatsCollector(connectionPool, bus, metrics)
+		go stats.run(config.statsInterval)
+		stats.register(admin)
+		deadLetters.register(admin)
+		registerConfigAPI(admin, config, live, startedAt)
+		registerHistoryAPI(admin, history)
+		analytics.register(admin)
+		registerRestartAPI(admin, connectionPool, &draining, cancel, config.restartExec, &reexec)
+		if config.enablePprof {
+			registerPprof(admin, config.pprofDir)
+		}
+		go serveAdmin(config.adminAddr, admin)
+	}
+
+	go watchAway(connectionPool)
+	go watchSlowConsumers(connectionPool, metrics, config.autoKickSlow, live, audit)
 
 	threadGroup.Add(1)
-	go serverBroadCast(&connectionPool, &messageChannel, &threadGroup, &messageHistory)
+	go serverBroadCast(ctx, connectionPool, broadcasts, format, &threadGroup, history, lpClients, multicast, processed, middleware, scanner, metrics, deadLetters, analytics)
 
+	if lpClients != nil {
+		// long-polling clients talk HTTP on the same listeners
+		handler := lpClients.handler(bus, connectionPool, live, connLog, reputation, metrics, &draining)
+		if tlsListener != nil {
+			metrics.listeners.Add(1)
+			go func() {
+				defer metrics.listeners.Add(-1)
+				log.Print(http.Serve(tls.NewListener(tlsListener, tlsConfig), handler))
+			}()
+		}
+		metrics.listeners.Add(1)
+		defer metrics.listeners.Add(-1)
+		log.Print(http.Serve(ln, handler))
+		return
+	}
+
+	// tracks live client handlers so they can be drained on restart
+	var handlerGroup sync.WaitGroup
+	watchRestart(ln, tlsListener)
+
+	// wrapped after watchRestart, which needs the raw sockets to hand
+	// over; always wrapped so that a limit can be set at runtime
+	ln = newLimitedListener(ln, live, connLog)
+	if tlsListener != nil {
+		tlsListener = newLimitedListener(tlsListener, live, connLog)
+	}
+
+	if tlsListener != nil {
+		go acceptConnections(ctx, tlsListener, tlsConfig, config, &handlerGroup, &draining, connectionPool, bus, format, welcome, history, connLog, reputation, audit, metrics, live)
+	}
+	acceptConnections(ctx, ln, nil, config, &handlerGroup, &draining, connectionPool, bus, format, welcome, history, connLog, reputation, audit, metrics, live)
+}
+
+// Opens the listening socket for a port on the host interface, or
+// takes over the one handed down by a restarting parent if inheritFD
+// is set. An inherited socket keeps the parent's backlog and buffer.
+func listen(host string, port int, inheritFD int, backlog int, rcvbuf int) (net.Listener, error) {
+	if inheritFD > 0 {
+		file := os.NewFile(uintptr(inheritFD), "listener")
+		defer file.Close()
+		return net.FileListener(file)
+	}
+
+	lc := net.ListenConfig{Control: listenControl(rcvbuf)}
+	ln, err := lc.Listen(context.Background(), "tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return nil, err
+	}
+	if err := setListenBacklog(ln, backlog); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// Like listen, but while the port is in use tries again up to retries
+// times, delay apart. When a process manager restarts the server the
+// old process can hold the port for a moment.
+func listenWithRetry(host string, port int, inheritFD int, backlog int, rcvbuf int, retries int, delay time.Duration) (net.Listener, error) {
+	for attempt := 0; ; attempt++ {
+		ln, err := listen(host, port, inheritFD, backlog, rcvbuf)
+		if err == nil || attempt >= retries || !errors.Is(err, syscall.EADDRINUSE) {
+			return ln, err
+		}
+		log.Printf("Port in use, retrying in %v...", delay)
+		time.Sleep(delay)
+	}
+}
+
+// Accepts clients on ln until it is closed, starting a handler for
+// each one. Connections are wrapped in TLS when tlsConfig is set.
+func acceptConnections(ctx context.Context, ln net.Listener, tlsConfig *tls.Config, config serverConfig, handlerGroup *sync.WaitGroup,
+	draining *atomic.Bool, connectionPool *safePool, bus *MessageBus, format *template.Template, welcome *template.Template,
+	history *messageHistory, connLog *connectionLog, reputation *ipReputation, audit *userAuditLog, metrics *serverMetrics, live *liveConfig) {
+	metrics.listeners.Add(1)
 	for {
 		conn, err := ln.Accept()
-		if err != nil {
+		if errors.Is(err, net.ErrClosed) {
+			// the listener was closed for a restart or shutdown,
+			// so finish serving the clients we already have
+			metrics.listeners.Add(-1)
+			log.Print("Draining existing connections")
+			handlerGroup.Wait()
+			return
+		} else if err != nil {
 			log.Print(err)
 			continue
 		}
+		if draining.Load() {
+			// off the accept loop, as closing gracefully waits for the client
+			go func() {
+				sendError(conn, drainingText)
+				closeGracefully(conn)
+			}()
+			continue
+		}
+		configureKeepAlive(conn, config.keepAlive)
+		conn = simulateLatency(conn)
+
+		if tlsConfig != nil {
+			conn = tls.Server(conn, tlsConfig)
+		}
 
-		go handleConnection(conn, &connectionPool, &messageChannel, &messageHistory)
+		handlerGroup.Add(1)
+		go func() {
+			defer handlerGroup.Done()
+			handleConnection(ctx, conn, config, connectionPool, bus, format, welcome, history, connLog, reputation, audit, metrics, live)
+		}()
 
 	}
-
 }
 
-func handleConnection(conn net.Conn, connectionPool *map[string]user, messageChannel *chan messagePacket, messageHistory *[]messagePacket) {
+func handleConnection(ctx context.Context, conn net.Conn, config serverConfig, connectionPool *safePool, bus *MessageBus,
+	format *template.Template, welcome *template.Template, history *messageHistory, connLog *connectionLog,
+	reputation *ipReputation, audit *userAuditLog, metrics *serverMetrics, live *liveConfig) {
 	defer conn.Close()
 	connectionAddress := conn.RemoteAddr().String()
 
-	// read username
-	userBuf := make([]byte, 1024)
-	size, err := conn.Read(userBuf)
+	var flags []string
+	switch label := reputation.lookup(conn.RemoteAddr()); label {
+	case "":
+	case reputationMalicious:
+		log.Print("Rejected connection from malicious network: ", connectionAddress)
+		connLog.record(conn.RemoteAddr(), "", outcomeRejectedReputation)
+		sendError(conn, "connection refused")
+		closeGracefully(conn)
+		return
+	default:
+		log.Print("Warning: connection from ", label, " network: ", connectionAddress)
+		flags = append(flags, label)
+	}
+
+	// on cancellation, expire the read deadline so a
+	// blocked Read returns and the handler can exit (on the
+	// connection itself, as conn is replaced by the queue below)
+	raw := conn
+	stop := context.AfterFunc(ctx, func() { raw.SetReadDeadline(time.Now()) })
+	defer stop()
 
+	// read the client's hello, if any, and username
+	hello, name, err := readHandshake(conn)
 	if err != nil {
 		log.Print(err)
 		return
 	}
+	if hello.ClientVersion != "" {
+		log.Print("Client version ", hello.ClientVersion, " from ", connectionAddress)
+	}
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		logTLSState(tlsConn)
+	}
 
-	name := strings.TrimSpace(string(userBuf[:size]))
+	if config.minClientVersion != "" && olderThan(hello.ClientVersion, config.minClientVersion) {
+		log.Print("Rejected client version ", strconv.Quote(hello.ClientVersion), " from ", connectionAddress)
+		connLog.record(conn.RemoteAddr(), name, outcomeRejectedVersion)
+		sendError(conn, "client too old, please upgrade")
+		closeGracefully(conn)
+		return
+	}
+
+	anonymous := name == "" && config.allowAnonymous
+	if anonymous {
+		name = guestName(connectionPool)
+	}
+
+	offerMulticast := config.transport == "multicast" && supportsMulticast(hello)
+
+	stats := newUserStats()
+	out := newQueuedConn(conn, stats)
+	defer out.Close()
 
 	var newUser = user{
-		connection: conn,
+		connection: out,
 		username:   name,
+		anonymous:  anonymous,
+		stats:      stats,
+
+		clientVersion: hello.ClientVersion,
+		multicast:     &atomic.Bool{},
+		flags:         flags,
+	}
+
+	err = validateUsername(name, connectionPool)
+	if err == nil {
+		err = connectionPool.addIfAbsent(connectionAddress, newUser)
+	}
+	if err != nil {
+		log.Print("Rejected username ", strconv.Quote(name), ": ", err)
+		connLog.record(conn.RemoteAddr(), name, outcomeRejectedAuth)
+		sendError(conn, err.Error())
+		closeGracefully(conn)
+		return
 	}
+	connLog.record(conn.RemoteAddr(), name, outcomeAccepted)
 
-	(*connectionPool)[connectionAddress] = newUser
+	// from here on, everything sent to the client is queued,
+	// in order with the broadcasts
+	conn = out
+
+	if offerMulticast {
+		sendCommand(conn, "join_multicast", multicastAddr(config))
+	}
+
+	broadcastPresence(connectionPool, connectionAddress, "join", name)
+	audit.record(name, auditJoin, "from "+connectionAddress)
+	defer func() {
+		connectionPool.remove(connectionAddress)
+		broadcastPresence(connectionPool, connectionAddress, "leave", name)
+		audit.record(name, auditLeave, "")
+	}()
 
 	log.Print("New connection from user ", name)
 
 	// retroactively send them messages
-	for _, packet := range *messageHistory {
-		res := "BROADCAST " + packet.sender + ": " + packet.text + "\n"
+	for _, packet := range history.snapshot() {
+		res := formatBroadcast(format, packet)
 
 		conn.Write([]byte(res))
 	}
+	if err := sendWelcome(conn, welcome, name, connectionPool); err != nil {
+		log.Print("Welcome message: ", err)
+	}
+	sendPresenceList(conn, connectionPool)
+
+	var limiter *slidingWindowLimiter
 
 	for {
 		// block until message received
-		buffer := make([]byte, 1024)
+		buffer := make([]byte, maxMessageSize)
 
 		size, err := (conn).Read(buffer)
 
@@ -125,53 +543,149 @@ func handleConnection(conn net.Conn, connectionPool *map[string]user, messageCha
 			log.Print(name, " has disconnected")
 			return
 		} else if err != nil {
-			log.Print(err)
+			log.Print(name, " has disconnected: ", err)
+			return
+		}
+		newUser.stats.received(size)
+
+		text := strings.TrimSpace(string(buffer[:size]))
+		// requests answered to this client alone, not broadcast
+		switch packetType, raw := decodePacket(text); packetType {
+		case "export_request":
+			sendExport(conn, history.snapshot())
+			continue
+		case "ping_echo":
+			var ping pingPacket
+			json.Unmarshal(raw, &ping)
+			sendPong(conn, ping)
+			continue
+		case "multicast_joined":
+			if offerMulticast {
+				newUser.multicast.Store(true)
+			}
+			continue
+		}
+		if err := validateMessage(text, DefaultRules); err != nil {
+			sendError(conn, err.Error())
+			continue
+		}
+		limiter = liveLimiter(limiter, live)
+		if limiter != nil && !limiter.Allow() {
+			sendError(conn, rateLimitedText)
+			continue
+		}
+		if newUser.anonymous {
+			text = "[guest] " + text
 		}
 
 		packet := messagePacket{
-			text:   strings.TrimSpace(string(buffer[:size])),
+			text:   text,
 			source: connectionAddress,
 			sender: name,
 		}
-		*messageChannel <- packet
+
+		// rather than stall this client while the broadcaster
+		// catches up, drop the message and tell them
+		if !bus.tryPublish(packet) {
+			metrics.queueOverflow.Add(1)
+			sendError(conn, serverBusyText)
+		}
 
 		buffer = nil
 
 	}
 }
 
-func serverBroadCast(connectionPool *map[string]user, messageChannel *chan messagePacket,
-	threadGroup *sync.WaitGroup, messageHistory *[]messagePacket) {
+func serverBroadCast(ctx context.Context, connectionPool *safePool, messages <-chan messagePacket, format *template.Template,
+	threadGroup *sync.WaitGroup, history *messageHistory, lpClients *lpHub, multicast *multicastSender, processed *MessageBus,
+	middleware []Middleware, scanner ContentScanner, metrics *serverMetrics, deadLetters *deadLetterQueue, analytics *Analytics) {
 	defer threadGroup.Done()
 
 	for {
-		packet := <-*messageChannel
+		var packet messagePacket
+		replay := false
+		select {
+		case packet = <-messages:
+		case packet = <-deadLetters.replays:
+			// already processed and in the history
+			replay = true
+		case <-ctx.Done():
+			return
+		}
 
-		// add packet to history
-		*messageHistory = append(*messageHistory, packet)
+		if !replay {
+			packet.timestamp = time.Now()
+			packet.text, packet.tags = extractTags(packet.text)
+			for _, m := range middleware {
+				m.Process(&packet)
+			}
+			if !scanMessage(scanner, connectionPool, &packet) {
+				continue
+			}
+
+			packet = history.append(packet)
+			metrics.messages.Add(1)
+			metrics.messageBytes.Add(uint64(len(packet.text)))
+			analytics.record(packet.sender, packet.timestamp)
+			if processed != nil && !processed.tryPublish(packet) {
+				processed.dropped.Add(1)
+			}
+		}
 
-		for _, userConn := range *connectionPool {
+		delivered := 0
+		multicasted := multicast != nil && multicast.send(packet.source, formatBroadcast(format, packet))
+		for _, userConn := range connectionPool.snapshot() {
 			// don't want to send broadcast to the source address
-			if packet.source != userConn.connection.RemoteAddr().String() {
-				res := "BROADCAST " + packet.sender + ": " + packet.text
+			if packet.source == userConn.connection.RemoteAddr().String() {
+				continue
+			}
+			if multicasted && userConn.multicast.Load() {
+				delivered++
+				continue
+			}
+			res := formatBroadcast(format, packet)
 
-				userConn.connection.Write([]byte(res))
+			// counted in the user's stats once written
+			if userConn.connection.writeBroadcast([]byte(res)) == nil {
+				delivered++
 			}
+		}
 
+		if lpClients != nil && !replay {
+			delivered += lpClients.publish(packet)
+		}
+
+		if delivered == 0 {
+			deadLetters.add(packet)
 		}
 	}
 }
 
+// Shared by every read from the terminal, so that
+// input buffered by one read isn't lost to the next.
+var stdin = bufio.NewReader(os.Stdin)
+
 // Helper function reads a line of input from
 // the terminal. Roughly equivalent to Python
 // 3's input(). Removes leading and trailing
 // whitespace.
 func readln() string {
-	reader := bufio.NewReader(os.Stdin)
-	text, _ := reader.ReadString('\n')
+	text, _ := stdin.ReadString('\n')
 	return strings.TrimSpace(text)
 }
 
+// Options for client mode, filled in from the command line.
+type clientConfig struct {
+	endpoint  string
+	keepAlive time.Duration
+	tls       bool
+	tlsCA     string // PEM file of extra trusted CAs, for self-signed servers
+	markdown  bool   // render Markdown in messages as ANSI styles
+
+	srvDomain  string // find the server through DNS SRV records instead of endpoint
+	srvTimeout time.Duration
+}
+
 // This function starts a new client session by connecting
 // to the server at the given endpoint.
 //
@@ -187,62 +701,258 @@ func readln() string {
 //	  the server.
 //	Wait for the user to type messages, and
 //	  send them to the server.
-func client(serverEndpoint string, port int) {
+func client(config clientConfig) {
 	var threadGroup sync.WaitGroup
 	fmt.Print("Enter your username: ")
 	username := readln()
 	_ = username // ignore unused variable
 
-	fmt.Println("Connecting to", serverEndpoint)
-	conn, err := net.Dial("tcp4", serverEndpoint)
+	endpoints := []string{config.endpoint}
+	if config.srvDomain != "" {
+		var err error
+		endpoints, err = lookupEndpoints(net.DefaultResolver, config.srvDomain, config.srvTimeout)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	fmt.Println("Connecting to", strings.Join(endpoints, ", "))
+	conn, config, err := connectAny(config, endpoints, username)
 
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	defer conn.Close()
-
-	// send server username
-	conn.Write([]byte(username))
+	out := newOutbox(conn)
+	defer out.close()
 
 	threadGroup.Add(1)
 
-	go clientSendMessage(&conn, &threadGroup)
-	go clientReceiveMessage(&conn, &threadGroup)
+	present := newPresentUsers()
+	exports := &pendingExport{}
+	pongs := make(chan pongPacket, latencyProbes)
+	highlights := loadHighlighter()
+	go clientSendMessage(out, &threadGroup, present, exports, pongs, highlights)
+	go clientReceiveMessage(conn, out, &threadGroup, config, username, present, exports, pongs, highlights)
 
 	threadGroup.Wait()
 
 	return
 }
 
-func clientReceiveMessage(conn *net.Conn, group *sync.WaitGroup) {
-	defer (*conn).Close()
-	// reader := bufio.NewReader(*conn)
+// Dials the server and announces the username, so
+// the server starts the history replay.
+func connect(config clientConfig, username string) (net.Conn, error) {
+	conn, err := net.Dial("tcp4", config.endpoint)
+	if err != nil {
+		return nil, err
+	}
+	configureKeepAlive(conn, config.keepAlive)
 
-	for {
+	if config.tls {
+		tlsConn, err := clientTLS(conn, config)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	if err := sendHello(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// send server username, newline-terminated so that an
+	// empty (anonymous) username still reaches the server
+	if _, err := conn.Write([]byte(username + "\n")); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Performs the TLS handshake on a freshly dialed connection.
+func clientTLS(conn net.Conn, config clientConfig) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(config.endpoint)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{ServerName: host}
+
+	if config.tlsCA != "" {
+		pem, err := os.ReadFile(config.tlsCA)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in " + config.tlsCA)
+		}
+	}
+
+	tlsConn := tls.Client(conn, tlsConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, err
+	}
+	return tlsConn, nil
+}
 
-		// text, err := reader.ReadString('\n')
+func clientReceiveMessage(conn net.Conn, out *outbox, group *sync.WaitGroup, config clientConfig, username string,
+	present *presentUsers, exports *pendingExport, pongs chan<- pongPacket, highlights *highlighter) {
+	defer out.close()
+	reader := bufio.NewReader(conn)
+	multicast := &multicastReceiver{}
 
-		buffer := make([]byte, 1024)
+	for {
 
-		size, err := (*conn).Read(buffer)
+		text, err := reader.ReadString('\n')
 
 		if err == io.EOF {
 			log.Fatal("Server has closed")
 			return
 		} else if err != nil {
-			log.Print(err)
+			log.Fatal(err)
 		}
 
-		fmt.Println(strings.TrimSpace(string(buffer[:size])))
+		text = strings.TrimSpace(text)
+
+		packetType, raw := decodePacket(text)
+		switch packetType {
+		case "", "multiline":
+			printBroadcast(text, config, highlights)
+
+		case "error":
+			var message errorPacket
+			json.Unmarshal(raw, &message)
+			fmt.Println("Error:", message.Text)
+
+		case "system":
+			var packet systemPacket
+			json.Unmarshal(raw, &packet)
+			fmt.Println(packet.Text)
 
+		case "presence":
+			var event presencePacket
+			json.Unmarshal(raw, &event)
+			present.apply(event)
+
+		case "pong_echo":
+			var pong pongPacket
+			json.Unmarshal(raw, &pong)
+			// dropped if /latency has given up waiting
+			select {
+			case pongs <- pong:
+			default:
+			}
+
+		case "export_data":
+			var data exportData
+			json.Unmarshal(raw, &data)
+			path := exports.take()
+			if path == "" {
+				continue // not one we asked for
+			}
+			if err := writeExport(path, data); err != nil {
+				fmt.Println("Export failed:", err)
+			} else {
+				fmt.Println("Exported", len(data.Messages), "messages to", path)
+			}
+
+		case "command":
+			var command commandPacket
+			json.Unmarshal(raw, &command)
+			conn, reader = runCommand(command, conn, reader, out, config, username, present, multicast, highlights)
+		}
+	}
+}
+
+// Prints a broadcast from the server, either multi-line or formatted.
+func printBroadcast(text string, config clientConfig, highlights *highlighter) {
+	if packetType, raw := decodePacket(text); packetType == "multiline" {
+		var message multilinePacket
+		json.Unmarshal(raw, &message)
+		fmt.Print(highlights.apply(renderMultiline(message)))
+		return
+	}
+	text = highlights.apply(text)
+	if config.markdown {
+		text = renderMessageMarkdown(text)
+	}
+	fmt.Println(text)
+}
+
+// Carries out a command from the server, returning the connection
+// and reader to carry on with, which a redirect replaces.
+func runCommand(command commandPacket, conn net.Conn, reader *bufio.Reader, out *outbox, config clientConfig, username string,
+	present *presentUsers, multicast *multicastReceiver, highlights *highlighter) (net.Conn, *bufio.Reader) {
+	switch command.Action {
+	case "clear_screen":
+		fmt.Print("\033[H\033[2J")
+	case "set_title":
+		fmt.Print("\033]0;" + command.Payload + "\a")
+	case "join_multicast":
+		if err := multicast.join(command.Payload, conn.LocalAddr().String(), config, highlights); err != nil {
+			fmt.Println("Couldn't join multicast group:", err)
+		} else if err := confirmMulticastJoin(out); err != nil {
+			log.Print("Multicast: ", err)
+		}
+	case "redirect":
+		// reconnect to the new server and carry on reading from it
+		config.endpoint = command.Payload
+		fmt.Println("Reconnecting to", config.endpoint)
+		out.disconnect()
+		newConn, err := connect(config, username)
+		if err != nil {
+			log.Fatal(err)
+		}
+		present.reset()
+		if err := out.reconnect(newConn); err != nil {
+			log.Fatal(err)
+		}
+		return newConn, bufio.NewReader(newConn)
 	}
+	return conn, reader
 }
 
-func clientSendMessage(conn *net.Conn, group *sync.WaitGroup) {
+func clientSendMessage(out *outbox, group *sync.WaitGroup, present *presentUsers, exports *pendingExport,
+	pongs <-chan pongPacket, highlights *highlighter) {
 	for {
-		text := readln()
-		if _, err := (*conn).Write([]byte(text)); err != nil {
+		line, err := stdin.ReadString('\n')
+		if err != nil && line == "" {
+			return // stdin closed; keep showing messages until the server hangs up
+		}
+		text := strings.TrimSpace(line)
+		if text == usersCommand {
+			// answered from the presence events, not the server
+			fmt.Println("Users:", strings.Join(present.names(), ", "))
+			continue
+		}
+		if text == highlightCommand || strings.HasPrefix(text, highlightCommand+" ") {
+			highlights.command(strings.TrimPrefix(text, highlightCommand))
+			continue
+		}
+		if text == latencyCommand {
+			if err := measureLatency(out, pongs); err != nil {
+				fmt.Println("Latency check failed:", err)
+			}
+			continue
+		}
+		if text == exportCommand || strings.HasPrefix(text, exportCommand+" ") {
+			path := strings.TrimSpace(strings.TrimPrefix(text, exportCommand))
+			if err := exports.request(out, path); err != nil {
+				log.Fatal(err)
+			}
+			continue
+		}
+		if text == multilineStart {
+			text = readMultiline()
+		}
+		if err := validateMessage(text, DefaultRules); err != nil {
+			fmt.Println("Not sent:", err)
+			continue
+		}
+		if err := out.send(text); err != nil {
 			log.Fatal(err)
 		}
 	}
@@ -260,17 +970,132 @@ func main() {
 	case "server":
 		// If we are running in server mode, listen on
 		// the usual port
-		server(port)
+		var config serverConfig
+		flags := flag.NewFlagSet("server", flag.ExitOnError)
+		flags.StringVar(&config.listenAddr, "listen-addr", "0.0.0.0", "interface to listen on: 0.0.0.0 for all IPv4, :: for all IPv6, 127.0.0.1 for local clients only")
+		flags.IntVar(&config.port, "port", port, "port for plain TCP clients")
+		flags.IntVar(&config.tlsPort, "tls-port", 0, "port for TLS clients, 0 to disable")
+		flags.StringVar(&config.tlsCert, "tls-cert", "", "PEM certificate for the TLS port")
+		flags.StringVar(&config.tlsKey, "tls-key", "", "PEM private key for the TLS port")
+		flags.StringVar(&config.tlsMinVersion, "tls-min-version", "1.2", "oldest TLS version to accept: 1.2 or 1.3")
+		flags.StringVar(&config.tlsCiphers, "tls-ciphers", "", "comma-separated TLS 1.2 cipher suites to allow, such as TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384")
+		flags.IntVar(&config.listenBacklog, "listen-backlog", 0, "queue length for connections not yet accepted, capped by net.core.somaxconn; 0 for the system default (Linux only)")
+		flags.IntVar(&config.listenRcvbuf, "listen-rcvbuf", 0, "receive buffer size in bytes for accepted connections, 0 for the system default (Linux only)")
+		flags.IntVar(&config.bindRetryCount, "bind-retry-count", 0, "times to retry binding a port that is in use before giving up")
+		flags.DurationVar(&config.bindRetryDelay, "bind-retry-delay", time.Second, "how long to wait between -bind-retry-count attempts")
+		flags.IntVar(&config.inheritFD, "inherit-fd", 0, "accept on an already-open listening socket (used by restarts)")
+		flags.IntVar(&config.inheritTLSFD, "inherit-tls-fd", 0, "like -inherit-fd, for the TLS port")
+		flags.DurationVar(&config.keepAlive, "tcp-keepalive-interval", defaultKeepAlive, "TCP keepalive probe interval, 0 to disable")
+		flags.StringVar(&config.transport, "transport", "tcp", "client transport: tcp, lp for HTTP long-polling, or multicast (experimental) for broadcasts over UDP multicast")
+		flags.StringVar(&config.wireFormat, "wire-format", "json", "encoding -transport lp clients may ask for: json, or gob for batches of messages")
+		flags.StringVar(&config.multicastGroup, "multicast-group", "239.0.0.1", "group address for -transport multicast")
+		flags.IntVar(&config.multicastPort, "multicast-port", 8012, "UDP port for -transport multicast")
+		flags.BoolVar(&config.allowAnonymous, "allow-anonymous", false, "let clients connect without a username as guests")
+		flags.IntVar(&config.queueSize, "message-queue-size", 10000, "messages waiting for broadcast before new ones are dropped")
+		flags.DurationVar(&config.statsInterval, "stats-interval", 10*time.Second, "how often the admin API samples server statistics")
+		flags.BoolVar(&config.noBanner, "no-banner", false, "don't print the startup banner")
+		flags.StringVar(&config.adminAddr, "admin-addr", "", "address for the admin HTTP API, such as 127.0.0.1:8080")
+		flags.StringVar(&config.connectionLog, "connection-log", "", "append connection attempts to this file as NDJSON")
+		flags.StringVar(&config.emojiCodesFile, "emoji-codes-file", "", "JSON file mapping :shortcodes: to emoji")
+		flags.StringVar(&config.sentimentDir, "sentiment-lexicon-dir", "", "tag messages by sentiment using positive_words.txt and negative_words.txt in this directory")
+		flags.StringVar(&config.slackWebhookURL, "slack-webhook-url", "", "post messages to this Slack incoming webhook")
+		flags.StringVar(&config.slackChannel, "slack-channel", "", "override the webhook's default Slack channel")
+		flags.StringVar(&config.contentScannerURL, "content-scanner-url", "", "POST each message to this HTTP service to be allowed, redacted or blocked")
+		flags.BoolVar(&config.scannerFailOpen, "content-scanner-fail-open", false, "let messages through when the content scanner fails or times out, rather than block them")
+		flags.StringVar(&config.messageFormat, "message-format", defaultMessageFormat, "text/template for broadcast lines, with {{.Sender}}, {{.Text}} and {{.Timestamp}}")
+		flags.IntVar(&config.maxPerIP, "max-connections-per-ip", defaultMaxConnectionsPerIP, "connections allowed at once from one IP address, 0 for no limit")
+		flags.BoolVar(&config.autoKickSlow, "auto-kick-slow-consumers", false, "disconnect users who fall too far behind on what is sent to them")
+		flags.UintVar(&config.slowThreshold, "slow-consumer-threshold", defaultSlowThreshold, "lines waiting to be written before -auto-kick-slow-consumers disconnects a user")
+		flags.StringVar(&config.analyticsFile, "analytics-file", "", "save daily usage statistics to this JSON file")
+		flags.IntVar(&config.rateLimit, "rate-limit", 0, "messages each client may send per rate window, 0 for no limit")
+		flags.DurationVar(&config.rateWindow, "rate-window", defaultRateWindow, "the sliding window -rate-limit counts messages over")
+		flags.DurationVar(&config.historyMaxAge, "history-max-age", 0, "don't replay messages older than this to new clients, e.g. 24h; 0 to replay them all")
+		flags.StringVar(&config.welcomeMessage, "welcome-message", "", "text/template sent to each new user after the history, with {{.Username}}, {{.UserCount}} and {{.ServerVersion}}")
+		flags.BoolVar(&config.restartExec, "restart-exec", false, "on POST /api/restart, replace the process with a fresh copy rather than exiting")
+		flags.StringVar(&config.ipReputation, "ip-reputation-file", "", "JSON file of CIDR networks to \"malicious\", refused, or other labels, logged; reloaded on SIGHUP")
+		flags.BoolVar(&config.enablePprof, "enable-pprof", false, "serve profiling data under /debug/ on the admin API")
+		flags.StringVar(&config.pprofDir, "pprof-dir", os.TempDir(), "directory the admin API writes heap and CPU profiles to")
+		flags.StringVar(&config.minClientVersion, "min-client-version", "", "refuse clients older than this version, such as 1.2.0")
+		registerSimulationFlags(flags)
+		flags.Parse(os.Args[2:])
+		if config.transport != "tcp" && config.transport != "lp" && config.transport != "multicast" {
+			log.Fatal("Unknown transport ", config.transport)
+		}
+		if _, err := parseWireFormat(config.wireFormat); err != nil {
+			log.Fatal("Invalid -wire-format: ", err)
+		}
+		if config.tlsPort > 0 && (config.tlsCert == "" || config.tlsKey == "") {
+			log.Fatal("-tls-port requires -tls-cert and -tls-key")
+		}
+		if _, err := parseTLSVersion(config.tlsMinVersion); err != nil {
+			log.Fatal("Invalid -tls-min-version: ", err)
+		}
+		if _, err := parseCipherSuites(config.tlsCiphers); err != nil {
+			log.Fatal("Invalid -tls-ciphers: ", err)
+		}
+		if u, err := url.Parse(config.contentScannerURL); config.contentScannerURL != "" && (err != nil || (u.Scheme != "http" && u.Scheme != "https")) {
+			log.Fatal("-content-scanner-url must be an http or https URL")
+		}
+		if _, err := parseMessageFormat(config.messageFormat); err != nil {
+			log.Fatal("Invalid -message-format: ", err)
+		}
+		if _, err := parseWelcomeMessage(config.welcomeMessage); err != nil {
+			log.Fatal("Invalid -welcome-message: ", err)
+		}
+		if _, ok := parseVersion(config.minClientVersion); config.minClientVersion != "" && !ok {
+			log.Fatal("Invalid -min-client-version ", config.minClientVersion)
+		}
+		if config.statsInterval <= 0 {
+			log.Fatal("-stats-interval must be positive")
+		}
+		if config.rateLimit < 0 || config.rateLimit > maxRateLimit {
+			log.Fatal("-rate-limit must be between 0 and ", maxRateLimit)
+		}
+		if config.rateWindow <= 0 {
+			log.Fatal("-rate-window must be positive")
+		}
+		server(config)
 
 	case "client":
 		// If we are running in client mode, start
 		// by connecting to the specified server
-		if len(os.Args) != 3 {
+		var config clientConfig
+		flags := flag.NewFlagSet("client", flag.ExitOnError)
+		flags.BoolVar(&config.tls, "tls", false, "connect to the server's TLS port")
+		flags.StringVar(&config.tlsCA, "tls-ca", "", "PEM file of CA certificates to trust")
+		flags.BoolVar(&config.markdown, "markdown", false, "render **bold**, *italic*, `code` and # headings in messages")
+		flags.DurationVar(&config.keepAlive, "tcp-keepalive-interval", defaultKeepAlive, "TCP keepalive probe interval, 0 to disable")
+		flags.StringVar(&config.srvDomain, "srv-domain", "", "find the server from the _chat._tcp SRV records of this domain")
+		flags.DurationVar(&config.srvTimeout, "srv-timeout", defaultSRVTimeout, "how long to wait for the SRV lookup")
+		flags.Parse(os.Args[2:])
+		switch {
+		case flags.NArg() == 1:
+			config.endpoint = flags.Arg(0)
+		case flags.NArg() == 0 && config.srvDomain != "":
+			// the endpoint comes from DNS
+		default:
 			log.Fatal("Insufficient parameters")
 		}
-		client(os.Args[2], port)
+		client(config)
+
+	case "stress":
+		// Generate load against a running server
+		var config stressConfig
+		flags := flag.NewFlagSet("stress", flag.ExitOnError)
+		flags.StringVar(&config.server, "server", "127.0.0.1:8011", "address of the server to test")
+		flags.IntVar(&config.clients, "clients", 100, "number of clients to connect")
+		flags.DurationVar(&config.duration, "duration", 30*time.Second, "how long to send messages for")
+		flags.Float64Var(&config.rate, "rate", 50, "messages per second sent by each client")
+		flags.Float64Var(&config.maxErrorRate, "max-error-rate", 0.01, "fraction of errors above which the test fails")
+		flags.Parse(os.Args[2:])
+		if config.clients < 1 || config.rate <= 0 || config.duration <= 0 {
+			log.Fatal("-clients, -rate and -duration must be positive")
+		}
+		if !stress(config) {
+			os.Exit(1)
+		}
 
 	default:
-		log.Fatal("Please use subcommand 'server' or 'client'")
+		log.Fatal("Please use subcommand 'server', 'client' or 'stress'")
 	}
 }
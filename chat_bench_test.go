@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Adds n users to the pool, each connected by a net.Pipe whose client
+// end is read and thrown away.
+func addPipeUsers(tb testing.TB, pool *safePool, n int) {
+	for i := 0; i < n; i++ {
+		server, client := net.Pipe()
+		tb.Cleanup(func() {
+			server.Close()
+			client.Close()
+		})
+		go io.Copy(io.Discard, client)
+		address := fmt.Sprintf("10.0.%d.%d:5000", i/256, i%256)
+		pool.addIfAbsent(address, newTestUser(tb, server, fmt.Sprintf("user%d", i)))
+	}
+}
+
+// Adds a user like addPipeUsers, returning the number of lines they
+// have read so far.
+func addCountingUser(tb testing.TB, pool *safePool) *atomic.Int64 {
+	server, client := net.Pipe()
+	tb.Cleanup(func() {
+		server.Close()
+		client.Close()
+	})
+	read := &atomic.Int64{}
+	go func() {
+		lines := bufio.NewScanner(client)
+		for lines.Scan() {
+			read.Add(1)
+		}
+	}()
+	pool.addIfAbsent("10.1.0.1:5000", newTestUser(tb, server, "counter"))
+	return read
+}
+
+// Waits for the counting user to have read want lines, then for
+// everyone else to have been written what is queued for them. Sending
+// half a send queue between waits, the queues never overflow, though
+// the broadcaster may not have queued the last message for everyone.
+func waitForBroadcasts(pool *safePool, read *atomic.Int64, want int) {
+	for read.Load() < int64(want) {
+		runtime.Gosched()
+	}
+	for _, u := range pool.snapshot() {
+		for u.connection.depth() > 0 {
+			runtime.Gosched()
+		}
+	}
+}
+
+// Runs serverBroadCast on messages for the pool, with the default
+// format and no middleware, until the test ends.
+func startBroadcaster(tb testing.TB, pool *safePool, messages <-chan messagePacket) *messageHistory {
+	return runBroadcaster(tb, pool, messages, nil, nil, NoopScanner{}, newDeadLetterQueue())
+}
+
+// Like startBroadcaster, publishing what it lets through on processed
+// if that is set, and with the given middleware, scanner and
+// dead-letter queue.
+func runBroadcaster(tb testing.TB, pool *safePool, messages <-chan messagePacket, processed *MessageBus,
+	middleware []Middleware, scanner ContentScanner, deadLetters *deadLetterQueue) *messageHistory {
+	format, err := parseMessageFormat(defaultMessageFormat)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	analytics, err := newAnalytics("")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	history := newMessageHistory(0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var threadGroup sync.WaitGroup
+	threadGroup.Add(1)
+	go serverBroadCast(ctx, pool, messages, format, &threadGroup, history, nil, nil, processed, middleware, scanner, &serverMetrics{}, deadLetters, analytics)
+	tb.Cleanup(func() {
+		cancel()
+		threadGroup.Wait()
+	})
+	return history
+}
+
+// Times each message from being handed to the broadcaster until the
+// last of users has read it.
+func benchmarkBroadcast(b *testing.B, users int) {
+	pool := newSafePool()
+	addPipeUsers(b, pool, users-1)
+	read := addCountingUser(b, pool)
+	messages := make(chan messagePacket)
+	startBroadcaster(b, pool, messages)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if i > 0 && i%(sendQueueSize/2) == 0 {
+			waitForBroadcasts(pool, read, i)
+		}
+		messages <- messagePacket{text: "hello everyone", source: "10.2.0.1:5000", sender: "alice"}
+	}
+	waitForBroadcasts(pool, read, b.N)
+}
+
+func BenchmarkBroadcast1(b *testing.B)    { benchmarkBroadcast(b, 1) }
+func BenchmarkBroadcast100(b *testing.B)  { benchmarkBroadcast(b, 100) }
+func BenchmarkBroadcast1000(b *testing.B) { benchmarkBroadcast(b, 1000) }
+
+// Ten clients publishing through the bus at once, as their connection
+// handlers do, to a hundred users.
+func BenchmarkConcurrentSenders10(b *testing.B) {
+	const senders = 10
+	pool := newSafePool()
+	addPipeUsers(b, pool, 99)
+	read := addCountingUser(b, pool)
+	bus := newMessageBus(100)
+	startBroadcaster(b, pool, bus.subscribe())
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for sent := 0; sent < b.N; sent += sendQueueSize / 2 {
+		batch := min(sendQueueSize/2, b.N-sent)
+		var wg sync.WaitGroup
+		for s := 0; s < senders; s++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				source := fmt.Sprintf("10.2.0.%d:5000", s)
+				for i := s; i < batch; i += senders {
+					bus.publish(messagePacket{text: "hello everyone", source: source, sender: "alice"})
+				}
+			}()
+		}
+		wg.Wait()
+		waitForBroadcasts(pool, read, sent+batch)
+	}
+}
+
+// The replay of the history to a client that has just joined, as
+// handleConnection does it.
+func BenchmarkHistoryReplay1000(b *testing.B) {
+	format, err := parseMessageFormat(defaultMessageFormat)
+	if err != nil {
+		b.Fatal(err)
+	}
+	history := newMessageHistory(0)
+	for i := 0; i < 1000; i++ {
+		history.append(messagePacket{sender: "alice", text: fmt.Sprintf("message %d", i), timestamp: time.Now()})
+	}
+	server, client := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go io.Copy(io.Discard, client)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, packet := range history.snapshot() {
+			res := formatBroadcast(format, packet)
+
+			server.Write([]byte(res))
+		}
+	}
+}
+
+// What the server does with each line a client sends before queueing
+// it: checking for a packet, validating it and taking out its tags.
+func BenchmarkMessageParsing(b *testing.B) {
+	lines := []struct {
+		name string
+		line string
+	}{
+		{"text", "hello everyone, the build is done"},
+		{"tagged", "Build done #build_id=42 #status=ok"},
+		{"packet", `{"type":"ping_echo","payload":"1","sent_at":"2026-01-02T15:04:05Z"}`},
+	}
+	for _, bb := range lines {
+		b.Run(bb.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if packetType, _ := decodePacket(bb.line); packetType != "" {
+					continue
+				}
+				if err := validateMessage(bb.line, DefaultRules); err != nil {
+					b.Fatal(err)
+				}
+				extractTags(bb.line)
+			}
+		})
+	}
+}
+
+// Encoding one message, as for /lp/send, and a batch of 100, as for a
+// busy /lp/recv, in each wire format.
+func BenchmarkCodec(b *testing.B) {
+	message := wireMessage{Seq: 42, Sender: "alice", Text: "Build done #build_id=42 #status=ok", Tags: map[string]string{"build_id": "42", "status": "ok"}}
+	batch := make([]wireMessage, 100)
+	for i := range batch {
+		batch[i] = message
+		batch[i].Seq = i
+	}
+	for _, format := range []wireFormat{jsonWireFormat, gobWireFormat} {
+		for _, bb := range []struct {
+			name string
+			v    any
+			into func() any
+		}{
+			{"1", message, func() any { return new(wireMessage) }},
+			{"100", batch, func() any { return new([]wireMessage) }},
+		} {
+			data, err := format.codec.Marshal(bb.v)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.Run(format.name+"/marshal"+bb.name, func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					format.codec.Marshal(bb.v)
+				}
+			})
+			b.Run(format.name+"/unmarshal"+bb.name, func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					if err := format.codec.Unmarshal(data, bb.into()); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+)
+
+// Lines from the network, whether chat text or control packets, must
+// never crash the reader. Run with
+//
+//	go test -fuzz FuzzDecodePacket -fuzztime 30s
+
+func FuzzDecodePacket(f *testing.F) {
+	f.Add("hello everyone")
+	f.Add("")
+	f.Add("{")
+	f.Add("{}")
+	f.Add(`{"type":"presence","event":"join","username":"alice"}`)
+	f.Add(`{"type":"command","action":"redirect","payload":"10.0.0.1:8080"}`)
+	f.Add(`{"type":"multiline","sender":"alice","text":"one\ntwo"}`)
+	f.Add(`{"type":"export_data","messages":[{"sender":"alice","text":"hi"}]}`)
+	f.Add(`{"type":1}`)
+	f.Add(`{"type":"error","text":"x"} trailing`)
+
+	f.Fuzz(func(t *testing.T, line string) {
+		packetType, raw := decodePacket(line)
+		if packetType == "" {
+			return
+		}
+		if !strings.HasPrefix(line, "{") || !json.Valid(raw) {
+			t.Fatalf("decodePacket(%q) gave type %q for a line that isn't a JSON object", line, packetType)
+		}
+
+		// the receivers decode the packet into the struct for its
+		// type, ignoring the error
+		var command commandPacket
+		json.Unmarshal(raw, &command)
+		var message multilinePacket
+		json.Unmarshal(raw, &message)
+		renderMultiline(message)
+		var data exportData
+		json.Unmarshal(raw, &data)
+	})
+}
+
+// The long-poll API and the admin history decode and encode messages
+// as wireMessage; a message that decodes must encode and decode again
+// to the same thing.
+func FuzzParseWireMessage(f *testing.F) {
+	f.Add([]byte(`{"seq":1,"sender":"alice","text":"hello"}`))
+	f.Add([]byte(`{"sender":"bot","text":"Build done","tags":{"status":"ok"}}`))
+	f.Add([]byte(`{"sender":"alice","text":"**hi**","content_type":"text/markdown"}`))
+	f.Add([]byte(`{"seq":-1,"tags":null}`))
+	f.Add([]byte(`{"text":"\ud800"}`))
+	f.Add([]byte(`[]`))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var message wireMessage
+		if err := json.Unmarshal(data, &message); err != nil {
+			return
+		}
+		encoded, err := json.Marshal(message)
+		if err != nil {
+			t.Fatalf("encoding %+v: %v", message, err)
+		}
+		var decoded wireMessage
+		if err := json.Unmarshal(encoded, &decoded); err != nil {
+			t.Fatalf("decoding %s: %v", encoded, err)
+		}
+		if decoded.Seq != message.Seq || decoded.Sender != message.Sender || decoded.Text != message.Text ||
+			decoded.ContentType != message.ContentType || len(decoded.Tags) != len(message.Tags) {
+			t.Fatalf("%s decoded as %+v, then %+v", data, message, decoded)
+		}
+	})
+}
+
+// The start of a connection comes from anyone who can reach the port.
+func FuzzReadHandshake(f *testing.F) {
+	f.Add([]byte("alice\n"))
+	f.Add([]byte("\n"))
+	f.Add([]byte(`{"type":"client_hello","client_version":"1.2.3","supported_features":["multiline"]}` + "\nalice\n"))
+	f.Add([]byte(`{"type":"client_hello"}` + "\n"))
+	f.Add([]byte(`{"type":"client_hello","supported_features":"multiline"}`))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		server, client := net.Pipe()
+		defer server.Close()
+		go func() {
+			client.Write(data)
+			client.Close()
+		}()
+
+		_, name, err := readHandshake(server)
+		if err == nil && name != strings.TrimSpace(name) {
+			t.Fatalf("readHandshake(%q) gave the username %q, with spaces around it", data, name)
+		}
+	})
+}
@@ -0,0 +1,516 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"text/template"
+	"time"
+)
+
+// End-to-end tests: a server wired up as server() does it, on ports
+// the OS picks, with clients connecting through connect. Run with -race.
+
+const integrationTimeout = 5 * time.Second
+
+// The state a server's accept loops and broadcaster share.
+type testServer struct {
+	config    serverConfig
+	format    *template.Template
+	pool      *safePool
+	bus       *MessageBus
+	processed *MessageBus
+	history   *messageHistory
+	metrics   *serverMetrics
+	draining  atomic.Bool
+
+	ctx          context.Context
+	cancel       context.CancelFunc
+	listeners    []net.Listener
+	acceptLoops  sync.WaitGroup
+	handlerGroup sync.WaitGroup
+	threadGroup  sync.WaitGroup
+	stopOnce     sync.Once
+}
+
+// Starts a server with its broadcaster and a plain TCP listener,
+// stopped when the test ends.
+func startTestServer(t *testing.T) *testServer {
+	return startTestServerWith(t, serverConfig{transport: "tcp"}, nil)
+}
+
+// Starts a server as startTestServer does, but with config, and
+// multicasting broadcasts through multicast if it isn't nil.
+func startTestServerWith(t *testing.T, config serverConfig, multicast *multicastSender) *testServer {
+	s, err := newTestServer(config, multicast)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.stop)
+	return s
+}
+
+// Starts a server, for startTestServerWith or for the tests to share,
+// which must be stopped.
+func newTestServer(config serverConfig, multicast *multicastSender) (*testServer, error) {
+	s := &testServer{
+		config:    config,
+		pool:      newSafePool(),
+		bus:       newMessageBus(100),
+		processed: newMessageBus(100),
+		history:   newMessageHistory(0),
+		metrics:   &serverMetrics{},
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+
+	var err error
+	s.format, err = parseMessageFormat(defaultMessageFormat)
+	if err != nil {
+		return nil, err
+	}
+	analytics, err := newAnalytics("")
+	if err != nil {
+		return nil, err
+	}
+	s.threadGroup.Add(1)
+	go serverBroadCast(s.ctx, s.pool, s.bus.subscribe(), s.format, &s.threadGroup, s.history, nil, multicast, s.processed, nil, NoopScanner{}, s.metrics, newDeadLetterQueue(), analytics)
+
+	if _, err := s.listenOn(nil); err != nil {
+		s.stop()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Starts another accept loop on a new port, with TLS if tlsConfig is
+// set, returning its address.
+func (s *testServer) listen(t *testing.T, tlsConfig *tls.Config) string {
+	addr, err := s.listenOn(tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return addr
+}
+
+func (s *testServer) listenOn(tlsConfig *tls.Config) (string, error) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	s.listeners = append(s.listeners, ln)
+
+	connLog, err := newConnectionLog("")
+	if err != nil {
+		return "", err
+	}
+	s.acceptLoops.Add(1)
+	go func() {
+		defer s.acceptLoops.Done()
+		acceptConnections(s.ctx, ln, tlsConfig, s.config, &s.handlerGroup, &s.draining, s.pool, s.bus, s.format, nil,
+			s.history, connLog, nil, newUserAuditLog(), s.metrics, newLiveConfig(s.config))
+	}()
+	return ln.Addr().String(), nil
+}
+
+// The plain TCP listener's address.
+func (s *testServer) addr() string {
+	return s.listeners[0].Addr().String()
+}
+
+// Shuts down as server() does once drained: the handlers and accept
+// loops finish, then the broadcaster.
+func (s *testServer) stop() {
+	s.stopOnce.Do(func() {
+		s.cancel()
+		for _, ln := range s.listeners {
+			ln.Close()
+		}
+		s.acceptLoops.Wait()
+		s.threadGroup.Wait()
+	})
+}
+
+// A client's connection and the lines it has received.
+type testClient struct {
+	name  string
+	conn  net.Conn
+	lines chan string
+}
+
+// Connects as name, returning once the server has added them to the pool.
+func dialTestClient(t *testing.T, config clientConfig, name string) *testClient {
+	c := connectTestClient(t, config, name)
+	// the new user's presence list includes themselves
+	c.waitFor(t, strings.TrimSpace(formatPresence("join", name)))
+	return c
+}
+
+// Connects as name and starts reading, without waiting to be let in.
+func connectTestClient(t *testing.T, config clientConfig, name string) *testClient {
+	c, err := newTestClient(config, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.conn.Close() })
+	return c
+}
+
+func newTestClient(config clientConfig, name string) (*testClient, error) {
+	conn, err := connect(config, name)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &testClient{name: name, conn: conn, lines: make(chan string, 100)}
+	go func() {
+		defer close(c.lines)
+		reader := bufio.NewReader(conn)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			c.lines <- strings.TrimSpace(line)
+		}
+	}()
+	return c, nil
+}
+
+// A server the integration tests share, started by TestMain with
+// sharedClients clients already connected to it. A test borrows
+// clients from clientPool rather than starting a server of its own:
+//
+//	alice := clientPool.Get()
+//	defer clientPool.Put(alice)
+//
+// Other tests use the same server, so look for lines by their text.
+var (
+	sharedServer *testServer
+	clientPool   *testClientPool
+)
+
+const sharedClients = 5
+
+type testClientPool struct {
+	clients chan *testClient
+}
+
+// Starts the shared server and connects its clients, returning a
+// function that disconnects them and stops the server.
+func startSharedServer() (stop func(), err error) {
+	sharedServer, err = newTestServer(serverConfig{transport: "tcp"}, nil)
+	if err != nil {
+		return nil, err
+	}
+	clientPool = &testClientPool{clients: make(chan *testClient, sharedClients)}
+	stop = func() {
+		for i := 0; i < sharedClients; i++ {
+			select {
+			case c := <-clientPool.clients:
+				c.conn.Close()
+			default:
+			}
+		}
+		sharedServer.stop()
+	}
+
+	config := clientConfig{endpoint: sharedServer.addr()}
+	for i := 1; i <= sharedClients; i++ {
+		c, err := newTestClient(config, "pooled"+strconv.Itoa(i))
+		if err == nil {
+			err = c.waitForJoin()
+		}
+		if err != nil {
+			stop()
+			return nil, err
+		}
+		clientPool.clients <- c
+	}
+	return stop, nil
+}
+
+// Waits for the server to let the client in, as dialTestClient does.
+func (c *testClient) waitForJoin() error {
+	want := strings.TrimSpace(formatPresence("join", c.name))
+	timeout := time.After(integrationTimeout)
+	for {
+		select {
+		case line, ok := <-c.lines:
+			if !ok {
+				return errors.New(c.name + " was disconnected before joining")
+			}
+			if line == want {
+				return nil
+			}
+		case <-timeout:
+			return errors.New("timed out waiting for " + c.name + " to join")
+		}
+	}
+}
+
+// Takes a connected client, waiting for one to be put back if all
+// of them are in use.
+func (p *testClientPool) Get() *testClient {
+	return <-p.clients
+}
+
+// Returns a client for other tests, dropping the lines it has
+// received so far.
+func (p *testClientPool) Put(c *testClient) {
+	for len(c.lines) > 0 {
+		<-c.lines
+	}
+	p.clients <- c
+}
+
+func (c *testClient) send(t *testing.T, text string) {
+	t.Helper()
+	if _, err := c.conn.Write([]byte(text)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Skips lines until want, failing if it doesn't arrive in time.
+func (c *testClient) waitFor(t *testing.T, want string) {
+	t.Helper()
+	timeout := time.After(integrationTimeout)
+	for {
+		select {
+		case line, ok := <-c.lines:
+			if !ok {
+				t.Fatalf("connection closed before %q arrived", want)
+			}
+			if line == want {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for %q", want)
+		}
+	}
+}
+
+// Waits for the server to hang up, skipping any lines before that.
+func (c *testClient) waitForClose(t *testing.T) {
+	t.Helper()
+	timeout := time.After(integrationTimeout)
+	for {
+		select {
+		case _, ok := <-c.lines:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatal("timed out waiting for the server to close the connection")
+		}
+	}
+}
+
+func TestIntegration_BasicBroadcast(t *testing.T) {
+	alice, bob, carol := clientPool.Get(), clientPool.Get(), clientPool.Get()
+	defer clientPool.Put(alice)
+	defer clientPool.Put(bob)
+	defer clientPool.Put(carol)
+
+	// named after the sender, as other tests share the server
+	hello := "hello everyone from " + alice.name
+	alice.send(t, hello)
+	bob.waitFor(t, "BROADCAST "+alice.name+": "+hello)
+	carol.waitFor(t, "BROADCAST "+alice.name+": "+hello)
+
+	reply := "hi from " + carol.name
+	carol.send(t, reply)
+	alice.waitFor(t, "BROADCAST "+carol.name+": "+reply)
+	bob.waitFor(t, "BROADCAST "+carol.name+": "+reply)
+}
+
+// With every client borrowed, Get waits for one to be put back.
+func TestClientPoolBlocksWhenEmpty(t *testing.T) {
+	var borrowed []*testClient
+	for i := 0; i < sharedClients; i++ {
+		borrowed = append(borrowed, clientPool.Get())
+	}
+	defer func() {
+		for _, c := range borrowed {
+			clientPool.Put(c)
+		}
+	}()
+
+	got := make(chan *testClient)
+	go func() { got <- clientPool.Get() }()
+	select {
+	case c := <-got:
+		borrowed = append(borrowed, c)
+		t.Fatal("got a client while all were in use")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	returned := borrowed[0]
+	borrowed = borrowed[1:]
+	clientPool.Put(returned)
+	select {
+	case c := <-got:
+		borrowed = append(borrowed, c)
+		if c != returned {
+			t.Errorf("got %s, want %s, who was put back", c.name, returned.name)
+		}
+	case <-time.After(integrationTimeout):
+		t.Fatal("Get didn't return once a client was put back")
+	}
+}
+
+// Private messages and rooms (TestIntegration_PrivateMessage and
+// TestIntegration_RoomIsolation in the request) aren't tested: the
+// server has neither, and every message goes to everyone.
+
+func TestIntegration_HistoryReplay(t *testing.T) {
+	s := startTestServer(t)
+	config := clientConfig{endpoint: s.addr()}
+	alice := dialTestClient(t, config, "alice")
+	bob := dialTestClient(t, config, "bob")
+
+	alice.send(t, "first")
+	bob.waitFor(t, "BROADCAST alice: first")
+	alice.send(t, "second")
+	bob.waitFor(t, "BROADCAST alice: second")
+
+	// replayed in order, before the presence list
+	carol := connectTestClient(t, config, "carol")
+	carol.waitFor(t, "BROADCAST alice: first")
+	carol.waitFor(t, "BROADCAST alice: second")
+	carol.waitFor(t, strings.TrimSpace(formatPresence("join", "carol")))
+}
+
+func TestIntegration_GracefulShutdown(t *testing.T) {
+	s := startTestServer(t)
+	config := clientConfig{endpoint: s.addr()}
+	alice := dialTestClient(t, config, "alice")
+	bob := dialTestClient(t, config, "bob")
+
+	drained := make(chan error, 1)
+	go func() { drained <- drain(s.pool, &s.draining, integrationTimeout) }()
+
+	// while draining, newcomers are turned away but those already
+	// connected carry on
+	for !s.draining.Load() {
+		time.Sleep(time.Millisecond)
+	}
+	carol := connectTestClient(t, config, "carol")
+	carol.waitFor(t, `{"type":"error","text":"server is draining"}`)
+	carol.waitForClose(t)
+
+	alice.send(t, "see you")
+	bob.waitFor(t, "BROADCAST alice: see you")
+
+	alice.conn.Close()
+	bob.conn.Close()
+	select {
+	case err := <-drained:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(integrationTimeout):
+		t.Fatal("drain didn't finish once everyone had left")
+	}
+
+	s.stop()
+	if conn, err := connect(config, "dave"); err == nil {
+		conn.Close()
+		t.Error("connected after the server stopped")
+	}
+}
+
+// Stopping disconnects anyone still connected, rather than waiting.
+func TestIntegration_StopDisconnectsClients(t *testing.T) {
+	s := startTestServer(t)
+	alice := dialTestClient(t, clientConfig{endpoint: s.addr()}, "alice")
+
+	stopped := make(chan struct{})
+	go func() {
+		s.stop()
+		close(stopped)
+	}()
+	alice.waitForClose(t)
+	select {
+	case <-stopped:
+	case <-time.After(integrationTimeout):
+		t.Fatal("the server didn't stop")
+	}
+}
+
+// Writes a self-signed certificate for 127.0.0.1 to a PEM file for
+// the client to trust, returning the server's side of it.
+func testCertificate(t *testing.T) (tls.Certificate, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "chat test"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, path
+}
+
+// With --tls-port, plain and TLS clients share one chat.
+func TestIntegration_PlainAndTLS(t *testing.T) {
+	s := startTestServer(t)
+	cert, caFile := testCertificate(t)
+	tlsAddr := s.listen(t, &tls.Config{Certificates: []tls.Certificate{cert}})
+
+	alice := dialTestClient(t, clientConfig{endpoint: s.addr()}, "alice")
+	bob := dialTestClient(t, clientConfig{endpoint: tlsAddr, tls: true, tlsCA: caFile}, "bob")
+	if _, ok := bob.conn.(*tls.Conn); !ok {
+		t.Fatal("bob's connection isn't TLS")
+	}
+
+	alice.send(t, "hello over TCP")
+	bob.waitFor(t, "BROADCAST alice: hello over TCP")
+	bob.send(t, "hello over TLS")
+	alice.waitFor(t, "BROADCAST bob: hello over TLS")
+
+	mux := http.NewServeMux()
+	s.metrics.register(mux, s.bus, s.processed)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(w.Body.String(), "\nchat_listeners 2\n") {
+		t.Errorf("metrics don't count both listeners:\n%s", w.Body)
+	}
+
+	s.stop()
+	if n := s.metrics.listeners.Load(); n != 0 {
+		t.Errorf("%d listeners after stopping, want 0", n)
+	}
+}
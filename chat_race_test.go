@@ -0,0 +1,189 @@
+//go:build !short
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Clients connecting, sending and leaving at once, for the race
+// detector to check the pool, history and broadcaster under: run with
+// go test -race. Built without the short tag, as they take a while.
+
+const raceClients = 50
+
+// Connects as name from a goroutine other than the test's, reading
+// until the server has let them in, and returns the connection, or
+// nil after reporting why not.
+func raceConnect(t *testing.T, config clientConfig, name string) net.Conn {
+	conn, err := connect(config, name)
+	if err != nil {
+		t.Error(err)
+		return nil
+	}
+	joined := make(chan struct{})
+	go func() {
+		reader := bufio.NewReader(conn)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if line == formatPresence("join", name) {
+				close(joined)
+			}
+		}
+	}()
+	select {
+	case <-joined:
+	case <-time.After(integrationTimeout):
+		conn.Close()
+		t.Errorf("%s wasn't let in", name)
+		return nil
+	}
+	return conn
+}
+
+// Waits for every connection handler to have removed its user.
+func waitForEmptyPool(t *testing.T, pool *safePool) {
+	deadline := time.Now().Add(integrationTimeout)
+	for len(pool.snapshot()) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d users still connected", len(pool.snapshot()))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Starts a client for each of n names, reading and discarding what
+// they are sent.
+func connectRaceClients(t *testing.T, config clientConfig, n int) []*testClient {
+	clients := make([]*testClient, n)
+	for i := range clients {
+		clients[i] = dialTestClient(t, config, fmt.Sprintf("user%d", i))
+		go func() {
+			for range clients[i].lines {
+			}
+		}()
+	}
+	return clients
+}
+
+func TestRace_ConcurrentConnections(t *testing.T) {
+	s := startTestServer(t)
+	config := clientConfig{endpoint: s.addr()}
+
+	var wg sync.WaitGroup
+	for i := 0; i < raceClients; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn := raceConnect(t, config, fmt.Sprintf("user%d", i))
+			if conn == nil {
+				return
+			}
+			conn.Write([]byte("hello"))
+			conn.Close()
+		}()
+	}
+	wg.Wait()
+	waitForEmptyPool(t, s.pool)
+}
+
+func TestRace_ConcurrentBroadcast(t *testing.T) {
+	const messages = 10
+	s := startTestServer(t)
+	clients := connectRaceClients(t, clientConfig{endpoint: s.addr()}, raceClients)
+
+	var wg sync.WaitGroup
+	for _, c := range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < messages; i++ {
+				c.conn.Write([]byte("hello"))
+				// one message per read on the server
+				time.Sleep(time.Millisecond)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// messages sent close together can arrive as one
+	deadline := time.Now().Add(integrationTimeout)
+	for broadcast(s.history, "hello") < raceClients*messages && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Counts the times text has been broadcast so far.
+func broadcast(history *messageHistory, text string) int {
+	count := 0
+	for _, packet := range history.snapshot() {
+		count += strings.Count(packet.text, text)
+	}
+	return count
+}
+
+// Users sending while they are kicked, as --auto-kick-slow-consumers
+// does it: by closing their connection under the handler.
+func TestRace_ConcurrentKick(t *testing.T) {
+	s := startTestServer(t)
+	clients := connectRaceClients(t, clientConfig{endpoint: s.addr()}, raceClients)
+
+	var wg sync.WaitGroup
+	for i, c := range clients {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			c.conn.Write([]byte("hello"))
+		}()
+		go func() {
+			defer wg.Done()
+			if _, u, ok := s.pool.lookup(fmt.Sprintf("user%d", i)); ok {
+				u.connection.Close()
+			}
+		}()
+	}
+	wg.Wait()
+	waitForEmptyPool(t, s.pool)
+}
+
+// New users getting the history replayed while it is added to.
+func TestRace_ConcurrentHistoryReplay(t *testing.T) {
+	s := startTestServer(t)
+	config := clientConfig{endpoint: s.addr()}
+	sender := dialTestClient(t, config, "sender")
+	go func() {
+		for range sender.lines {
+		}
+	}()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < raceClients; i++ {
+			sender.conn.Write([]byte(fmt.Sprintf("message %d", i)))
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	for i := 0; i < raceClients; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if conn := raceConnect(t, config, fmt.Sprintf("user%d", i)); conn != nil {
+				conn.Close()
+			}
+		}()
+	}
+	wg.Wait()
+	sender.conn.Close()
+	waitForEmptyPool(t, s.pool)
+}
@@ -0,0 +1,363 @@
+// Contributing: every change comes with tests in the _test.go file of
+// the feature it touches, using the helpers here and the sample files
+// in testdata. Run them with make test-race. make coverage fails when
+// statement coverage is below 70%, as it does in CI, so new code needs
+// tests enough to keep it above that.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"text/template"
+	"time"
+)
+
+// The server logs every connection and message, which buries test
+// failures, so logs are only shown with -v. The integration tests'
+// shared server runs for the whole test binary.
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if !testing.Verbose() {
+		log.SetOutput(io.Discard)
+	}
+	stop, err := startSharedServer()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Starting the shared test server:", err)
+		os.Exit(1)
+	}
+	code := m.Run()
+	stop()
+	os.Exit(code)
+}
+
+// A connection that hands out readData one chunk per Read, as if each
+// arrived in its own segment, then reports EOF, and keeps what is
+// written to it.
+type mockConn struct {
+	mu        sync.Mutex
+	readData  [][]byte
+	writeBuf  bytes.Buffer
+	closed    bool
+	remote    net.Addr
+	beforeEOF func() // called once readData runs out, before reporting EOF
+}
+
+func newMockConn(remote string, reads ...string) *mockConn {
+	conn := &mockConn{remote: net.TCPAddrFromAddrPort(netip.MustParseAddrPort(remote))}
+	for _, read := range reads {
+		conn.readData = append(conn.readData, []byte(read))
+	}
+	return conn
+}
+
+func (c *mockConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+	if len(c.readData) == 0 {
+		if c.beforeEOF != nil {
+			c.mu.Unlock()
+			c.beforeEOF()
+			c.mu.Lock()
+		}
+		return 0, io.EOF
+	}
+	n := copy(b, c.readData[0])
+	if n == len(c.readData[0]) {
+		c.readData = c.readData[1:]
+	} else {
+		c.readData[0] = c.readData[0][n:]
+	}
+	return n, nil
+}
+
+func (c *mockConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+	return c.writeBuf.Write(b)
+}
+
+func (c *mockConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	return nil
+}
+
+// What has been written to the connection so far.
+func (c *mockConn) written() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.writeBuf.String()
+}
+
+func (c *mockConn) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+func (c *mockConn) LocalAddr() net.Addr                { return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8080} }
+func (c *mockConn) RemoteAddr() net.Addr               { return c.remote }
+func (c *mockConn) SetDeadline(t time.Time) error      { return nil }
+func (c *mockConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *mockConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// A user connected over conn, as handleConnection adds them to the
+// pool, closed when the test ends.
+func newTestUser(tb testing.TB, conn net.Conn, name string) user {
+	stats := newUserStats()
+	u := user{connection: newQueuedConn(conn, stats), username: name, stats: stats, multicast: &atomic.Bool{}}
+	tb.Cleanup(func() { u.connection.Close() })
+	return u
+}
+
+// The state handleConnection shares with the rest of the server.
+type connectionTest struct {
+	pool       *safePool
+	bus        *MessageBus
+	history    *messageHistory
+	audit      *userAuditLog
+	metrics    *serverMetrics
+	welcome    *template.Template
+	reputation *ipReputation
+	connLog    *connectionLog
+	config     serverConfig
+}
+
+func newConnectionTest() *connectionTest {
+	return &connectionTest{
+		pool:    newSafePool(),
+		bus:     newMessageBus(16),
+		history: newMessageHistory(0),
+		audit:   newUserAuditLog(),
+		metrics: &serverMetrics{},
+		connLog: &connectionLog{},
+		config:  serverConfig{transport: "tcp"},
+	}
+}
+
+// Runs handleConnection on conn until it has read everything.
+func (c *connectionTest) handle(t *testing.T, conn net.Conn) {
+	format, err := parseMessageFormat(defaultMessageFormat)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handleConnection(context.Background(), conn, c.config, c.pool, c.bus, format, c.welcome, c.history, c.connLog, c.reputation, c.audit, c.metrics, newLiveConfig(c.config))
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handleConnection didn't return once the client disconnected")
+	}
+}
+
+func TestHandleConnection(t *testing.T) {
+	hello := `{"type":"client_hello","client_version":"1.2.3","supported_features":["multiline"]}` + "\n"
+
+	tests := []struct {
+		name          string
+		history       []string // already broadcast by carol
+		reads         []string
+		wantUser      string   // who joined, or "" if no one did
+		wantWritten   []string // in this order, among what was written
+		wantPublished []string
+	}{
+		{
+			name:     "username",
+			reads:    []string{"alice\n"},
+			wantUser: "alice",
+		},
+		{
+			name:     "hello then username",
+			reads:    []string{hello, "alice\n"},
+			wantUser: "alice",
+		},
+		{
+			name:     "hello and username together",
+			reads:    []string{hello + "alice\n"},
+			wantUser: "alice",
+		},
+		{
+			name:        "invalid username",
+			reads:       []string{"al ice\n"},
+			wantWritten: []string{`{"type":"error","text":"` + ErrUsernameInvalid.Error() + `"}`},
+		},
+		{
+			name:        "history replayed",
+			history:     []string{"first", "second"},
+			reads:       []string{"alice\n"},
+			wantUser:    "alice",
+			wantWritten: []string{"BROADCAST carol: first\n", "BROADCAST carol: second\n"},
+		},
+		{
+			name:          "messages forwarded",
+			reads:         []string{"alice\n", "hello\n", "  how are you  "},
+			wantUser:      "alice",
+			wantPublished: []string{"hello", "how are you"},
+		},
+		{
+			name:        "ping answered, not forwarded",
+			reads:       []string{"alice\n", `{"type":"ping_echo","payload":"1"}`},
+			wantUser:    "alice",
+			wantWritten: []string{`"type":"pong_echo","payload":"1"`},
+		},
+		{
+			name:          "empty message refused",
+			reads:         []string{"alice\n", "   \n", "hello\n"},
+			wantUser:      "alice",
+			wantWritten:   []string{`{"type":"error"`},
+			wantPublished: []string{"hello"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newConnectionTest()
+			for _, text := range tt.history {
+				c.history.append(messagePacket{sender: "carol", text: text, timestamp: time.Now()})
+			}
+			published := c.bus.subscribe()
+			conn := newMockConn("10.0.0.1:5000", tt.reads...)
+
+			c.handle(t, conn)
+
+			written := conn.written()
+			for _, want := range tt.wantWritten {
+				i := strings.Index(written, want)
+				if i < 0 {
+					t.Fatalf("%q not written; got %q", want, written)
+				}
+				written = written[i+len(want):]
+			}
+
+			for _, want := range tt.wantPublished {
+				select {
+				case packet := <-published:
+					if packet.text != want || packet.sender != tt.wantUser || packet.source != "10.0.0.1:5000" {
+						t.Errorf("published %q from %s (%s), want %q from %s", packet.text, packet.sender, packet.source, want, tt.wantUser)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatalf("%q wasn't published", want)
+				}
+			}
+			select {
+			case packet := <-published:
+				t.Errorf("%q was published too", packet.text)
+			case <-time.After(10 * time.Millisecond):
+			}
+
+			if tt.wantUser != "" {
+				events, _ := c.audit.events(tt.wantUser)
+				if len(events) != 2 || events[0].Action != auditJoin || events[1].Action != auditLeave {
+					t.Errorf("%s's audit events = %+v, want a join then a leave", tt.wantUser, events)
+				}
+			}
+
+			// disconnecting, by EOF here, removes the user and closes
+			// the connection
+			if users := c.pool.snapshot(); len(users) != 0 {
+				t.Errorf("%d users left in the pool after disconnecting", len(users))
+			}
+			if !conn.isClosed() {
+				t.Error("connection wasn't closed")
+			}
+		})
+	}
+}
+
+// Others see a user join and leave, and the user sees who was there.
+func TestHandleConnectionPresence(t *testing.T) {
+	c := newConnectionTest()
+	bob := newMockConn("10.0.0.2:5000")
+	bobUser := newTestUser(t, bob, "bob")
+	c.pool.addIfAbsent("10.0.0.2:5000", bobUser)
+	alice := newMockConn("10.0.0.1:5000", "alice\n")
+
+	c.handle(t, alice)
+	bobUser.connection.Close() // once what's queued for bob is written
+
+	if got, want := alice.written(), formatPresence("join", "bob"); !strings.Contains(got, want) {
+		t.Errorf("alice got %q, want %q", got, want)
+	}
+	if got, want := bob.written(), formatPresence("join", "alice")+formatPresence("leave", "alice"); got != want {
+		t.Errorf("bob got %q, want %q", got, want)
+	}
+}
+
+// A second connection can't take a name that's in use.
+func TestHandleConnectionUsernameTaken(t *testing.T) {
+	c := newConnectionTest()
+	c.pool.addIfAbsent("10.0.0.2:5000", newTestUser(t, newMockConn("10.0.0.2:5000"), "alice"))
+	conn := newMockConn("10.0.0.1:5000", "alice\n", "hello\n")
+
+	c.handle(t, conn)
+
+	if got, want := conn.written(), `{"type":"error","text":"`+ErrUsernameTaken.Error()+`"}`+"\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if _, ok := c.pool.get("10.0.0.2:5000"); !ok {
+		t.Error("the user who had the name was removed")
+	}
+	if !conn.isClosed() {
+		t.Error("connection wasn't closed")
+	}
+}
+
+// With the queue full, a message is dropped and its sender told,
+// rather than the connection stalling.
+func TestHandleConnectionQueueFull(t *testing.T) {
+	c := newConnectionTest()
+	c.bus = newMessageBus(1)
+	c.bus.subscribe() // never read, so the queue backs up
+	reads := []string{"alice\n"}
+	for i := 0; i < 100; i++ {
+		reads = append(reads, "hello")
+	}
+	conn := newMockConn("10.0.0.1:5000", reads...)
+
+	c.handle(t, conn)
+
+	busy := strings.Count(conn.written(), `{"type":"error","text":"`+serverBusyText+`"}`)
+	if busy == 0 {
+		t.Fatal("no message was dropped")
+	}
+	if n := c.metrics.queueOverflow.Load(); n != uint64(busy) {
+		t.Errorf("counted %d overflows, but the client was told of %d", n, busy)
+	}
+
+	mux := http.NewServeMux()
+	c.metrics.register(mux, c.bus, newMessageBus(1))
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	for _, want := range []string{
+		"\nchat_queue_depth ", // still changing as the bus runs
+		fmt.Sprintf("\nchat_queue_overflow_total %d\n", busy),
+	} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("metrics are missing %q:\n%s", strings.TrimSpace(want), w.Body)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+)
+
+// Encodings for the long-polling transport's messages. JSON is what
+// every client speaks; a server started with --wire-format gob also
+// offers encoding/gob, which a client takes up by listing "gob" in
+// the features it joins with:
+//
+//	{"username":"alice","features":["gob"]}
+//
+// The join response names the format the session's /lp/send and
+// /lp/recv bodies then use, as in {"client_id":"...","wire_format":"gob"}.
+// The join itself is always JSON.
+//
+// Gob describes each type before its first value, so it only pays
+// off on batches: a /lp/recv response of 100 messages is a third
+// smaller than JSON and a little quicker to encode and decode, but a
+// single message is larger and several times slower (see
+// BenchmarkCodec).
+
+type Codec interface {
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+type JSONCodec struct{}
+
+func (JSONCodec) Marshal(v any) ([]byte, error)      { return json.Marshal(v) }
+func (JSONCodec) Unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
+
+type GobCodec struct{}
+
+func (GobCodec) Marshal(v any) ([]byte, error) {
+	var b bytes.Buffer
+	if err := gob.NewEncoder(&b).Encode(v); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func (GobCodec) Unmarshal(data []byte, v any) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+type wireFormat struct {
+	name        string // as given to --wire-format and listed in a client's features
+	contentType string
+	codec       Codec
+}
+
+var (
+	jsonWireFormat = wireFormat{"json", "application/json", JSONCodec{}}
+	gobWireFormat  = wireFormat{"gob", "application/x-gob", GobCodec{}}
+)
+
+func parseWireFormat(name string) (wireFormat, error) {
+	switch name {
+	case jsonWireFormat.name:
+		return jsonWireFormat, nil
+	case gobWireFormat.name:
+		return gobWireFormat, nil
+	}
+	return wireFormat{}, fmt.Errorf("unknown wire format %q, want json or gob", name)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCodecRoundTrip(t *testing.T) {
+	messages := []wireMessage{
+		{Seq: 1, Sender: "alice", Text: "hi"},
+		{Seq: 2, Sender: "bob", Text: `{"build":42}`, ContentType: "application/json", Tags: map[string]string{"status": "ok"}},
+	}
+	for _, codec := range []Codec{JSONCodec{}, GobCodec{}} {
+		data, err := codec.Marshal(messages)
+		if err != nil {
+			t.Fatalf("%T: %v", codec, err)
+		}
+		var got []wireMessage
+		if err := codec.Unmarshal(data, &got); err != nil {
+			t.Fatalf("%T: %v", codec, err)
+		}
+		if !reflect.DeepEqual(got, messages) {
+			t.Errorf("%T: got %+v, want %+v", codec, got, messages)
+		}
+	}
+}
+
+func TestParseWireFormat(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    wireFormat
+		wantErr bool
+	}{
+		{"json", jsonWireFormat, false},
+		{"gob", gobWireFormat, false},
+		{"msgpack", wireFormat{}, true},
+		{"", wireFormat{}, true},
+	}
+	for _, tt := range tests {
+		got, err := parseWireFormat(tt.name)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseWireFormat(%q) = %+v, %v", tt.name, got, err)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"time"
+)
+
+// Server-to-client commands. Besides chat lines, the server can
+// send a client a single JSON line instructing it to do something:
+//
+//	{"type":"command","action":"clear_screen"}
+//	{"type":"command","action":"set_title","payload":"#general"}
+//	{"type":"command","action":"redirect","payload":"server2:8011"}
+//	{"type":"command","action":"join_multicast","payload":"239.0.0.1:8012"}
+//
+// A redirect makes the client reconnect to the given address,
+// which lets clients be moved off a server before maintenance.
+// Clients ignore actions they don't know.
+
+// How long a migrated client has to reconnect before
+// its old connection is closed.
+const migrateDrainTime = 2 * time.Second
+
+var errNoSuchUser = errors.New("no such user")
+
+type commandPacket struct {
+	Type    string `json:"type"` // always "command"
+	Action  string `json:"action"`
+	Payload string `json:"payload,omitempty"`
+}
+
+func sendCommand(conn net.Conn, action string, payload string) error {
+	line, err := json.Marshal(commandPacket{Type: "command", Action: action, Payload: payload})
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(append(line, '\n'))
+	return err
+}
+
+// Hands a connected user off to another server instance: the client
+// is told to reconnect to newAddr, taken out of the pool so it gets
+// no further broadcasts, and disconnected after migrateDrainTime.
+func migrateClient(pool *safePool, username string, newAddr string) error {
+	address, u, ok := pool.lookup(username)
+	if !ok {
+		return errNoSuchUser
+	}
+	if err := sendCommand(u.connection, "redirect", newAddr); err != nil {
+		return err
+	}
+
+	pool.remove(address)
+	time.AfterFunc(migrateDrainTime, func() { u.connection.Close() })
+	log.Print("Migrating ", username, " to ", newAddr)
+	return nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+)
+
+// Runs f with os.Stdout redirected, returning what it printed.
+func captureStdout(t *testing.T, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	f()
+	os.Stdout = stdout
+	w.Close()
+	printed, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(printed)
+}
+
+func TestSendCommand(t *testing.T) {
+	tests := []struct {
+		action  string
+		payload string
+		want    string
+	}{
+		{"clear_screen", "", `{"type":"command","action":"clear_screen"}`},
+		{"set_title", "#general", `{"type":"command","action":"set_title","payload":"#general"}`},
+		{"redirect", "server2:8011", `{"type":"command","action":"redirect","payload":"server2:8011"}`},
+	}
+	for _, tt := range tests {
+		conn := newMockConn("10.0.0.1:5000")
+		if err := sendCommand(conn, tt.action, tt.payload); err != nil {
+			t.Fatal(err)
+		}
+		if got := conn.written(); got != tt.want+"\n" {
+			t.Errorf("sendCommand(%q, %q) wrote %q, want %q", tt.action, tt.payload, got, tt.want)
+		}
+		if packetType, _ := decodePacket(strings.TrimSpace(conn.written())); packetType != "command" {
+			t.Errorf("%s decoded as %q", tt.action, packetType)
+		}
+	}
+}
+
+// The client carries out screen commands, and ignores ones it doesn't know.
+func TestRunCommandScreen(t *testing.T) {
+	tests := []struct {
+		command commandPacket
+		want    string
+	}{
+		{commandPacket{Action: "clear_screen"}, "\033[H\033[2J"},
+		{commandPacket{Action: "set_title", Payload: "#general"}, "\033]0;#general\a"},
+		{commandPacket{Action: "dance"}, ""},
+	}
+	for _, tt := range tests {
+		conn := newMockConn("10.0.0.1:5000")
+		reader := bufio.NewReader(conn)
+		var gotConn net.Conn
+		var gotReader *bufio.Reader
+		printed := captureStdout(t, func() {
+			gotConn, gotReader = runCommand(tt.command, conn, reader, newOutbox(conn), clientConfig{}, "alice",
+				newPresentUsers(), &multicastReceiver{}, &highlighter{})
+		})
+		if printed != tt.want {
+			t.Errorf("%s printed %q, want %q", tt.command.Action, printed, tt.want)
+		}
+		if gotConn != net.Conn(conn) || gotReader != reader {
+			t.Errorf("%s replaced the connection", tt.command.Action)
+		}
+	}
+}
+
+// A redirect reconnects to the new address, and the client carries
+// on there.
+func TestRunCommandRedirect(t *testing.T) {
+	s := startTestServer(t)
+	bob := dialTestClient(t, clientConfig{endpoint: s.addr()}, "bob")
+	old := newMockConn("10.0.0.1:5000")
+	out := newOutbox(old)
+
+	var conn net.Conn
+	captureStdout(t, func() {
+		conn, _ = runCommand(commandPacket{Action: "redirect", Payload: s.addr()}, old, bufio.NewReader(old), out,
+			clientConfig{endpoint: "old:8011"}, "alice", newPresentUsers(), &multicastReceiver{}, &highlighter{})
+	})
+	t.Cleanup(func() { conn.Close() })
+
+	bob.waitFor(t, strings.TrimSpace(formatPresence("join", "alice")))
+	if !old.isClosed() {
+		t.Error("the old connection wasn't closed")
+	}
+	if err := out.send("hello from the new server"); err != nil {
+		t.Fatal(err)
+	}
+	bob.waitFor(t, "BROADCAST alice: hello from the new server")
+}
+
+// Migrating moves a client from one server to another: it is taken
+// out of the old server's pool and told to reconnect, and carries on
+// at the new one.
+func TestMigrateClient(t *testing.T) {
+	s1 := startTestServer(t)
+	s2 := startTestServer(t)
+	carol := dialTestClient(t, clientConfig{endpoint: s1.addr()}, "carol")
+	dave := dialTestClient(t, clientConfig{endpoint: s2.addr()}, "dave")
+	alice := dialTestClient(t, clientConfig{endpoint: s1.addr()}, "alice")
+	carol.waitFor(t, strings.TrimSpace(formatPresence("join", "alice")))
+
+	if err := migrateClient(s1.pool, "alice", s2.addr()); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok := s1.pool.lookup("alice"); ok {
+		t.Error("alice is still in the old server's pool")
+	}
+	if err := migrateClient(s1.pool, "alice", s2.addr()); err != errNoSuchUser {
+		t.Errorf("migrating alice again: %v, want %v", err, errNoSuchUser)
+	}
+
+	// the client follows the redirect as clientReceiveMessage does
+	var redirect commandPacket
+	for line := range alice.lines {
+		if packetType, raw := decodePacket(line); packetType == "command" {
+			json.Unmarshal(raw, &redirect)
+			break
+		}
+	}
+	if redirect.Action != "redirect" || redirect.Payload != s2.addr() {
+		t.Fatalf("alice was sent %+v, want a redirect to %s", redirect, s2.addr())
+	}
+	out := newOutbox(alice.conn)
+	var conn net.Conn
+	captureStdout(t, func() {
+		conn, _ = runCommand(redirect, alice.conn, nil, out, clientConfig{endpoint: s1.addr()}, "alice",
+			newPresentUsers(), &multicastReceiver{}, &highlighter{})
+	})
+	t.Cleanup(func() { conn.Close() })
+
+	dave.waitFor(t, strings.TrimSpace(formatPresence("join", "alice")))
+	out.send("hello from server 2")
+	dave.waitFor(t, "BROADCAST alice: hello from server 2")
+	if _, _, ok := s2.pool.lookup("alice"); !ok {
+		t.Error("alice isn't in the new server's pool")
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The running configuration on the admin API. GET /api/config shows
+// the server's settings, with secrets redacted. PUT /api/config with
+// a JSON object of the settings to change, such as
+//
+//	{"max_connections_per_ip": 10, "slow_consumer_threshold": 100, "rate_limit": 20, "rate_window": "10s"}
+//
+// applies them without a restart. Only the settings in liveConfig can
+// be changed; anything else, or an invalid value, is refused with 400
+// and nothing is applied.
+
+const redacted = "<redacted>"
+
+// Settings that can be changed while the server runs. They start out
+// as given on the command line and are read at the time of use.
+type liveSettings struct {
+	maxPerIP      int64 // 0 for no limit
+	slowThreshold uint32
+	rateLimit     int // 0 for no limit
+	rateWindow    time.Duration
+}
+
+// The live settings, replaced as a whole on each change so that
+// readers see all of an update or none of it.
+type liveConfig struct {
+	mu       sync.Mutex // held to change the settings, so changes don't overwrite each other
+	settings atomic.Pointer[liveSettings]
+}
+
+func newLiveConfig(config serverConfig) *liveConfig {
+	live := &liveConfig{}
+	live.settings.Store(&liveSettings{
+		maxPerIP:      int64(config.maxPerIP),
+		slowThreshold: uint32(config.slowThreshold),
+		rateLimit:     config.rateLimit,
+		rateWindow:    config.rateWindow,
+	})
+	return live
+}
+
+// The current settings, which must not be modified.
+func (l *liveConfig) load() *liveSettings {
+	return l.settings.Load()
+}
+
+// Applies change to a copy of the current settings, then puts the
+// copy in their place.
+func (l *liveConfig) update(change func(*liveSettings)) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	settings := *l.settings.Load()
+	change(&settings)
+	l.settings.Store(&settings)
+}
+
+func registerConfigAPI(mux *http.ServeMux, config serverConfig, live *liveConfig, startedAt time.Time) {
+	type configView struct {
+		ListenAddr       string    `json:"listen_addr"`
+		Port             int       `json:"port"`
+		TLSPort          int       `json:"tls_port"`
+		TLSCert          string    `json:"tls_cert"`
+		TLSKey           string    `json:"tls_key"`
+		TLSMinVersion    string    `json:"tls_min_version"`
+		TLSCiphers       string    `json:"tls_ciphers"`
+		ListenBacklog    int       `json:"listen_backlog"`
+		ListenRcvbuf     int       `json:"listen_rcvbuf"`
+		BindRetryCount   int       `json:"bind_retry_count"`
+		BindRetryDelay   string    `json:"bind_retry_delay"`
+		Transport        string    `json:"transport"`
+		WireFormat       string    `json:"wire_format"`
+		KeepAlive        string    `json:"tcp_keepalive_interval"`
+		AllowAnonymous   bool      `json:"allow_anonymous"`
+		QueueSize        int       `json:"message_queue_size"`
+		StatsInterval    string    `json:"stats_interval"`
+		AdminAddr        string    `json:"admin_addr"`
+		ConnectionLog    string    `json:"connection_log"`
+		EmojiCodesFile   string    `json:"emoji_codes_file"`
+		SentimentDir     string    `json:"sentiment_lexicon_dir"`
+		SlackWebhookURL  string    `json:"slack_webhook_url"`
+		SlackChannel     string    `json:"slack_channel"`
+		ContentScanner   string    `json:"content_scanner_url"`
+		ScannerFailOpen  bool      `json:"content_scanner_fail_open"`
+		MinClientVersion string    `json:"min_client_version"`
+		MessageFormat    string    `json:"message_format"`
+		WelcomeMessage   string    `json:"welcome_message"`
+		AnalyticsFile    string    `json:"analytics_file"`
+		IPReputation     string    `json:"ip_reputation_file"`
+		EnablePprof      bool      `json:"enable_pprof"`
+		PprofDir         string    `json:"pprof_dir"`
+		HistoryMaxAge    string    `json:"history_max_age"`
+		RestartExec      bool      `json:"restart_exec"`
+		RateLimit        int64     `json:"rate_limit"`
+		RateWindow       string    `json:"rate_window"`
+		MaxPerIP         int64     `json:"max_connections_per_ip"`
+		AutoKickSlow     bool      `json:"auto_kick_slow_consumers"`
+		SlowThreshold    uint32    `json:"slow_consumer_threshold"`
+		EffectiveSince   time.Time `json:"effective_since"`
+		Source           string    `json:"source"`
+	}
+
+	// secrets are only redacted when set, so it's clear whether they are
+	hide := func(value string) string {
+		if value == "" {
+			return ""
+		}
+		return redacted
+	}
+
+	mux.HandleFunc("GET /api/config", func(w http.ResponseWriter, r *http.Request) {
+		settings := live.load()
+		writeJSON(w, http.StatusOK, configView{
+			ListenAddr:       config.listenAddr,
+			Port:             config.port,
+			TLSPort:          config.tlsPort,
+			TLSCert:          config.tlsCert,
+			TLSKey:           hide(config.tlsKey),
+			TLSMinVersion:    config.tlsMinVersion,
+			TLSCiphers:       config.tlsCiphers,
+			ListenBacklog:    config.listenBacklog,
+			ListenRcvbuf:     config.listenRcvbuf,
+			BindRetryCount:   config.bindRetryCount,
+			BindRetryDelay:   config.bindRetryDelay.String(),
+			Transport:        config.transport,
+			WireFormat:       config.wireFormat,
+			KeepAlive:        config.keepAlive.String(),
+			AllowAnonymous:   config.allowAnonymous,
+			QueueSize:        config.queueSize,
+			StatsInterval:    config.statsInterval.String(),
+			AdminAddr:        config.adminAddr,
+			ConnectionLog:    config.connectionLog,
+			EmojiCodesFile:   config.emojiCodesFile,
+			SentimentDir:     config.sentimentDir,
+			SlackWebhookURL:  hide(config.slackWebhookURL), // the URL holds the webhook's token
+			SlackChannel:     config.slackChannel,
+			ContentScanner:   hide(config.contentScannerURL), // may carry credentials
+			ScannerFailOpen:  config.scannerFailOpen,
+			MinClientVersion: config.minClientVersion,
+			MessageFormat:    config.messageFormat,
+			WelcomeMessage:   config.welcomeMessage,
+			AnalyticsFile:    config.analyticsFile,
+			IPReputation:     config.ipReputation,
+			EnablePprof:      config.enablePprof,
+			PprofDir:         config.pprofDir,
+			HistoryMaxAge:    config.historyMaxAge.String(),
+			RestartExec:      config.restartExec,
+			RateLimit:        int64(settings.rateLimit),
+			RateWindow:       settings.rateWindow.String(),
+			MaxPerIP:         settings.maxPerIP,
+			AutoKickSlow:     config.autoKickSlow,
+			SlowThreshold:    settings.slowThreshold,
+			EffectiveSince:   startedAt,
+			Source:           "flags", // there is no config file
+		})
+	})
+
+	mux.HandleFunc("PUT /api/config", func(w http.ResponseWriter, r *http.Request) {
+		var update struct {
+			MaxPerIP      *int64  `json:"max_connections_per_ip"`
+			SlowThreshold *int64  `json:"slow_consumer_threshold"`
+			RateLimit     *int64  `json:"rate_limit"`
+			RateWindow    *string `json:"rate_window"`
+		}
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&update); err != nil {
+			http.Error(w, "invalid config: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// check everything before applying anything
+		if update.MaxPerIP != nil && *update.MaxPerIP < 0 {
+			http.Error(w, "max_connections_per_ip must not be negative", http.StatusBadRequest)
+			return
+		}
+		if update.SlowThreshold != nil && (*update.SlowThreshold < 1 || *update.SlowThreshold > 1<<32-1) {
+			http.Error(w, "slow_consumer_threshold must be a positive 32-bit number", http.StatusBadRequest)
+			return
+		}
+		if update.RateLimit != nil && (*update.RateLimit < 0 || *update.RateLimit > maxRateLimit) {
+			http.Error(w, fmt.Sprintf("rate_limit must be between 0 and %d", maxRateLimit), http.StatusBadRequest)
+			return
+		}
+		var rateWindow time.Duration
+		if update.RateWindow != nil {
+			var err error
+			rateWindow, err = time.ParseDuration(*update.RateWindow)
+			if err != nil || rateWindow <= 0 {
+				http.Error(w, "rate_window must be a positive duration, such as 10s", http.StatusBadRequest)
+				return
+			}
+		}
+
+		live.update(func(settings *liveSettings) {
+			if update.MaxPerIP != nil {
+				settings.maxPerIP = *update.MaxPerIP
+			}
+			if update.SlowThreshold != nil {
+				settings.slowThreshold = uint32(*update.SlowThreshold)
+			}
+			if update.RateLimit != nil {
+				settings.rateLimit = int(*update.RateLimit)
+			}
+			if update.RateWindow != nil {
+				settings.rateWindow = rateWindow
+			}
+		})
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestConfigAPI(t *testing.T) (*http.ServeMux, *liveConfig) {
+	t.Helper()
+	config := serverConfig{
+		port:            8011,
+		tlsKey:          "/etc/chat/key.pem",
+		slackWebhookURL: "https://hooks.slack.com/services/T000/B000/secret",
+		maxPerIP:        5,
+		slowThreshold:   defaultSlowThreshold,
+		rateLimit:       10,
+		rateWindow:      defaultRateWindow,
+	}
+	live := newLiveConfig(config)
+	mux := http.NewServeMux()
+	registerConfigAPI(mux, config, live, time.Now())
+	return mux, live
+}
+
+func TestGetConfigRedactsSecrets(t *testing.T) {
+	mux, _ := newTestConfigAPI(t)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/api/config", nil))
+
+	var view map[string]any
+	if err := json.NewDecoder(w.Body).Decode(&view); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"tls_key", "slack_webhook_url"} {
+		if view[key] != redacted {
+			t.Errorf("%s = %v, want %q", key, view[key], redacted)
+		}
+	}
+	if view["tls_cert"] != "" {
+		t.Errorf("unset tls_cert = %v, want it empty rather than redacted", view["tls_cert"])
+	}
+	if view["rate_limit"] != float64(10) || view["rate_window"] != "10s" {
+		t.Errorf("rate_limit %v per %v, want 10 per 10s", view["rate_limit"], view["rate_window"])
+	}
+}
+
+func TestPutConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{"max per IP", `{"max_connections_per_ip": 10}`, http.StatusNoContent},
+		{"negative max per IP", `{"max_connections_per_ip": -1}`, http.StatusBadRequest},
+		{"zero slow threshold", `{"slow_consumer_threshold": 0}`, http.StatusBadRequest},
+		{"rate limit and window", `{"rate_limit": 20, "rate_window": "1m"}`, http.StatusNoContent},
+		{"rate limit off", `{"rate_limit": 0}`, http.StatusNoContent},
+		{"negative rate limit", `{"rate_limit": -5}`, http.StatusBadRequest},
+		{"huge rate limit", `{"rate_limit": 1000000000}`, http.StatusBadRequest},
+		{"bad rate window", `{"rate_window": "soon"}`, http.StatusBadRequest},
+		{"zero rate window", `{"rate_window": "0s"}`, http.StatusBadRequest},
+		{"rate window not a string", `{"rate_window": 10}`, http.StatusBadRequest},
+		{"unknown setting", `{"port": 9000}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mux, _ := newTestConfigAPI(t)
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, httptest.NewRequest("PUT", "/api/config", strings.NewReader(tt.body)))
+			if w.Code != tt.status {
+				t.Errorf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+		})
+	}
+}
+
+// The sample settings in testdata apply as a whole.
+func TestPutConfigSample(t *testing.T) {
+	body, err := os.ReadFile("testdata/config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux, live := newTestConfigAPI(t)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("PUT", "/api/config", bytes.NewReader(body)))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	want := liveSettings{maxPerIP: 10, slowThreshold: 100, rateLimit: 20, rateWindow: time.Minute}
+	if got := *live.load(); got != want {
+		t.Errorf("settings %+v, want %+v", got, want)
+	}
+}
+
+// An invalid value anywhere in the update means nothing is applied.
+func TestPutConfigAllOrNothing(t *testing.T) {
+	mux, live := newTestConfigAPI(t)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("PUT", "/api/config", strings.NewReader(`{"rate_limit": 50, "rate_window": "-1s"}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if limit := live.load().rateLimit; limit != 10 {
+		t.Errorf("rate_limit changed to %d by a refused update", limit)
+	}
+}
+
+// A connection's limiter follows the live settings from its next message.
+func TestLiveLimiterFollowsConfig(t *testing.T) {
+	mux, live := newTestConfigAPI(t)
+
+	limiter := liveLimiter(nil, live)
+	if limiter == nil || limiter.limit != 10 {
+		t.Fatalf("limiter = %+v, want a limit of 10", limiter)
+	}
+	if liveLimiter(limiter, live) != limiter {
+		t.Error("limiter replaced although the settings didn't change")
+	}
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("PUT", "/api/config", strings.NewReader(`{"rate_limit": 1, "rate_window": "1h"}`)))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	limiter = liveLimiter(limiter, live)
+	if !limiter.Allow() || limiter.Allow() {
+		t.Error("the new limit of 1 per hour wasn't applied")
+	}
+
+	live.update(func(settings *liveSettings) { settings.rateLimit = 0 })
+	if liveLimiter(limiter, live) != nil {
+		t.Error("limiter kept after the limit was turned off")
+	}
+}
+
+// Readers see each update whole, never one setting from it and another
+// from the update before.
+func TestPutConfigAtomic(t *testing.T) {
+	mux, live := newTestConfigAPI(t)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			n := i%2 + 1
+			body := fmt.Sprintf(`{"rate_limit": %d, "rate_window": "%ds"}`, n, n)
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, httptest.NewRequest("PUT", "/api/config", strings.NewReader(body)))
+			if w.Code != http.StatusNoContent {
+				t.Errorf("status %d: %s", w.Code, w.Body)
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		settings := live.load()
+		if settings.rateLimit != 10 && settings.rateWindow != time.Duration(settings.rateLimit)*time.Second {
+			t.Fatalf("read a rate limit of %d with a window of %v", settings.rateLimit, settings.rateWindow)
+		}
+	}
+}
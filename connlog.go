@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Security log of connection attempts, so that failed or abusive
+// connections can be investigated after the fact. Each attempt is
+// written to --connection-log as one JSON object per line, and the
+// most recent entries are kept in memory for GET /api/connection-log.
+
+const connectionLogRecent = 100
+
+const (
+	outcomeAccepted     = "accepted"
+	outcomeRejectedAuth = "rejected_auth" // username refused during the handshake
+
+	outcomeRejectedVersion    = "rejected_version"    // client older than --min-client-version
+	outcomeRejectedThrottled  = "rejected_throttled"  // too many connections from the address
+	outcomeRejectedReputation = "rejected_reputation" // from a network listed as malicious
+)
+
+type connectionAttempt struct {
+	Event      string    `json:"event"` // always "connection_attempt"
+	RemoteAddr string    `json:"remote_addr"`
+	Username   string    `json:"username,omitempty"`
+	Timestamp  time.Time `json:"timestamp"`
+	Outcome    string    `json:"outcome"`
+}
+
+type connectionLog struct {
+	mu     sync.Mutex
+	file   *os.File // nil when only keeping entries in memory
+	recent []connectionAttempt
+}
+
+// Opens the log, appending to path if it is not empty.
+func newConnectionLog(path string) (*connectionLog, error) {
+	l := &connectionLog{}
+	if path != "" {
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, err
+		}
+		l.file = file
+	}
+	return l, nil
+}
+
+func (l *connectionLog) record(addr net.Addr, username string, outcome string) {
+	attempt := connectionAttempt{
+		Event:      "connection_attempt",
+		RemoteAddr: addr.String(),
+		Username:   username,
+		Timestamp:  time.Now(),
+		Outcome:    outcome,
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.recent = append(l.recent, attempt)
+	if len(l.recent) > connectionLogRecent {
+		l.recent = l.recent[len(l.recent)-connectionLogRecent:]
+	}
+
+	if l.file != nil {
+		line, _ := json.Marshal(attempt)
+		if _, err := l.file.Write(append(line, '\n')); err != nil {
+			log.Print("Writing connection log: ", err)
+		}
+	}
+}
+
+// Returns the last entries, oldest first.
+func (l *connectionLog) entries() []connectionAttempt {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]connectionAttempt{}, l.recent...)
+}
+
+func (l *connectionLog) register(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/connection-log", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, l.entries())
+	})
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConnectionLogOutcomes(t *testing.T) {
+	reputation, err := loadReputation(testReputationFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hello := `{"type":"client_hello","client_version":"1.2.3"}` + "\n"
+	oldHello := `{"type":"client_hello","client_version":"1.0.0"}` + "\n"
+
+	tests := []struct {
+		name         string
+		remote       string
+		reads        []string
+		wantUsername string
+		wantOutcome  string
+	}{
+		{"accepted", "10.0.0.1:5000", []string{hello + "alice\n"}, "alice", outcomeAccepted},
+		{"invalid username", "10.0.0.1:5000", []string{hello + "al ice\n"}, "al ice", outcomeRejectedAuth},
+		{"client too old", "10.0.0.1:5000", []string{oldHello + "alice\n"}, "alice", outcomeRejectedVersion},
+		{"malicious network", "1.2.3.4:5000", []string{"alice\n"}, "", outcomeRejectedReputation},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newConnectionTest()
+			c.reputation = reputation
+			c.config.minClientVersion = "1.2.0"
+
+			c.handle(t, newMockConn(tt.remote, tt.reads...))
+
+			entries := c.connLog.entries()
+			if len(entries) != 1 {
+				t.Fatalf("logged %+v, want one attempt", entries)
+			}
+			got := entries[0]
+			if got.Event != "connection_attempt" || got.RemoteAddr != tt.remote || got.Username != tt.wantUsername ||
+				got.Outcome != tt.wantOutcome || got.Timestamp.IsZero() {
+				t.Errorf("logged %+v, want %s from %s as %q", got, tt.wantOutcome, tt.remote, tt.wantUsername)
+			}
+		})
+	}
+
+	t.Run("too many connections", func(t *testing.T) {
+		ln, accepted := newTestLimitedListener(t, 1)
+		dialLimited(t, ln)
+		waitAccepted(t, accepted)
+		refused := dialLimited(t, ln)
+		expectRefused(t, refused)
+
+		entries := ln.connLog.entries()
+		if len(entries) != 1 || entries[0].Outcome != outcomeRejectedThrottled || entries[0].RemoteAddr != refused.LocalAddr().String() {
+			t.Errorf("logged %+v, want the second connection throttled", entries)
+		}
+	})
+}
+
+// Attempts are appended to the file as NDJSON, and the admin API
+// returns the most recent.
+func TestConnectionLogFileAndAPI(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "connections.ndjson")
+	l, err := newConnectionLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i <= connectionLogRecent; i++ {
+		addr := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 5000 + i}
+		l.record(addr, fmt.Sprint("user", i), outcomeAccepted)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	lines := 0
+	for scanner := bufio.NewScanner(file); scanner.Scan(); lines++ {
+		var attempt connectionAttempt
+		if err := json.Unmarshal(scanner.Bytes(), &attempt); err != nil {
+			t.Fatalf("line %d: %v", lines+1, err)
+		}
+		if want := fmt.Sprint("user", lines); attempt.Username != want {
+			t.Errorf("line %d is for %q, want %q", lines+1, attempt.Username, want)
+		}
+	}
+	if lines != connectionLogRecent+1 {
+		t.Errorf("wrote %d lines, want %d", lines, connectionLogRecent+1)
+	}
+
+	mux := http.NewServeMux()
+	l.register(mux)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/api/connection-log", nil))
+	var entries []connectionAttempt
+	if err := json.Unmarshal(w.Body.Bytes(), &entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != connectionLogRecent || entries[0].Username != "user1" || entries[len(entries)-1].Username != fmt.Sprint("user", connectionLogRecent) {
+		t.Errorf("API returned %d entries from %+v, want the last %d", len(entries), entries[0], connectionLogRecent)
+	}
+}
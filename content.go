@@ -0,0 +1,36 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// Content types a message can declare, for clients that carry
+// structured data as well as chat. Messages without one are
+// text/plain. Only the long-polling transport's JSON messages
+// have a place to declare a type.
+var contentTypes = map[string]bool{
+	"text/plain":          true,
+	"text/markdown":       true,
+	"application/json":    true,
+	"application/x-alert": true,
+}
+
+var (
+	ErrContentType = errors.New("unsupported content type")
+	ErrInvalidJSON = errors.New("application/json message is not valid JSON")
+)
+
+// Checks that a message's text is of its declared content type.
+func validateContent(contentType string, text string) error {
+	if contentType == "" {
+		return nil
+	}
+	if !contentTypes[contentType] {
+		return ErrContentType
+	}
+	if contentType == "application/json" && !json.Valid([]byte(text)) {
+		return ErrInvalidJSON
+	}
+	return nil
+}
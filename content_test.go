@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestValidateContent(t *testing.T) {
+	tests := []struct {
+		contentType string
+		text        string
+		want        error
+	}{
+		{"", "hello", nil},
+		{"text/plain", "hello", nil},
+		{"text/markdown", "**hello**", nil},
+		{"application/x-alert", "disk full", nil},
+		{"application/json", `{"build_id":42,"status":"failed"}`, nil},
+		{"application/json", `{"build_id":42,`, ErrInvalidJSON},
+		{"application/json", "hello", ErrInvalidJSON},
+		{"image/png", "hello", ErrContentType},
+	}
+	for _, tt := range tests {
+		if got := validateContent(tt.contentType, tt.text); got != tt.want {
+			t.Errorf("validateContent(%q, %q) = %v, want %v", tt.contentType, tt.text, got, tt.want)
+		}
+	}
+}
+
+// Long-poll messages that aren't what they claim to be are refused;
+// the rest carry their content type on.
+func TestLPSendContentType(t *testing.T) {
+	server := newTestLPServer(t, serverConfig{})
+	messages := server.bus.subscribe()
+	id, _ := lpJoin(t, server, "alice")
+
+	if status := lpSend(t, server, id, `{"text":"{\"status\":","content_type":"application/json"}`); status != http.StatusBadRequest {
+		t.Errorf("invalid JSON: status %d, want %d", status, http.StatusBadRequest)
+	}
+	if status := lpSend(t, server, id, `{"text":"hi","content_type":"image/png"}`); status != http.StatusBadRequest {
+		t.Errorf("unsupported content type: status %d, want %d", status, http.StatusBadRequest)
+	}
+	if status := lpSend(t, server, id, `{"text":"{\"status\":\"ok\"}","content_type":"application/json"}`); status != http.StatusNoContent {
+		t.Fatalf("valid JSON: status %d, want %d", status, http.StatusNoContent)
+	}
+
+	packet := <-messages
+	if packet.text != `{"status":"ok"}` || packet.contentType != "application/json" {
+		t.Errorf("published %q as %q, want only the valid JSON", packet.text, packet.contentType)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Dead-letter queue for messages that weren't delivered to anyone,
+// because every write failed or nobody else was connected. Rather
+// than lose them silently, the broadcaster keeps the most recent ones
+// here. On the admin API,
+//
+//	GET /api/dlq
+//	     lists the queued messages, oldest first.
+//	POST /api/dlq/replay
+//	     empties the queue, handing the messages back to the
+//	     broadcaster to deliver to the users connected now.
+//	     Replays are only delivered: they aren't added to the
+//	     history again, and aren't passed to the Slack webhook
+//	     or long-poll clients, which saw them the first time.
+
+const deadLetterCapacity = 1000
+
+type deadLetter struct {
+	Sender   string    `json:"sender"`
+	Text     string    `json:"text"`
+	FailedAt time.Time `json:"failed_at"`
+
+	packet messagePacket
+}
+
+type deadLetterQueue struct {
+	mu      sync.Mutex
+	letters []deadLetter
+
+	replays chan messagePacket // read by the broadcaster
+}
+
+func newDeadLetterQueue() *deadLetterQueue {
+	return &deadLetterQueue{replays: make(chan messagePacket, deadLetterCapacity)}
+}
+
+// Queues a message, dropping the oldest once the queue is full.
+func (q *deadLetterQueue) add(packet messagePacket) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.letters = append(q.letters, deadLetter{
+		Sender:   packet.sender,
+		Text:     packet.text,
+		FailedAt: time.Now(),
+		packet:   packet,
+	})
+	if len(q.letters) > deadLetterCapacity {
+		q.letters = q.letters[len(q.letters)-deadLetterCapacity:]
+	}
+}
+
+func (q *deadLetterQueue) list() []deadLetter {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return append([]deadLetter{}, q.letters...)
+}
+
+// Empties the queue, returning what was in it.
+func (q *deadLetterQueue) drain() []deadLetter {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	letters := q.letters
+	q.letters = nil
+	return letters
+}
+
+func (q *deadLetterQueue) register(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/dlq", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, q.list())
+	})
+
+	mux.HandleFunc("POST /api/dlq/replay", func(w http.ResponseWriter, r *http.Request) {
+		letters := q.drain()
+		for _, letter := range letters {
+			q.replays <- letter.packet
+		}
+		writeJSON(w, http.StatusOK, map[string]int{"replayed": len(letters)})
+	})
+}
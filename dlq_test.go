@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDeadLetterQueue(t *testing.T) {
+	q := newDeadLetterQueue()
+	mux := http.NewServeMux()
+	q.register(mux)
+
+	for i := 0; i < deadLetterCapacity+2; i++ {
+		q.add(messagePacket{sender: "alice", text: fmt.Sprintf("message %d", i)})
+	}
+
+	// the oldest are dropped once it's full
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/api/dlq", nil))
+	var letters []deadLetter
+	if err := json.NewDecoder(w.Body).Decode(&letters); err != nil {
+		t.Fatal(err)
+	}
+	if len(letters) != deadLetterCapacity {
+		t.Fatalf("listed %d dead letters, want %d", len(letters), deadLetterCapacity)
+	}
+	if letters[0].Text != "message 2" || letters[len(letters)-1].Text != fmt.Sprint("message ", deadLetterCapacity+1) {
+		t.Errorf("listed %q to %q", letters[0].Text, letters[len(letters)-1].Text)
+	}
+	if letters[0].Sender != "alice" || letters[0].FailedAt.IsZero() {
+		t.Errorf("first dead letter = %+v", letters[0])
+	}
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("POST", "/api/dlq/replay", nil))
+	if w.Code != http.StatusOK || w.Body.String() != fmt.Sprintf(`{"replayed":%d}`+"\n", deadLetterCapacity) {
+		t.Fatalf("replay answered %d %s", w.Code, w.Body)
+	}
+	if len(q.list()) != 0 {
+		t.Errorf("%d dead letters left after replaying", len(q.list()))
+	}
+	if len(q.replays) != deadLetterCapacity {
+		t.Fatalf("%d messages handed back to the broadcaster", len(q.replays))
+	}
+	if packet := <-q.replays; packet.text != "message 2" {
+		t.Errorf("replayed %q first", packet.text)
+	}
+}
+
+// A message nobody gets is dead-lettered, and replaying it delivers
+// it to whoever has joined since.
+func TestBroadcastDeadLetters(t *testing.T) {
+	pool := newSafePool()
+	deadLetters := newDeadLetterQueue()
+	messages := make(chan messagePacket)
+	history := runBroadcaster(t, pool, messages, nil, nil, NoopScanner{}, deadLetters)
+
+	messages <- messagePacket{sender: "alice", text: "anyone here?", source: "10.0.0.1:5000"}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(deadLetters.list()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the message wasn't dead-lettered")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if len(history.snapshot()) != 1 {
+		t.Error("the message wasn't kept in the history")
+	}
+
+	read := addCountingUser(t, pool)
+	mux := http.NewServeMux()
+	deadLetters.register(mux)
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/api/dlq/replay", nil))
+	deadline = time.Now().Add(5 * time.Second)
+	for read.Load() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the replayed message wasn't delivered")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if len(history.snapshot()) != 1 {
+		t.Error("the replayed message was added to the history again")
+	}
+	if n := len(deadLetters.list()); n != 0 {
+		t.Errorf("%d dead letters after delivering the replay", n)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Graceful shutdown. On SIGTERM or interrupt the server first drains:
+// it keeps running for the users already connected but turns new
+// connections away with a "server is draining" error, and waits up to
+// drainTimeout for everyone to leave. Then it stops, disconnecting
+// whoever is left. A second signal stops it straight away. Long-poll
+// clients are refused both joins and sends while the server drains.
+
+const (
+	drainTimeout      = 30 * time.Second
+	drainPollInterval = 100 * time.Millisecond
+)
+
+var errDrainTimeout = errors.New("timed out waiting for clients to disconnect")
+
+// The error sent to clients turned away while draining.
+const drainingText = "server is draining"
+
+// Stops new connections being accepted and waits until the pool is
+// empty, or until timeout has passed.
+func drain(pool *safePool, draining *atomic.Bool, timeout time.Duration) error {
+	draining.Store(true)
+	log.Print("Draining: waiting for ", len(pool.snapshot()), " clients to disconnect")
+
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	deadline := time.After(timeout)
+	for len(pool.snapshot()) > 0 {
+		select {
+		case <-ticker.C:
+		case <-deadline:
+			return errDrainTimeout
+		}
+	}
+	return nil
+}
+
+// Returns a context that is cancelled once the server has drained
+// after a SIGTERM or interrupt, or on a second signal.
+func drainOnSignal(pool *safePool, draining *atomic.Bool) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		<-signals
+		go func() {
+			<-signals
+			log.Print("Stopping without waiting for clients")
+			cancel()
+		}()
+
+		if err := drain(pool, draining, drainTimeout); err != nil {
+			log.Print(err)
+		}
+		cancel()
+	}()
+	return ctx, cancel
+}
+
+// Restarts the server on POST /api/restart: it drains as it would on
+// SIGTERM, then stops, leaving a process manager such as systemd to
+// start it again. With --restart-exec it instead replaces itself with
+// a fresh copy of its binary, keeping its PID. The request returns
+// 202 straight away, or 409 if the server is already shutting down.
+func registerRestartAPI(mux *http.ServeMux, pool *safePool, draining *atomic.Bool, cancel context.CancelFunc,
+	restartExec bool, reexec *atomic.Bool) {
+	mux.HandleFunc("POST /api/restart", func(w http.ResponseWriter, r *http.Request) {
+		if draining.Load() {
+			http.Error(w, "already shutting down", http.StatusConflict)
+			return
+		}
+		log.Print("Restart requested through the admin API")
+		go func() {
+			if err := drain(pool, draining, drainTimeout); err != nil {
+				log.Print(err)
+			}
+			reexec.Store(restartExec)
+			cancel()
+		}()
+		w.WriteHeader(http.StatusAccepted)
+	})
+}
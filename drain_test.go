@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDrain(t *testing.T) {
+	tests := []struct {
+		name      string
+		users     int
+		leaveAt   time.Duration // when the users leave, or 0 to stay
+		wantErr   error
+		wantUnder time.Duration
+	}{
+		{"no users", 0, 0, nil, drainPollInterval},
+		{"users leave", 2, 50 * time.Millisecond, nil, time.Second},
+		{"users stay", 2, 0, errDrainTimeout, 2 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool := newSafePool()
+			for i := 0; i < tt.users; i++ {
+				pool.addIfAbsent(fmt.Sprintf("10.0.0.%d:5000", i), user{username: fmt.Sprintf("user%d", i)})
+			}
+			if tt.leaveAt > 0 {
+				time.AfterFunc(tt.leaveAt, func() {
+					for i := 0; i < tt.users; i++ {
+						pool.remove(fmt.Sprintf("10.0.0.%d:5000", i))
+					}
+				})
+			}
+
+			var draining atomic.Bool
+			start := time.Now()
+			err := drain(pool, &draining, time.Second)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("drain() = %v, want %v", err, tt.wantErr)
+			}
+			if elapsed := time.Since(start); elapsed > tt.wantUnder {
+				t.Errorf("drain took %v, want under %v", elapsed, tt.wantUnder)
+			}
+			if !draining.Load() {
+				t.Error("drain didn't set draining")
+			}
+		})
+	}
+}
+
+func TestRestartAPI(t *testing.T) {
+	pool := newSafePool()
+	var draining, reexec atomic.Bool
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mux := http.NewServeMux()
+	registerRestartAPI(mux, pool, &draining, cancel, true, &reexec)
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("POST", "/api/restart", nil))
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("POST /api/restart returned %d, want %d", w.Code, http.StatusAccepted)
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("the server wasn't stopped once drained")
+	}
+	if !reexec.Load() {
+		t.Error("restart with --restart-exec didn't ask for a re-exec")
+	}
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("POST", "/api/restart", nil))
+	if w.Code != http.StatusConflict {
+		t.Errorf("second restart returned %d, want %d", w.Code, http.StatusConflict)
+	}
+}
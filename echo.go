@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Round-trip latency checks. A client can send
+//
+//	{"type":"ping_echo","payload":"9f2c...","sent_at":"2024-05-01T12:00:00.123456789Z"}
+//
+// and the server answers that connection straight away, without
+// broadcasting it, with
+//
+//	{"type":"pong_echo","payload":"9f2c...","sent_at":"...","received_at":"..."}
+//
+// where payload and sent_at are echoed unchanged. Typing /latency in
+// the client sends latencyProbes pings one after another and prints
+// the minimum, average and maximum round-trip times.
+
+const (
+	latencyCommand = "/latency"
+	latencyProbes  = 5
+	latencyTimeout = 5 * time.Second
+)
+
+type pingPacket struct {
+	Type    string    `json:"type"` // always "ping_echo"
+	Payload string    `json:"payload"`
+	SentAt  time.Time `json:"sent_at"`
+}
+
+type pongPacket struct {
+	Type       string    `json:"type"` // always "pong_echo"
+	Payload    string    `json:"payload"`
+	SentAt     time.Time `json:"sent_at"`
+	ReceivedAt time.Time `json:"received_at"`
+}
+
+func sendPong(conn net.Conn, ping pingPacket) error {
+	line, err := json.Marshal(pongPacket{Type: "pong_echo", Payload: ping.Payload, SentAt: ping.SentAt, ReceivedAt: time.Now()})
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(append(line, '\n'))
+	return err
+}
+
+// Pings the server latencyProbes times, waiting for each pong
+// on pongs, and prints the round-trip times.
+func measureLatency(out *outbox, pongs <-chan pongPacket) error {
+	var total, least, most time.Duration
+	for i := 0; i < latencyProbes; i++ {
+		payload := make([]byte, 8)
+		rand.Read(payload)
+		ping := pingPacket{Type: "ping_echo", Payload: hex.EncodeToString(payload), SentAt: time.Now()}
+
+		line, err := json.Marshal(ping)
+		if err != nil {
+			return err
+		}
+		if err := out.send(string(line)); err != nil {
+			return err
+		}
+
+		rtt, err := awaitPong(pongs, ping.Payload)
+		if err != nil {
+			return err
+		}
+		total += rtt
+		if i == 0 || rtt < least {
+			least = rtt
+		}
+		most = max(most, rtt)
+	}
+	fmt.Printf("Round trip: min %v, avg %v, max %v\n", least, total/latencyProbes, most)
+	return nil
+}
+
+// Waits for the pong echoing payload, skipping any
+// left over from an earlier, timed out, ping.
+func awaitPong(pongs <-chan pongPacket, payload string) (time.Duration, error) {
+	timeout := time.After(latencyTimeout)
+	for {
+		select {
+		case pong := <-pongs:
+			if pong.Payload == payload {
+				return time.Since(pong.SentAt), nil
+			}
+		case <-timeout:
+			return 0, errors.New("no reply from the server")
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// The server echoes a ping to its sender alone, with the payload and
+// sent_at unchanged.
+func TestPingEcho(t *testing.T) {
+	s := startTestServer(t)
+	config := clientConfig{endpoint: s.addr()}
+	alice := dialTestClient(t, config, "alice")
+	dialTestClient(t, config, "bob")
+
+	sentAt := time.Date(2026, 1, 2, 15, 4, 5, 123456789, time.UTC)
+	ping, err := json.Marshal(pingPacket{Type: "ping_echo", Payload: "9f2cé \"quoted\"", SentAt: sentAt})
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := time.Now()
+	alice.send(t, string(ping))
+
+	timeout := time.After(integrationTimeout)
+	for {
+		select {
+		case line := <-alice.lines:
+			packetType, raw := decodePacket(line)
+			if packetType != "pong_echo" {
+				continue
+			}
+			var pong pongPacket
+			if err := json.Unmarshal(raw, &pong); err != nil {
+				t.Fatal(err)
+			}
+			if pong.Payload != "9f2cé \"quoted\"" || !pong.SentAt.Equal(sentAt) {
+				t.Errorf("pong = %+v, want the ping's payload and sent_at", pong)
+			}
+			if pong.ReceivedAt.Before(before) || pong.ReceivedAt.After(time.Now()) {
+				t.Errorf("received_at %v isn't between sending and the reply", pong.ReceivedAt)
+			}
+			if n := len(s.history.snapshot()); n != 0 {
+				t.Errorf("ping was broadcast")
+			}
+			return
+		case <-timeout:
+			t.Fatal("no pong")
+		}
+	}
+}
+
+// Pongs for earlier pings that timed out are skipped.
+func TestAwaitPong(t *testing.T) {
+	pongs := make(chan pongPacket, 2)
+	pongs <- pongPacket{Payload: "old", SentAt: time.Now().Add(-time.Hour)}
+	pongs <- pongPacket{Payload: "new", SentAt: time.Now().Add(-10 * time.Millisecond)}
+
+	rtt, err := awaitPong(pongs, "new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rtt < 10*time.Millisecond || rtt > time.Minute {
+		t.Errorf("round trip of %v, want around 10ms", rtt)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Saving the conversation to a file. Typing /export [filename] in the
+// client asks the server for the message history with
+//
+//	{"type":"export_request"}
+//
+// which is answered, to that client only, with
+//
+//	{"type":"export_data","messages":[{"sender":"alice","text":"hi","timestamp":"..."}]}
+//
+// The client writes the messages to filename, by default
+// chat-<timestamp>.txt, one "[15:04:05] sender: text" line each
+// after a header saying when the export was made.
+
+const exportCommand = "/export"
+
+type exportRequest struct {
+	Type string `json:"type"` // always "export_request"
+}
+
+type exportMessage struct {
+	Sender    string    `json:"sender"`
+	Text      string    `json:"text"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+type exportData struct {
+	Type     string          `json:"type"` // always "export_data"
+	Messages []exportMessage `json:"messages"`
+}
+
+func sendExport(conn net.Conn, history []messagePacket) error {
+	data := exportData{Type: "export_data", Messages: []exportMessage{}}
+	for _, packet := range history {
+		data.Messages = append(data.Messages, exportMessage{Sender: packet.sender, Text: packet.text, Timestamp: packet.timestamp})
+	}
+	line, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(append(line, '\n'))
+	return err
+}
+
+func writeExport(path string, data exportData) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	fmt.Fprintf(w, "Chat history exported %s\n", time.Now().Format(time.RFC1123))
+	for _, message := range data.Messages {
+		fmt.Fprintf(w, "[%s] %s: %s\n", message.Timestamp.Format(time.TimeOnly), message.Sender, message.Text)
+	}
+	if err := w.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// Where the client saves the export it is waiting for. The sending
+// goroutine sets it and the receiving goroutine takes it.
+type pendingExport struct {
+	mu   sync.Mutex
+	path string
+}
+
+// Asks the server for the history, to be saved to path.
+func (p *pendingExport) request(out *outbox, path string) error {
+	if path == "" {
+		path = "chat-" + time.Now().Format("20060102-150405") + ".txt"
+	}
+	p.mu.Lock()
+	p.path = path
+	p.mu.Unlock()
+
+	line, err := json.Marshal(exportRequest{Type: "export_request"})
+	if err != nil {
+		return err
+	}
+	return out.send(string(line))
+}
+
+// Returns the path to save to, and clears it.
+func (p *pendingExport) take() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	path := p.path
+	p.path = ""
+	return path
+}
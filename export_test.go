@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Exports are answered from a snapshot, so the broadcaster can keep
+// appending while one is written. Run with -race.
+func TestSendExportDuringBroadcasts(t *testing.T) {
+	history := newMessageHistory(0)
+	for i := 0; i < 100; i++ {
+		history.append(messagePacket{sender: "alice", text: "hello", timestamp: time.Now()})
+	}
+
+	server, client := net.Pipe()
+	defer client.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			history.append(messagePacket{sender: "bob", text: "hi", timestamp: time.Now()})
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		defer server.Close()
+		if err := sendExport(server, history.snapshot()); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	line, err := bufio.NewReader(client).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+
+	packetType, raw := decodePacket(strings.TrimSpace(line))
+	if packetType != "export_data" {
+		t.Fatalf("got a %q packet, want export_data", packetType)
+	}
+	var data exportData
+	if err := json.Unmarshal(raw, &data); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(data.Messages); n < 100 || n > 200 {
+		t.Errorf("exported %d messages, want between 100 and 200", n)
+	}
+	if data.Messages[0].Sender != "alice" || data.Messages[0].Text != "hello" {
+		t.Errorf("first message is %+v", data.Messages[0])
+	}
+}
+
+func TestWriteExport(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chat.txt")
+	at := time.Date(2024, 5, 1, 12, 30, 0, 0, time.Local)
+	data := exportData{Messages: []exportMessage{
+		{Sender: "alice", Text: "hi", Timestamp: at},
+		{Sender: "bob", Text: "hello", Timestamp: at.Add(time.Minute)},
+	}}
+	if err := writeExport(path, data); err != nil {
+		t.Fatal(err)
+	}
+
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := os.ReadFile("testdata/history.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, messages, _ := strings.Cut(string(contents), "\n")
+	if !strings.HasPrefix(header, "Chat history exported ") || messages != string(want) {
+		t.Errorf("export is\n%s\nwant a header then\n%s", contents, want)
+	}
+}
+
+// The client remembers where to save the export it asked for, once.
+func TestPendingExport(t *testing.T) {
+	conn := newMockConn("10.0.0.1:8011")
+	var exports pendingExport
+	if err := exports.request(newOutbox(conn), "chat.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if got := conn.written(); got != `{"type":"export_request"}` {
+		t.Errorf("sent %q, want an export request", got)
+	}
+	if path := exports.take(); path != "chat.txt" {
+		t.Errorf("took %q, want chat.txt", path)
+	}
+	if path := exports.take(); path != "" {
+		t.Errorf("took %q again, want nothing", path)
+	}
+
+	exports.request(newOutbox(newMockConn("10.0.0.1:8011")), "")
+	if path := exports.take(); !strings.HasPrefix(path, "chat-") || !strings.HasSuffix(path, ".txt") {
+		t.Errorf("default path %q, want a timestamped chat-*.txt", path)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// How single-line messages look to clients, set with --message-format
+// as a text/template. The fields available are
+//
+//	{{.Sender}}     the sender's username
+//	{{.Text}}       the message
+//	{{.Timestamp}}  when it was broadcast, a time.Time, so
+//	                {{.Timestamp.Format "15:04"}} also works
+//
+// Clients recognise messages by the "BROADCAST " prefix of the
+// default, so custom formats are for plain-text clients such as nc.
+//
+// Clients take lines starting with { for control packets, so a
+// format that lets a user's text or name start a line, such as
+// "{{.Text}}", would let them send commands to everyone. Formats
+// like that are refused.
+
+const defaultMessageFormat = "BROADCAST {{.Sender}}: {{.Text}}"
+
+type messageFields struct {
+	Sender    string
+	Text      string
+	Timestamp time.Time
+}
+
+var errFormatStartsPacket = errors.New("a line of the format must not start with {, or with the sender or text")
+
+// Parses a --message-format template, and tries it on a sample
+// message so that unknown fields are reported now rather than
+// when the first message is sent. The sample's sender and text
+// start with {, to catch formats that could forge control packets.
+func parseMessageFormat(format string) (*template.Template, error) {
+	tmpl, err := template.New("message-format").Parse(format)
+	if err != nil {
+		return nil, err
+	}
+	var sample strings.Builder
+	if err := tmpl.Execute(&sample, messageFields{Sender: "{", Text: "{", Timestamp: time.Now()}); err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(sample.String(), "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "{") {
+			return nil, errFormatStartsPacket
+		}
+	}
+	return tmpl, nil
+}
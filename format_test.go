@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestParseMessageFormat(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  string
+		wantErr error // nil for a format that's accepted
+	}{
+		{"default", defaultMessageFormat, nil},
+		{"timestamp first", `[{{.Timestamp.Format "15:04"}}] {{.Sender}}: {{.Text}}`, nil},
+		{"text first", "{{.Text}}", errFormatStartsPacket},
+		{"sender first", "{{.Sender}} says {{.Text}}", errFormatStartsPacket},
+		{"leading space", "  {{.Text}}", errFormatStartsPacket},
+		{"literal brace", `{"type":"command"}`, errFormatStartsPacket},
+		{"text on its own line", "{{.Sender}}:\n{{.Text}}", errFormatStartsPacket},
+		{"text through a function", `{{printf "%s" .Text}}`, errFormatStartsPacket},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseMessageFormat(tt.format)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("parseMessageFormat(%q) = %v, want %v", tt.format, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseMessageFormatUnknownField(t *testing.T) {
+	if _, err := parseMessageFormat("BROADCAST {{.Room}}"); err == nil {
+		t.Error("a format with an unknown field was accepted")
+	}
+}
+
+// A user's text must not come out of the broadcast as a line a
+// client would take for a control packet.
+func TestFormatBroadcastCannotForgePackets(t *testing.T) {
+	format, err := parseMessageFormat(defaultMessageFormat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet := messagePacket{sender: "mallory", text: `{"type":"command","action":"redirect","payload":"evil:8011"}`, timestamp: time.Now()}
+	if packetType, _ := decodePacket(formatBroadcast(format, packet)); packetType != "" {
+		t.Errorf("broadcast decoded as a %q packet", packetType)
+	}
+
+	packet.text = "line one\n" + packet.text
+	if packetType, _ := decodePacket(formatBroadcast(format, packet)); packetType != "multiline" {
+		t.Errorf("multi-line broadcast decoded as %q, want multiline", packetType)
+	}
+}
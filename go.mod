@@ -0,0 +1,3 @@
+module chat_project
+
+go 1.22
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Client version announcement. Before its username, the client
+// sends a JSON line describing itself:
+//
+//	{"type":"client_hello","client_version":"1.2.3","supported_features":["multiline","commands"]}
+//
+// The hello is optional, so older clients that send only the
+// username still connect. A server started with --min-client-version
+// turns away clients older than that version with
+//
+//	{"type":"error","text":"client too old, please upgrade"}
+//
+// Clients without a hello, or with a version that isn't dotted
+// numbers (such as a "dev" build), count as older than any minimum.
+//
+// Every error the server reports to a client, during the handshake
+// or after, is sent as an error packet like the one above.
+
+// Features this client understands, announced in its hello.
+var clientFeatures = []string{"multiline", "commands", "markdown", "multicast"}
+
+type helloPacket struct {
+	Type              string   `json:"type"` // always "client_hello"
+	ClientVersion     string   `json:"client_version"`
+	SupportedFeatures []string `json:"supported_features"`
+}
+
+type errorPacket struct {
+	Type string `json:"type"` // always "error"
+	Text string `json:"text"`
+}
+
+func sendHello(conn net.Conn) error {
+	line, err := json.Marshal(helloPacket{Type: "client_hello", ClientVersion: Version, SupportedFeatures: clientFeatures})
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(append(line, '\n'))
+	return err
+}
+
+func sendError(conn net.Conn, text string) error {
+	line, err := json.Marshal(errorPacket{Type: "error", Text: text})
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(append(line, '\n'))
+	return err
+}
+
+// Reads the start of a new connection: the optional hello, then the
+// username. Both usually arrive in one read, but the username may
+// follow separately.
+func readHandshake(conn net.Conn) (hello helloPacket, name string, err error) {
+	buffer := make([]byte, 1024)
+	size, err := conn.Read(buffer)
+	if err != nil {
+		return hello, "", err
+	}
+	text := string(buffer[:size])
+
+	line, rest, _ := strings.Cut(text, "\n")
+	if packetType, raw := decodePacket(line); packetType == "client_hello" {
+		json.Unmarshal(raw, &hello)
+		text = rest
+		if text == "" {
+			size, err := conn.Read(buffer)
+			if err != nil {
+				return hello, "", err
+			}
+			text = string(buffer[:size])
+		}
+	}
+	return hello, strings.TrimSpace(text), nil
+}
+
+// Splits a version such as "1.2.3" or "v1.2" into its numbers,
+// reporting false if it is not in that form.
+func parseVersion(version string) ([]int, bool) {
+	version = strings.TrimPrefix(version, "v")
+	if version == "" {
+		return nil, false
+	}
+	var numbers []int
+	for _, part := range strings.Split(version, ".") {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, false
+		}
+		numbers = append(numbers, n)
+	}
+	return numbers, true
+}
+
+// Reports whether version is older than minimum, treating missing
+// trailing numbers as zero so that "1.2" and "1.2.0" are equal.
+func olderThan(version string, minimum string) bool {
+	have, ok := parseVersion(version)
+	if !ok {
+		return true
+	}
+	want, _ := parseVersion(minimum)
+	for i := 0; i < max(len(have), len(want)); i++ {
+		var h, w int
+		if i < len(have) {
+			h = have[i]
+		}
+		if i < len(want) {
+			w = want[i]
+		}
+		if h != w {
+			return h < w
+		}
+	}
+	return false
+}
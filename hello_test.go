@@ -0,0 +1,67 @@
+package main
+
+import "testing"
+
+func TestOlderThan(t *testing.T) {
+	tests := []struct {
+		version string
+		minimum string
+		want    bool
+	}{
+		{"1.2.3", "1.2.0", false},
+		{"1.2.0", "1.2.0", false},
+		{"1.2", "1.2.0", false},
+		{"v1.10.0", "1.9.0", false},
+		{"1.1.9", "1.2.0", true},
+		{"0.9", "1.2.0", true},
+		{"dev", "1.2.0", true},
+		{"", "1.2.0", true},
+	}
+	for _, tt := range tests {
+		if got := olderThan(tt.version, tt.minimum); got != tt.want {
+			t.Errorf("olderThan(%q, %q) = %v, want %v", tt.version, tt.minimum, got, tt.want)
+		}
+	}
+}
+
+// Clients older than --min-client-version are turned away; newer
+// ones are let in with their version recorded.
+func TestHandleConnectionMinClientVersion(t *testing.T) {
+	tests := []struct {
+		name        string
+		reads       []string
+		wantVersion string // recorded for the user, if let in
+	}{
+		{"too old", []string{`{"type":"client_hello","client_version":"1.1.0"}` + "\nalice\n"}, ""},
+		{"no hello", []string{"alice\n"}, ""},
+		{"new enough", []string{`{"type":"client_hello","client_version":"1.2.3"}` + "\nalice\n"}, "1.2.3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newConnectionTest()
+			c.config.minClientVersion = "1.2.0"
+			conn := newMockConn("10.0.0.1:5000", tt.reads...)
+			joined, version := false, ""
+			conn.beforeEOF = func() {
+				_, u, ok := c.pool.lookup("alice")
+				joined, version = ok, u.clientVersion
+			}
+
+			c.handle(t, conn)
+
+			if tt.wantVersion == "" {
+				if got, want := conn.written(), `{"type":"error","text":"client too old, please upgrade"}`+"\n"; got != want {
+					t.Errorf("got %q, want %q", got, want)
+				}
+				if joined {
+					t.Error("alice was let in")
+				}
+			} else if !joined || version != tt.wantVersion {
+				t.Errorf("joined %v with version %q, want %q", joined, version, tt.wantVersion)
+			}
+			if !conn.isClosed() {
+				t.Error("connection wasn't closed")
+			}
+		})
+	}
+}
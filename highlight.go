@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Client-side highlighting. Parts of incoming messages matching any
+// of the user's regular expressions are shown on a bright background.
+// Rules are managed with
+//
+//	/highlight add <pattern>
+//	/highlight list
+//	/highlight remove <index>
+//
+// and saved to ~/.chatrc as "highlight <pattern>" lines, so they
+// last between sessions. Other lines in the file are kept as they are.
+
+const (
+	highlightCommand = "/highlight"
+	chatrcName       = ".chatrc"
+	chatrcHighlight  = "highlight "
+
+	ansiHighlight = "\033[30;103m" // black on bright yellow
+)
+
+type highlighter struct {
+	mu    sync.Mutex
+	rules []*regexp.Regexp
+	path  string // the .chatrc file, empty if there is no home directory
+}
+
+// Loads the rules saved in ~/.chatrc. Missing files are fine,
+// and saved patterns that no longer compile are skipped.
+func loadHighlighter() *highlighter {
+	h := &highlighter{}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return h
+	}
+	h.path = filepath.Join(home, chatrcName)
+
+	file, err := os.Open(h.path)
+	if err != nil {
+		return h
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		pattern, ok := strings.CutPrefix(scanner.Text(), chatrcHighlight)
+		if !ok {
+			continue
+		}
+		rule, err := regexp.Compile(pattern)
+		if err != nil {
+			fmt.Printf("Skipping highlight %q from %s: %v\n", pattern, h.path, err)
+			continue
+		}
+		h.rules = append(h.rules, rule)
+	}
+	return h
+}
+
+// Runs a /highlight command, given the text after "/highlight".
+func (h *highlighter) command(args string) {
+	action, arg, _ := strings.Cut(strings.TrimSpace(args), " ")
+	arg = strings.TrimSpace(arg)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	switch action {
+	case "add":
+		if arg == "" {
+			fmt.Println("Usage: /highlight add <pattern>")
+			return
+		}
+		rule, err := regexp.Compile(arg)
+		if err != nil {
+			fmt.Printf("%q is not a valid regular expression: %v\n", arg, err)
+			return
+		}
+		h.rules = append(h.rules, rule)
+		fmt.Println("Highlighting", rule)
+	case "list":
+		if len(h.rules) == 0 {
+			fmt.Println("No highlights")
+		}
+		for i, rule := range h.rules {
+			fmt.Printf("%d: %s\n", i+1, rule)
+		}
+		return
+	case "remove":
+		index, err := strconv.Atoi(arg)
+		if err != nil || index < 1 || index > len(h.rules) {
+			fmt.Println("No highlight", arg, "- see /highlight list")
+			return
+		}
+		fmt.Println("No longer highlighting", h.rules[index-1])
+		h.rules = append(h.rules[:index-1], h.rules[index:]...)
+	default:
+		fmt.Println("Usage: /highlight add <pattern> | list | remove <index>")
+		return
+	}
+
+	if err := h.save(); err != nil {
+		fmt.Println("Couldn't save highlights:", err)
+	}
+}
+
+// Writes the rules to .chatrc in place of the ones there before.
+// Called with the mutex held.
+func (h *highlighter) save() error {
+	if h.path == "" {
+		return nil
+	}
+	var lines []string
+	if data, err := os.ReadFile(h.path); err == nil {
+		for _, line := range strings.Split(strings.TrimRight(string(data), "\n"), "\n") {
+			if line != "" && !strings.HasPrefix(line, chatrcHighlight) {
+				lines = append(lines, line)
+			}
+		}
+	}
+	for _, rule := range h.rules {
+		lines = append(lines, chatrcHighlight+rule.String())
+	}
+	return os.WriteFile(h.path, []byte(strings.Join(lines, "\n")+"\n"), 0o600)
+}
+
+// Wraps the parts of text matching any rule in highlight codes.
+func (h *highlighter) apply(text string) string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.rules) == 0 {
+		return text
+	}
+
+	// mark every matched byte first, so overlapping matches
+	// from different rules make one highlighted run
+	marked := make([]bool, len(text))
+	for _, rule := range h.rules {
+		for _, match := range rule.FindAllStringIndex(text, -1) {
+			for i := match[0]; i < match[1]; i++ {
+				marked[i] = true
+			}
+		}
+	}
+
+	var out strings.Builder
+	for i := 0; i < len(text); i++ {
+		if marked[i] && (i == 0 || !marked[i-1]) {
+			out.WriteString(ansiHighlight)
+		}
+		out.WriteByte(text[i])
+		if marked[i] && (i == len(text)-1 || !marked[i+1]) {
+			out.WriteString(ansiReset)
+		}
+	}
+	return out.String()
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Loads a highlighter from a copy of testdata/chatrc in a temporary
+// home directory, returning it and the copy's path.
+func loadTestHighlighter(t *testing.T) (*highlighter, string) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	chatrc, err := os.ReadFile("testdata/chatrc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(home, chatrcName)
+	if err := os.WriteFile(path, chatrc, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	var h *highlighter
+	captureStdout(t, func() { h = loadHighlighter() })
+	return h, path
+}
+
+// Saved patterns are loaded, skipping any that don't compile.
+func TestLoadHighlighter(t *testing.T) {
+	h, path := loadTestHighlighter(t)
+	if h.path != path {
+		t.Errorf("path %q, want %q", h.path, path)
+	}
+	var patterns []string
+	for _, rule := range h.rules {
+		patterns = append(patterns, rule.String())
+	}
+	if got, want := strings.Join(patterns, " "), `\balice\b deploy(ed|ing)?`; got != want {
+		t.Errorf("loaded %q, want %q", got, want)
+	}
+}
+
+func TestHighlighterApply(t *testing.T) {
+	h, _ := loadTestHighlighter(t)
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"nothing to see", "nothing to see"},
+		{"alice deployed", ansiHighlight + "alice" + ansiReset + " " + ansiHighlight + "deployed" + ansiReset},
+		{"malice", "malice"},
+	}
+	for _, tt := range tests {
+		if got := h.apply(tt.text); got != tt.want {
+			t.Errorf("apply(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+// Commands change the rules and save them, keeping the file's other
+// lines.
+func TestHighlighterCommand(t *testing.T) {
+	h, path := loadTestHighlighter(t)
+
+	tests := []struct {
+		args string
+		want string // printed
+	}{
+		{" add bob", "Highlighting bob\n"},
+		{" add [", `"[" is not a valid regular expression`},
+		{" remove 1", `No longer highlighting \balice\b` + "\n"},
+		{" remove 5", "No highlight 5"},
+		{" list", "1: deploy(ed|ing)?\n2: bob\n"},
+		{"", "Usage:"},
+	}
+	for _, tt := range tests {
+		printed := captureStdout(t, func() { h.command(tt.args) })
+		if !strings.HasPrefix(printed, tt.want) {
+			t.Errorf("/highlight%s printed %q, want %q", tt.args, printed, tt.want)
+		}
+	}
+
+	saved, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "# settings for the chat client\ntheme dark\nhighlight deploy(ed|ing)?\nhighlight bob\n"
+	if string(saved) != want {
+		t.Errorf("saved\n%s\nwant\n%s", saved, want)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// The messages broadcast so far, oldest first, replayed to new
+// clients, exported and served by the admin API. The broadcaster appends to
+// it while connection handlers and the admin API read it, so all
+// access goes through the mutex and readers get a copy.
+//
+// Each message is numbered with its seq as it is added. Long-poll
+// clients track their place by seq, and it keeps counting when old
+// messages are trimmed, so it is not the message's index.
+type messageHistory struct {
+	mu       sync.Mutex
+	messages []messagePacket
+	seq      int           // the last message's seq
+	maxAge   time.Duration // see trim
+}
+
+func newMessageHistory(maxAge time.Duration) *messageHistory {
+	return &messageHistory{maxAge: maxAge}
+}
+
+// Adds a message, returning it numbered with its seq.
+func (h *messageHistory) append(packet messagePacket) messagePacket {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.seq++
+	packet.seq = h.seq
+	h.trim()
+	h.messages = append(h.messages, packet)
+	return packet
+}
+
+// Returns a copy of the messages, oldest first, leaving out
+// those older than maxAge.
+func (h *messageHistory) snapshot() []messagePacket {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.trim()
+	return slices.Clone(h.messages)
+}
+
+// With --history-max-age, messages older than the given age aren't
+// replayed to new clients or exported. They're removed whenever the
+// history is added to or read rather than on a timer. Messages are in
+// the order they arrived, so the expired ones are all at the start.
+// Called with h.mu held.
+func (h *messageHistory) trim() {
+	if h.maxAge <= 0 {
+		return
+	}
+	expired := 0
+	for expired < len(h.messages) && time.Since(h.messages[expired].timestamp) > h.maxAge {
+		expired++
+	}
+	// zeroed so their text can be freed before append next
+	// moves the history to a new array
+	clear(h.messages[:expired])
+	h.messages = h.messages[expired:]
+}
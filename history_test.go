@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"testing/quick"
+	"time"
+)
+
+func TestMessageHistoryNumbersMessages(t *testing.T) {
+	history := newMessageHistory(0)
+	for i := 1; i <= 3; i++ {
+		if packet := history.append(messagePacket{text: "hello"}); packet.seq != i {
+			t.Errorf("message %d got seq %d", i, packet.seq)
+		}
+	}
+	for i, packet := range history.snapshot() {
+		if packet.seq != i+1 {
+			t.Errorf("snapshot[%d].seq = %d, want %d", i, packet.seq, i+1)
+		}
+	}
+}
+
+// The history API reports the seq long-poll clients saw, which keeps
+// counting after old messages are trimmed, not the index.
+func TestHistoryAPISeqAfterTrim(t *testing.T) {
+	history := newMessageHistory(time.Hour)
+	history.append(messagePacket{text: "old", timestamp: time.Now().Add(-2 * time.Hour)})
+	history.append(messagePacket{text: "new #status=ok", timestamp: time.Now(), tags: map[string]string{"status": "ok"}})
+	history.append(messagePacket{text: "newer", timestamp: time.Now()}) // trims "old"
+
+	mux := http.NewServeMux()
+	registerHistoryAPI(mux, history)
+
+	tests := []struct {
+		query    string
+		wantSeqs []int
+	}{
+		{"", []int{2, 3}},
+		{"?tag_key=status", []int{2}},
+		{"?tag_key=status&tag_value=failed", []int{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, httptest.NewRequest("GET", "/api/history"+tt.query, nil))
+			var messages []wireMessage
+			if err := json.NewDecoder(w.Body).Decode(&messages); err != nil {
+				t.Fatal(err)
+			}
+			if len(messages) != len(tt.wantSeqs) {
+				t.Fatalf("got %d messages, want %d", len(messages), len(tt.wantSeqs))
+			}
+			for i, message := range messages {
+				if message.Seq != tt.wantSeqs[i] {
+					t.Errorf("message %d has seq %d, want %d", i, message.Seq, tt.wantSeqs[i])
+				}
+			}
+		})
+	}
+}
+
+func TestHistoryAPITagValueNeedsKey(t *testing.T) {
+	mux := http.NewServeMux()
+	registerHistoryAPI(mux, newMessageHistory(0))
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/api/history?tag_value=ok", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+// Run with -race: the broadcaster appends while readers take snapshots.
+func TestMessageHistoryConcurrentAccess(t *testing.T) {
+	history := newMessageHistory(time.Minute)
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			history.append(messagePacket{text: "hello", timestamp: time.Now()})
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			for _, packet := range history.snapshot() {
+				_ = packet.text
+			}
+		}
+	}()
+	wg.Wait()
+
+	if n := len(history.snapshot()); n != 1000 {
+		t.Errorf("history has %d messages, want 1000", n)
+	}
+}
+
+func TestMessageHistoryMaxAge(t *testing.T) {
+	history := newMessageHistory(time.Hour)
+	history.append(messagePacket{text: "old", timestamp: time.Now().Add(-2 * time.Hour)})
+	history.append(messagePacket{text: "recent", timestamp: time.Now().Add(-30 * time.Minute)})
+
+	// snapshot leaves out expired messages even before the next append,
+	// so they aren't replayed or exported
+	messages := history.snapshot()
+	if len(messages) != 1 || messages[0].text != "recent" {
+		t.Fatalf("snapshot = %+v, want only the recent message", messages)
+	}
+
+	server, client := net.Pipe()
+	defer client.Close()
+	go func() {
+		defer server.Close()
+		sendExport(server, history.snapshot())
+	}()
+	line, _ := bufio.NewReader(client).ReadString('\n')
+	var data exportData
+	if err := json.Unmarshal([]byte(line), &data); err != nil {
+		t.Fatal(err)
+	}
+	if len(data.Messages) != 1 || data.Messages[0].Text != "recent" {
+		t.Errorf("exported %+v, want only the recent message", data.Messages)
+	}
+}
+
+func TestMessageHistoryNoMaxAge(t *testing.T) {
+	history := newMessageHistory(0)
+	history.append(messagePacket{text: "ancient", timestamp: time.Now().Add(-24 * 365 * time.Hour)})
+	if n := len(history.snapshot()); n != 1 {
+		t.Errorf("history has %d messages, want 1", n)
+	}
+}
+
+// Whatever the ages of the messages added, the history is the newest
+// of them in the order they were added, starting with one that hasn't
+// expired, and ending with the last if it hasn't.
+func TestMessageHistoryProperties(t *testing.T) {
+	const maxAge = 100*time.Minute + 30*time.Second // no message is right on the edge
+	property := func(ages []uint8) bool {
+		history := newMessageHistory(maxAge)
+		now := time.Now()
+		var added []messagePacket
+		for _, age := range ages {
+			packet := history.append(messagePacket{text: "hello", timestamp: now.Add(-time.Duration(age) * time.Minute)})
+			added = append(added, packet)
+		}
+
+		snapshot := history.snapshot()
+		if !slices.EqualFunc(snapshot, added[len(added)-len(snapshot):], func(a, b messagePacket) bool { return a.seq == b.seq }) {
+			return false
+		}
+		if len(snapshot) > 0 && time.Since(snapshot[0].timestamp) > maxAge {
+			return false
+		}
+		if len(ages) > 0 && time.Duration(ages[len(ages)-1])*time.Minute < maxAge {
+			return len(snapshot) > 0 && snapshot[len(snapshot)-1].seq == len(ages)
+		}
+		return true
+	}
+	if err := quick.Check(property, &quick.Config{MaxCount: 10000}); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"io"
+	"net"
+	"time"
+)
+
+// NAT devices and stateful firewalls forget idle TCP sessions after
+// a few minutes, silently breaking chats where nobody has spoken.
+//
+// TCP keepalives are empty probes sent by the kernel once a connection
+// has been idle for the keepalive interval. They keep those mappings
+// alive and let either side notice a dead peer, without anything
+// appearing in the chat stream. An application-level ping, by
+// contrast, is a real message the peer has to read and answer, and
+// it proves the other program is responsive rather than just that
+// its host is reachable.
+
+const defaultKeepAlive = 15 * time.Second
+
+// Enables TCP keepalives on a connection and sets SO_LINGER to 0,
+// so closing it sends RST instead of leaving the socket in
+// TIME_WAIT. A busy server would otherwise run out of ports.
+// An interval of 0 disables keepalives.
+func configureKeepAlive(conn net.Conn, interval time.Duration) {
+	tcpConn, ok := tcpConnOf(conn)
+	if !ok {
+		return
+	}
+	if interval > 0 {
+		tcpConn.SetKeepAlive(true)
+		tcpConn.SetKeepAlivePeriod(interval)
+	} else {
+		tcpConn.SetKeepAlive(false)
+	}
+	tcpConn.SetLinger(0)
+}
+
+// How long closeGracefully waits for the client to hang up.
+const closeGracePeriod = time.Second
+
+// Closes a connection right after the server has told the client
+// why, so that the client gets to read it. With the SO_LINGER 0 of
+// configureKeepAlive, or with unread input left on the socket, the
+// kernel would send a RST that can overtake the error. Instead
+// linger is restored, the write side is shut down so the line goes
+// out followed by a FIN, and input is discarded until the client
+// closes its side or closeGracePeriod has passed.
+func closeGracefully(conn net.Conn) {
+	defer conn.Close()
+	tcpConn, ok := tcpConnOf(conn)
+	if !ok {
+		return
+	}
+	tcpConn.SetLinger(-1)
+	if tcpConn.CloseWrite() != nil {
+		return
+	}
+	tcpConn.SetReadDeadline(time.Now().Add(closeGracePeriod))
+	io.Copy(io.Discard, tcpConn)
+}
+
+// Finds the TCP connection under any wrappers, such as TLS or the
+// per-IP limit, that expose it through NetConn.
+func tcpConnOf(conn net.Conn) (*net.TCPConn, bool) {
+	for {
+		if tcpConn, ok := conn.(*net.TCPConn); ok {
+			return tcpConn, true
+		}
+		wrapped, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			return nil, false
+		}
+		conn = wrapped.NetConn()
+	}
+}
@@ -0,0 +1,82 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Reads the keepalive options of a connection's socket.
+func keepAliveOptions(t *testing.T, conn net.Conn) (keepAlive int, idle int) {
+	t.Helper()
+	tcpConn, ok := tcpConnOf(conn)
+	if !ok {
+		t.Fatal("not a TCP connection")
+	}
+	raw, err := tcpConn.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		if keepAlive, sockErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_KEEPALIVE); sockErr != nil {
+			return
+		}
+		idle, sockErr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE)
+	})
+	if err == nil {
+		err = sockErr
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keepAlive, idle
+}
+
+func TestConfigureKeepAlive(t *testing.T) {
+	tests := []struct {
+		interval      time.Duration
+		wantKeepAlive int
+	}{
+		{15 * time.Second, 1},
+		{0, 0},
+	}
+	for _, tt := range tests {
+		_, server := tcpPair(t)
+		configureKeepAlive(&limitedConn{Conn: server, release: func() {}}, tt.interval)
+
+		keepAlive, idle := keepAliveOptions(t, server)
+		if keepAlive != tt.wantKeepAlive {
+			t.Errorf("interval %v: SO_KEEPALIVE %d, want %d", tt.interval, keepAlive, tt.wantKeepAlive)
+		}
+		if tt.interval > 0 && time.Duration(idle)*time.Second != tt.interval {
+			t.Errorf("interval %v: TCP_KEEPIDLE %ds", tt.interval, idle)
+		}
+	}
+}
+
+// With SO_LINGER 0, closing resets the connection, while closing
+// gracefully lets the client read the last line and then EOF.
+func TestKeepAliveCloseResets(t *testing.T) {
+	client, server := tcpPair(t)
+	configureKeepAlive(server, defaultKeepAlive)
+	server.Close()
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.Read(make([]byte, 1)); !errors.Is(err, syscall.ECONNRESET) {
+		t.Errorf("reading after close: %v, want a reset", err)
+	}
+
+	client, server = tcpPair(t)
+	configureKeepAlive(server, defaultKeepAlive)
+	server.Write([]byte("bye\n"))
+	go closeGracefully(server)
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if got, err := io.ReadAll(client); err != nil || string(got) != "bye\n" {
+		t.Errorf("read %q, %v after closing gracefully, want the line and EOF", got, err)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// Dials a local listener, returning both ends of the connection.
+func tcpPair(t *testing.T) (client net.Conn, server net.Conn) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	client, err = net.Dial("tcp4", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	server, err = ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	return client, server
+}
+
+func TestTCPConnOf(t *testing.T) {
+	_, server := tcpPair(t)
+	wrapped := &limitedConn{Conn: server, release: func() {}}
+	if tcpConn, ok := tcpConnOf(wrapped); !ok || tcpConn != server {
+		t.Error("didn't find the TCP connection under the per-IP limit")
+	}
+
+	pipe, other := net.Pipe()
+	defer pipe.Close()
+	defer other.Close()
+	if _, ok := tcpConnOf(pipe); ok {
+		t.Error("found a TCP connection in a pipe")
+	}
+	// and there's nothing to configure
+	configureKeepAlive(pipe, time.Second)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+// Caps how many connections one IP address can hold open at once,
+// set with --max-connections-per-ip. Connections over the limit are
+// told so and closed by the listener, before they reach a handler.
+// The limit can be changed at runtime through PUT /api/config.
+
+const defaultMaxConnectionsPerIP = 5
+
+var errTooManyConnections = errors.New("too many connections from your IP")
+
+type limitedListener struct {
+	net.Listener
+	perIP   map[string]int
+	live    *liveConfig // holds the limit, 0 for none
+	connLog *connectionLog
+	mu      sync.Mutex
+}
+
+func newLimitedListener(ln net.Listener, live *liveConfig, connLog *connectionLog) *limitedListener {
+	return &limitedListener{Listener: ln, perIP: make(map[string]int), live: live, connLog: connLog}
+}
+
+func (l *limitedListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		ip := remoteIP(conn)
+		if !l.acquire(ip) {
+			l.connLog.record(conn.RemoteAddr(), "", outcomeRejectedThrottled)
+			// off the accept loop, as closing gracefully waits for the client
+			go func() {
+				sendError(conn, errTooManyConnections.Error())
+				closeGracefully(conn)
+			}()
+			continue
+		}
+		return &limitedConn{Conn: conn, release: func() { l.release(ip) }}, nil
+	}
+}
+
+// Counts a new connection from ip, reporting false
+// if it already has as many as it is allowed.
+func (l *limitedListener) acquire(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if limit := l.live.load().maxPerIP; limit > 0 && int64(l.perIP[ip]) >= limit {
+		return false
+	}
+	l.perIP[ip]++
+	return true
+}
+
+func (l *limitedListener) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.perIP[ip]--
+	if l.perIP[ip] <= 0 {
+		delete(l.perIP, ip)
+	}
+}
+
+func remoteIP(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
+
+// A connection counted against its IP's limit until it is closed.
+type limitedConn struct {
+	net.Conn
+	release func()
+	once    sync.Once
+}
+
+func (c *limitedConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
+
+// The underlying connection, so that socket options can be set on it.
+func (c *limitedConn) NetConn() net.Conn {
+	return c.Conn
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Listens on a local port with a per-IP limit, returning the
+// listener and the connections it lets through.
+func newTestLimitedListener(t *testing.T, maxPerIP int) (*limitedListener, <-chan net.Conn) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	connLog, err := newConnectionLog("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	limited := newLimitedListener(ln, newLiveConfig(serverConfig{maxPerIP: maxPerIP}), connLog)
+	t.Cleanup(func() { limited.Close() })
+
+	accepted := make(chan net.Conn, 10)
+	go func() {
+		for {
+			conn, err := limited.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+	return limited, accepted
+}
+
+func dialLimited(t *testing.T, ln net.Listener) net.Conn {
+	conn, err := net.Dial("tcp4", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func waitAccepted(t *testing.T, accepted <-chan net.Conn) net.Conn {
+	t.Helper()
+	select {
+	case conn := <-accepted:
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection wasn't accepted")
+		return nil
+	}
+}
+
+// Expects the listener to turn conn away with an error and close it.
+func expectRefused(t *testing.T, conn net.Conn) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatalf("reading the refusal: %v", err)
+	}
+	if want := `{"type":"error","text":"` + errTooManyConnections.Error() + `"}`; strings.TrimSpace(line) != want {
+		t.Errorf("got %q, want %q", line, want)
+	}
+	if _, err := reader.ReadString('\n'); err == nil {
+		t.Error("connection left open after the refusal")
+	}
+}
+
+func TestLimitedListener(t *testing.T) {
+	ln, accepted := newTestLimitedListener(t, 5)
+
+	var conns []net.Conn
+	for i := 0; i < 5; i++ {
+		dialLimited(t, ln)
+		conns = append(conns, waitAccepted(t, accepted))
+	}
+	expectRefused(t, dialLimited(t, ln))
+
+	// closing one makes room for another, once
+	conns[0].Close()
+	conns[0].Close()
+	dialLimited(t, ln)
+	waitAccepted(t, accepted)
+	expectRefused(t, dialLimited(t, ln))
+}
+
+// The limit can be raised, or removed with 0, while running.
+func TestLimitedListenerLiveLimit(t *testing.T) {
+	ln, accepted := newTestLimitedListener(t, 1)
+	dialLimited(t, ln)
+	waitAccepted(t, accepted)
+	expectRefused(t, dialLimited(t, ln))
+
+	ln.live.update(func(settings *liveSettings) { settings.maxPerIP = 0 })
+	for i := 0; i < 3; i++ {
+		dialLimited(t, ln)
+		waitAccepted(t, accepted)
+	}
+
+	ln.live.update(func(settings *liveSettings) { settings.maxPerIP = 4 })
+	expectRefused(t, dialLimited(t, ln))
+}
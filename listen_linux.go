@@ -0,0 +1,52 @@
+//go:build linux
+
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// Returns a net.ListenConfig control function that sizes the receive
+// buffer of the listening socket, which accepted connections inherit.
+// It runs before listen(2), while the TCP window scale can still be
+// negotiated from the buffer size. 0 keeps the kernel's default.
+func listenControl(rcvbuf int) func(network, address string, c syscall.RawConn) error {
+	if rcvbuf <= 0 {
+		return nil
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF, rcvbuf)
+		})
+		if err != nil {
+			return err
+		}
+		return sockErr
+	}
+}
+
+// Sets the length of the queue of connections waiting to be accepted.
+// Go always listens with net.core.somaxconn, so the socket is listened
+// on again with the new length, which Linux allows on a socket that is
+// already listening. The kernel still caps it at net.core.somaxconn.
+// 0 keeps Go's default.
+func setListenBacklog(ln net.Listener, backlog int) error {
+	tcpListener, ok := ln.(*net.TCPListener)
+	if backlog <= 0 || !ok {
+		return nil
+	}
+	raw, err := tcpListener.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var listenErr error
+	err = raw.Control(func(fd uintptr) {
+		listenErr = syscall.Listen(int(fd), backlog)
+	})
+	if err != nil {
+		return err
+	}
+	return listenErr
+}
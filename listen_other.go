@@ -0,0 +1,26 @@
+//go:build !linux
+
+package main
+
+import (
+	"log"
+	"net"
+	"syscall"
+)
+
+// Tuning the listening socket is only supported on Linux; elsewhere
+// --listen-backlog and --listen-rcvbuf are ignored with a warning and
+// the socket keeps the operating system's defaults.
+func listenControl(rcvbuf int) func(network, address string, c syscall.RawConn) error {
+	if rcvbuf > 0 {
+		log.Print("Warning: -listen-rcvbuf is only supported on Linux")
+	}
+	return nil
+}
+
+func setListenBacklog(ln net.Listener, backlog int) error {
+	if backlog > 0 {
+		log.Print("Warning: -listen-backlog is only supported on Linux")
+	}
+	return nil
+}
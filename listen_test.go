@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Collects what is logged while a test runs.
+type logCapture struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (c *logCapture) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.buf.Write(b)
+}
+
+func (c *logCapture) String() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.buf.String()
+}
+
+func captureLog(t *testing.T) *logCapture {
+	capture := &logCapture{}
+	out := log.Writer()
+	log.SetOutput(capture)
+	t.Cleanup(func() { log.SetOutput(out) })
+	return capture
+}
+
+// Holds a local port, returning it.
+func occupyPort(t *testing.T) (net.Listener, int) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	return ln, ln.Addr().(*net.TCPAddr).Port
+}
+
+func TestListenWithRetryGivesUp(t *testing.T) {
+	_, port := occupyPort(t)
+	logged := captureLog(t)
+
+	ln, err := listenWithRetry("127.0.0.1", port, 0, 0, 0, 2, 10*time.Millisecond)
+	if err == nil {
+		ln.Close()
+		t.Fatal("listened on a port in use")
+	}
+	if !errors.Is(err, syscall.EADDRINUSE) {
+		t.Errorf("error %v, want EADDRINUSE", err)
+	}
+	if n := strings.Count(logged.String(), "Port in use, retrying in 10ms..."); n != 2 {
+		t.Errorf("logged %d retries, want 2:\n%s", n, logged)
+	}
+}
+
+func TestListenWithRetryOnceFree(t *testing.T) {
+	held, port := occupyPort(t)
+	captureLog(t)
+	time.AfterFunc(50*time.Millisecond, func() { held.Close() })
+
+	ln, err := listenWithRetry("127.0.0.1", port, 0, 0, 0, 100, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.Close()
+}
+
+// Only a port in use is worth waiting for.
+func TestListenWithRetryOtherErrors(t *testing.T) {
+	logged := captureLog(t)
+
+	if _, err := listenWithRetry("no.such.host.invalid", 8011, 0, 0, 0, 3, 10*time.Millisecond); err == nil {
+		t.Fatal("listened on a host that doesn't exist")
+	}
+	if strings.Contains(logged.String(), "retrying") {
+		t.Errorf("retried an error other than the port being in use:\n%s", logged)
+	}
+}
+
+// One of this machine's addresses other than loopback, if it has one.
+func externalIP(t *testing.T) net.IP {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() != nil && !ipNet.IP.IsLoopback() {
+			return ipNet.IP
+		}
+	}
+	t.Skip("no non-loopback IPv4 address")
+	return nil
+}
+
+// Bound to 127.0.0.1, the server can't be reached on the machine's
+// other addresses; bound to 0.0.0.0, it can.
+func TestListenAddr(t *testing.T) {
+	external := externalIP(t)
+	tests := []struct {
+		listenAddr  string
+		wantRefused bool
+	}{
+		{"127.0.0.1", true},
+		{"0.0.0.0", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.listenAddr, func(t *testing.T) {
+			ln, err := listen(tt.listenAddr, 0, 0, 0, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+			port := ln.Addr().(*net.TCPAddr).Port
+
+			conn, err := net.DialTimeout("tcp", net.JoinHostPort(external.String(), strconv.Itoa(port)), integrationTimeout)
+			if err == nil {
+				conn.Close()
+			}
+			if refused := err != nil; refused != tt.wantRefused {
+				t.Errorf("connecting to %s: %v, want refused %v", external, err, tt.wantRefused)
+			}
+		})
+	}
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// HTTP long-polling transport, for networks where only plain
+// HTTP gets through. Clients join to get a client_id and then
+// use two endpoints:
+//
+//	POST /lp/join
+//	     Body {"username":"alice"} starts a session and returns
+//	     {"client_id":"<id>","wire_format":"json"}; see codec.go for
+//	     the other formats a client may ask for. Joining goes through the same checks
+//	     as a TCP handshake: IP reputation, the per-IP limit and
+//	     username validation, and is recorded in the connection log.
+//	     While the server is draining, joins and sends get 503.
+//	POST /lp/send?client_id=<id>
+//	     Body {"text":"hello"} is broadcast like a message from a
+//	     TCP client, sent by the session's user. An optional
+//	     "content_type" declares structured content, such as
+//	     application/json, which must then be valid. Messages over
+//	     the rate limit are dropped with 429, and while the message
+//	     queue is full, with 503.
+//	GET /lp/recv?client_id=<id>&since=<seq>
+//	     Blocks until messages newer than seq arrive, or
+//	     returns an empty array after lpPollTimeout.
+//
+// Each client gets a buffered channel that the broadcaster
+// fills, so messages sent between two polls are not missed.
+
+const (
+	lpPollTimeout = 30 * time.Second
+	lpIdleTimeout = 2 * time.Minute // clients that stop polling are dropped
+	lpQueueSize   = 256
+)
+
+// Wire form of a chat message. Seq numbers messages in the
+// order they were broadcast, as in messageHistory.
+type wireMessage struct {
+	Seq         int               `json:"seq,omitempty"`
+	Sender      string            `json:"sender"`
+	Text        string            `json:"text"`
+	ContentType string            `json:"content_type,omitempty"` // see contentTypes; empty for text/plain
+	Tags        map[string]string `json:"tags,omitempty"`         // from #key=value words in the text
+}
+
+type lpClient struct {
+	username string
+	ip       string // counted against --max-connections-per-ip
+	format   wireFormat
+	messages chan wireMessage
+	lastSeen time.Time
+
+	mu      sync.Mutex // held to check the limiter, as sends can overlap
+	limiter *slidingWindowLimiter
+}
+
+// Reports whether the client may send another message under the live
+// rate limit, counting it if so.
+func (c *lpClient) allowSend(live *liveConfig) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.limiter = liveLimiter(c.limiter, live)
+	return c.limiter == nil || c.limiter.Allow()
+}
+
+var errLPUnknownClient = errors.New("unknown client_id, POST /lp/join first")
+
+// The set of long-polling clients, keyed by client_id.
+type lpHub struct {
+	mu      sync.Mutex
+	clients map[string]*lpClient
+	offered wireFormat // to clients that list it in their features, besides JSON
+}
+
+func newLPHub(offered wireFormat) *lpHub {
+	return &lpHub{clients: make(map[string]*lpClient), offered: offered}
+}
+
+// Starts a session for username from ip, returning its client_id.
+// The name must not be in use by another session, and ip may hold
+// at most maxPerIP sessions at once, 0 for no limit. The session
+// uses the offered wire format if its features include it.
+func (h *lpHub) join(username string, ip string, features []string, maxPerIP int64) (string, wireFormat, error) {
+	suffix := make([]byte, 16)
+	rand.Read(suffix)
+	id := hex.EncodeToString(suffix)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.expire()
+
+	fromIP := int64(0)
+	for _, c := range h.clients {
+		if c.username == username {
+			return "", wireFormat{}, ErrUsernameTaken
+		}
+		if c.ip == ip {
+			fromIP++
+		}
+	}
+	if maxPerIP > 0 && fromIP >= maxPerIP {
+		return "", wireFormat{}, errTooManyConnections
+	}
+	format := jsonWireFormat
+	if slices.Contains(features, h.offered.name) {
+		format = h.offered
+	}
+	h.clients[id] = &lpClient{
+		username: username,
+		ip:       ip,
+		format:   format,
+		messages: make(chan wireMessage, lpQueueSize),
+		lastSeen: time.Now(),
+	}
+	return id, format, nil
+}
+
+// Returns the session for a client_id, marking it as still in use.
+func (h *lpHub) client(id string) (*lpClient, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	c, ok := h.clients[id]
+	if ok {
+		c.lastSeen = time.Now()
+	}
+	return c, ok
+}
+
+// Drops the clients that have stopped polling. Called with h.mu held.
+func (h *lpHub) expire() {
+	for id, c := range h.clients {
+		if time.Since(c.lastSeen) > lpIdleTimeout {
+			delete(h.clients, id)
+		}
+	}
+}
+
+// Queues a broadcast for every client except its sender,
+// returning how many it was queued for. Called from
+// serverBroadCast, so it must never block.
+func (h *lpHub) publish(packet messagePacket) (queued int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	message := wireMessage{Seq: packet.seq, Sender: packet.sender, Text: packet.text, ContentType: packet.contentType, Tags: packet.tags}
+	h.expire()
+	for id, c := range h.clients {
+		if packet.source == lpSource(id) {
+			continue
+		}
+		select {
+		case c.messages <- message:
+			queued++
+		default:
+			// queue full; the client has fallen too far behind
+		}
+	}
+	return queued
+}
+
+// The packet source used for messages sent by a long-poll client.
+func lpSource(id string) string {
+	return "lp:" + id
+}
+
+// The address of an HTTP client, in the form the connection log
+// and IP reputation expect.
+func httpRemoteAddr(r *http.Request) *net.TCPAddr {
+	addrPort, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return &net.TCPAddr{}
+	}
+	return net.TCPAddrFromAddrPort(addrPort)
+}
+
+func (h *lpHub) handler(bus *MessageBus, pool *safePool, live *liveConfig, connLog *connectionLog, reputation *ipReputation,
+	metrics *serverMetrics, draining *atomic.Bool) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("POST /lp/join", func(w http.ResponseWriter, r *http.Request) {
+		if draining.Load() {
+			http.Error(w, drainingText, http.StatusServiceUnavailable)
+			return
+		}
+		var request struct {
+			Username string   `json:"username"`
+			Features []string `json:"features"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		addr := httpRemoteAddr(r)
+
+		if reputation.lookup(addr) == reputationMalicious {
+			log.Print("Rejected long-poll client from malicious network: ", addr)
+			connLog.record(addr, request.Username, outcomeRejectedReputation)
+			http.Error(w, "connection refused", http.StatusForbidden)
+			return
+		}
+		if err := validateUsername(request.Username, pool); err != nil {
+			connLog.record(addr, request.Username, outcomeRejectedAuth)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		id, format, err := h.join(request.Username, addr.IP.String(), request.Features, live.load().maxPerIP)
+		if errors.Is(err, errTooManyConnections) {
+			connLog.record(addr, request.Username, outcomeRejectedThrottled)
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			return
+		} else if err != nil {
+			connLog.record(addr, request.Username, outcomeRejectedAuth)
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		connLog.record(addr, request.Username, outcomeAccepted)
+		log.Print("New long-poll client ", request.Username)
+		writeJSON(w, http.StatusOK, map[string]string{"client_id": id, "wire_format": format.name})
+	})
+
+	mux.HandleFunc("POST /lp/send", func(w http.ResponseWriter, r *http.Request) {
+		if draining.Load() {
+			http.Error(w, drainingText, http.StatusServiceUnavailable)
+			return
+		}
+		id := r.URL.Query().Get("client_id")
+		c, ok := h.client(id)
+		if !ok {
+			http.Error(w, errLPUnknownClient.Error(), http.StatusNotFound)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "invalid message: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		var message wireMessage
+		if err := c.format.codec.Unmarshal(body, &message); err != nil {
+			http.Error(w, "invalid message: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if message.Text == "" {
+			http.Error(w, "text is required", http.StatusBadRequest)
+			return
+		}
+		if message.Sender != "" && message.Sender != c.username {
+			http.Error(w, "sender does not match the client_id's user", http.StatusForbidden)
+			return
+		}
+		if err := validateMessage(message.Text, DefaultRules); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := validateContent(message.ContentType, message.Text); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !c.allowSend(live) {
+			http.Error(w, rateLimitedText, http.StatusTooManyRequests)
+			return
+		}
+
+		packet := messagePacket{
+			text:        message.Text,
+			source:      lpSource(id),
+			sender:      c.username,
+			contentType: message.ContentType,
+		}
+		// as for TCP clients, drop the message rather than
+		// hold the request while the broadcaster catches up
+		if !bus.tryPublish(packet) {
+			metrics.queueOverflow.Add(1)
+			http.Error(w, serverBusyText, http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("GET /lp/recv", func(w http.ResponseWriter, r *http.Request) {
+		id := r.URL.Query().Get("client_id")
+		since, _ := strconv.Atoi(r.URL.Query().Get("since"))
+		c, ok := h.client(id)
+		if !ok {
+			http.Error(w, errLPUnknownClient.Error(), http.StatusNotFound)
+			return
+		}
+
+		messages := []wireMessage{}
+		timeout := time.NewTimer(lpPollTimeout)
+		defer timeout.Stop()
+
+		// wait for the first message, then take whatever else is
+		// queued, skipping any the client says it already has
+		for len(messages) == 0 {
+			select {
+			case message := <-c.messages:
+				if message.Seq > since {
+					messages = append(messages, message)
+				}
+			case <-timeout.C:
+				writeMessages(w, c.format, messages)
+				return
+			case <-r.Context().Done():
+				return
+			}
+		}
+		for more := true; more; {
+			select {
+			case message := <-c.messages:
+				if message.Seq > since {
+					messages = append(messages, message)
+				}
+			default:
+				more = false
+			}
+		}
+		writeMessages(w, c.format, messages)
+	})
+
+	return mux
+}
+
+// Writes a /lp/recv response in the session's wire format.
+func writeMessages(w http.ResponseWriter, format wireFormat, messages []wireMessage) {
+	body, err := format.codec.Marshal(messages)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", format.contentType)
+	w.Write(body)
+}
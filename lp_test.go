@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// A long-poll server and the state its handler shares with the rest
+// of the server.
+type lpTestServer struct {
+	*httptest.Server
+	hub      *lpHub
+	bus      *MessageBus
+	metrics  *serverMetrics
+	draining atomic.Bool
+}
+
+func newTestLPServer(t *testing.T, config serverConfig) *lpTestServer {
+	t.Helper()
+	format, err := parseWireFormat(cmp.Or(config.wireFormat, "json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &lpTestServer{hub: newLPHub(format), bus: newMessageBus(16), metrics: &serverMetrics{}}
+	connLog, err := newConnectionLog("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Server = httptest.NewServer(s.hub.handler(s.bus, newSafePool(), newLiveConfig(config), connLog, nil, s.metrics, &s.draining))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func lpJoin(t *testing.T, server *lpTestServer, username string) (string, int) {
+	t.Helper()
+	resp, err := http.Post(server.URL+"/lp/join", "application/json", strings.NewReader(`{"username":"`+username+`"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var body struct {
+		ClientID string `json:"client_id"`
+	}
+	json.NewDecoder(resp.Body).Decode(&body)
+	return body.ClientID, resp.StatusCode
+}
+
+// Sends body as id's message, returning the response's status.
+func lpSend(t *testing.T, server *lpTestServer, id string, body string) int {
+	t.Helper()
+	resp, err := http.Post(server.URL+"/lp/send?client_id="+id, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestLPJoin(t *testing.T) {
+	server := newTestLPServer(t, serverConfig{maxPerIP: 2})
+
+	if id, status := lpJoin(t, server, "alice"); status != http.StatusOK || id == "" {
+		t.Fatalf("join alice: status %d, client_id %q", status, id)
+	}
+	if _, status := lpJoin(t, server, "alice"); status != http.StatusConflict {
+		t.Errorf("joining with a taken name: status %d, want %d", status, http.StatusConflict)
+	}
+	if _, status := lpJoin(t, server, "bad name"); status != http.StatusBadRequest {
+		t.Errorf("joining with an invalid name: status %d, want %d", status, http.StatusBadRequest)
+	}
+	if _, status := lpJoin(t, server, "bob"); status != http.StatusOK {
+		t.Errorf("join bob: status %d", status)
+	}
+	if _, status := lpJoin(t, server, "carol"); status != http.StatusTooManyRequests {
+		t.Errorf("joining over the per-IP limit: status %d, want %d", status, http.StatusTooManyRequests)
+	}
+}
+
+func TestLPSendUsesSessionSender(t *testing.T) {
+	server := newTestLPServer(t, serverConfig{})
+	messages := server.bus.subscribe()
+	id, _ := lpJoin(t, server, "alice")
+
+	tests := []struct {
+		name   string
+		id     string
+		body   string
+		status int
+	}{
+		{"unknown client", "nope", `{"text":"hi"}`, http.StatusNotFound},
+		{"spoofed sender", id, `{"sender":"bob","text":"hi"}`, http.StatusForbidden},
+		{"no text", id, `{}`, http.StatusBadRequest},
+		{"sender from session", id, `{"text":"hi"}`, http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if status := lpSend(t, server, tt.id, tt.body); status != tt.status {
+				t.Errorf("status %d, want %d", status, tt.status)
+			}
+		})
+	}
+
+	packet := <-messages
+	if packet.sender != "alice" || packet.text != "hi" {
+		t.Errorf("published %q from %q, want %q from %q", packet.text, packet.sender, "hi", "alice")
+	}
+}
+
+func TestLPRecvSkipsSeenMessages(t *testing.T) {
+	server := newTestLPServer(t, serverConfig{})
+	id, _ := lpJoin(t, server, "alice")
+
+	for seq := 1; seq <= 5; seq++ {
+		server.hub.publish(messagePacket{sender: "bob", text: "message", source: "lp:other", seq: seq})
+	}
+
+	resp, err := http.Get(server.URL + "/lp/recv?client_id=" + id + "&since=3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var messages []wireMessage
+	if err := json.NewDecoder(resp.Body).Decode(&messages); err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 2 || messages[0].Seq != 4 || messages[1].Seq != 5 {
+		t.Errorf("got %+v, want seqs 4 and 5", messages)
+	}
+}
+
+// With the queue full, a message is dropped with 503 rather than the
+// request waiting for room.
+func TestLPSendQueueFull(t *testing.T) {
+	server := newTestLPServer(t, serverConfig{})
+	server.bus.subscribe() // never read, so the queue backs up
+	id, _ := lpJoin(t, server, "alice")
+
+	busy := 0
+	for i := 0; i < 200 && busy == 0; i++ {
+		switch status := lpSend(t, server, id, `{"text":"hello"}`); status {
+		case http.StatusNoContent:
+		case http.StatusServiceUnavailable:
+			busy++
+		default:
+			t.Fatalf("status %d", status)
+		}
+	}
+	if busy == 0 {
+		t.Fatal("no message was dropped")
+	}
+	if n := server.metrics.queueOverflow.Load(); n != 1 {
+		t.Errorf("counted %d overflows, want 1", n)
+	}
+}
+
+// The rate limit applies to long-poll sessions as it does to TCP
+// clients, and to each session separately.
+func TestLPSendRateLimit(t *testing.T) {
+	server := newTestLPServer(t, serverConfig{rateLimit: 3, rateWindow: time.Minute})
+	alice, _ := lpJoin(t, server, "alice")
+	bob, _ := lpJoin(t, server, "bob")
+
+	for i := 0; i < 3; i++ {
+		if status := lpSend(t, server, alice, `{"text":"hello"}`); status != http.StatusNoContent {
+			t.Fatalf("message %d: status %d", i+1, status)
+		}
+	}
+	if status := lpSend(t, server, alice, `{"text":"hello"}`); status != http.StatusTooManyRequests {
+		t.Errorf("message over the limit: status %d, want %d", status, http.StatusTooManyRequests)
+	}
+	if status := lpSend(t, server, bob, `{"text":"hello"}`); status != http.StatusNoContent {
+		t.Errorf("another session's message: status %d", status)
+	}
+}
+
+// While draining, long-poll clients can neither join nor send.
+func TestLPDraining(t *testing.T) {
+	server := newTestLPServer(t, serverConfig{})
+	messages := server.bus.subscribe()
+	id, _ := lpJoin(t, server, "alice")
+
+	server.draining.Store(true)
+	if status := lpSend(t, server, id, `{"text":"hello"}`); status != http.StatusServiceUnavailable {
+		t.Errorf("sending while draining: status %d, want %d", status, http.StatusServiceUnavailable)
+	}
+	if _, status := lpJoin(t, server, "bob"); status != http.StatusServiceUnavailable {
+		t.Errorf("joining while draining: status %d, want %d", status, http.StatusServiceUnavailable)
+	}
+	select {
+	case packet := <-messages:
+		t.Errorf("%q was published", packet.text)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+// A client that lists gob in its features sends and receives gob;
+// one that doesn't stays on JSON.
+func TestLPGobWireFormat(t *testing.T) {
+	server := newTestLPServer(t, serverConfig{wireFormat: "gob"})
+	messages := server.bus.subscribe()
+
+	join := func(body string) (id, format string) {
+		resp, err := http.Post(server.URL+"/lp/join", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var joined struct {
+			ClientID   string `json:"client_id"`
+			WireFormat string `json:"wire_format"`
+		}
+		json.NewDecoder(resp.Body).Decode(&joined)
+		return joined.ClientID, joined.WireFormat
+	}
+	if _, format := join(`{"username":"bob"}`); format != "json" {
+		t.Errorf("joined without features in %q, want json", format)
+	}
+	id, format := join(`{"username":"alice","features":["gob"]}`)
+	if format != "gob" {
+		t.Fatalf("joined listing gob in %q, want gob", format)
+	}
+
+	if status := lpSend(t, server, id, `{"text":"hi"}`); status != http.StatusBadRequest {
+		t.Errorf("sending JSON to a gob session: status %d, want %d", status, http.StatusBadRequest)
+	}
+	body, err := GobCodec{}.Marshal(wireMessage{Text: "hi"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := lpSend(t, server, id, string(body)); status != http.StatusNoContent {
+		t.Errorf("sending gob: status %d, want %d", status, http.StatusNoContent)
+	}
+	if packet := <-messages; packet.sender != "alice" || packet.text != "hi" {
+		t.Errorf("published %q from %q, want %q from %q", packet.text, packet.sender, "hi", "alice")
+	}
+
+	server.hub.publish(messagePacket{sender: "bob", text: "hello #build=42", source: "lp:other", seq: 1, tags: map[string]string{"build": "42"}})
+	resp, err := http.Get(server.URL + "/lp/recv?client_id=" + id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if got := resp.Header.Get("Content-Type"); got != "application/x-gob" {
+		t.Errorf("Content-Type %q, want application/x-gob", got)
+	}
+	var buf bytes.Buffer
+	buf.ReadFrom(resp.Body)
+	var received []wireMessage
+	if err := (GobCodec{}).Unmarshal(buf.Bytes(), &received); err != nil {
+		t.Fatal(err)
+	}
+	if len(received) != 1 || received[0].Sender != "bob" || received[0].Tags["build"] != "42" {
+		t.Errorf("received %+v", received)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import "strings"
+
+// A small Markdown renderer for the client's terminal, enabled with
+// --markdown. It understands **bold**, *italic*, `code` and
+// "# Heading" lines, and passes everything else through untouched.
+
+const (
+	ansiReset   = "\033[0m"
+	ansiBold    = "\033[1m"
+	ansiItalic  = "\033[3m"
+	ansiCode    = "\033[33;40m" // yellow on a dark background
+	ansiHeading = "\033[1;4m"   // bright and underlined
+)
+
+// Renders the message text of a BROADCAST line, leaving the
+// sender and any other kind of line alone.
+func renderMessageMarkdown(line string) string {
+	prefix, text, ok := strings.Cut(line, ": ")
+	if !ok || !strings.HasPrefix(prefix, "BROADCAST ") {
+		return line
+	}
+	return prefix + ": " + markdownToANSI(text)
+}
+
+func markdownToANSI(text string) string {
+	if heading, ok := strings.CutPrefix(text, "# "); ok {
+		return ansiHeading + markdownSpans(heading, ansiHeading) + ansiReset
+	}
+	return markdownSpans(text, "")
+}
+
+// Converts inline spans. A marker only opens a span if a matching
+// marker follows it, so stray asterisks and backticks are printed
+// as typed. base is the style to return to when spans close.
+func markdownSpans(text string, base string) string {
+	var out strings.Builder
+	var bold, italic bool
+
+	// re-establish the styles still open after one changes
+	restyle := func() {
+		out.WriteString(ansiReset + base)
+		if bold {
+			out.WriteString(ansiBold)
+		}
+		if italic {
+			out.WriteString(ansiItalic)
+		}
+	}
+
+	for i := 0; i < len(text); {
+		rest := text[i:]
+		switch {
+		case rest[0] == '`':
+			// code spans are literal, so markers inside them are ignored
+			if end := strings.IndexByte(rest[1:], '`'); end >= 0 {
+				out.WriteString(ansiCode + rest[1:1+end])
+				restyle()
+				i += end + 2
+				continue
+			}
+		case strings.HasPrefix(rest, "**"):
+			if bold || strings.Contains(rest[2:], "**") {
+				bold = !bold
+				restyle()
+				i += 2
+				continue
+			}
+		case rest[0] == '*':
+			if italic || strings.Contains(rest[1:], "*") {
+				italic = !italic
+				restyle()
+				i++
+				continue
+			}
+		}
+		out.WriteByte(text[i])
+		i++
+	}
+
+	if bold || italic {
+		// don't let a badly nested span leak into the next line
+		out.WriteString(ansiReset + base)
+	}
+	return out.String()
+}
@@ -0,0 +1,59 @@
+package main
+
+import "testing"
+
+func TestMarkdownToANSI(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{"plain", "just text", "just text"},
+		{"bold", "a **b** c", "a " + ansiReset + ansiBold + "b" + ansiReset + " c"},
+		{"italic", "a *b* c", "a " + ansiReset + ansiItalic + "b" + ansiReset + " c"},
+		{"code", "run `go test`", "run " + ansiCode + "go test" + ansiReset},
+		{"code is literal", "`**not bold**`", ansiCode + "**not bold**" + ansiReset},
+		{"heading", "# Title", ansiHeading + "Title" + ansiReset},
+		{"bold in a heading", "# a **b**", ansiHeading + "a " + ansiReset + ansiHeading + ansiBold + "b" + ansiReset + ansiHeading + ansiReset},
+		{"italic inside bold", "**a *b* c**",
+			ansiReset + ansiBold + "a " + ansiReset + ansiBold + ansiItalic + "b" + ansiReset + ansiBold + " c" + ansiReset},
+		{"unclosed bold", "2 ** 3", "2 ** 3"},
+		{"unclosed italic", "5 * 3 = 15", "5 * 3 = 15"},
+		{"unclosed code", "it's `here", "it's `here"},
+		{"heading needs a space", "#hashtag", "#hashtag"},
+		{"badly nested", "**a *b** c*",
+			ansiReset + ansiBold + "a " + ansiReset + ansiBold + ansiItalic + "b" + ansiReset + ansiItalic + " c" + ansiReset},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := markdownToANSI(tt.text); got != tt.want {
+				t.Errorf("markdownToANSI(%q) = %q, want %q", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+// Text without Markdown comes through unchanged, however often it's rendered.
+func TestMarkdownToANSIPlainTextUnchanged(t *testing.T) {
+	for _, text := range []string{"", "hello", "a < b && c > d", "email me at a_b@example.com", "50% off"} {
+		if got := markdownToANSI(markdownToANSI(text)); got != text {
+			t.Errorf("markdownToANSI(%q) = %q", text, got)
+		}
+	}
+}
+
+func TestRenderMessageMarkdown(t *testing.T) {
+	tests := []struct {
+		line string
+		want string
+	}{
+		{"BROADCAST alice: **hi**", "BROADCAST alice: " + ansiReset + ansiBold + "hi" + ansiReset},
+		{"BROADCAST **alice**: hi", "BROADCAST **alice**: hi"},
+		{"[12:00] alice: **hi**", "[12:00] alice: **hi**"},
+	}
+	for _, tt := range tests {
+		if got := renderMessageMarkdown(tt.line); got != tt.want {
+			t.Errorf("renderMessageMarkdown(%q) = %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+// Server-wide counters, exported on the admin API at GET /metrics
+// in the Prometheus text exposition format.
+type serverMetrics struct {
+	queueOverflow atomic.Uint64 // messages dropped because the queue was full
+	messages      atomic.Uint64 // messages broadcast
+	messageBytes  atomic.Uint64 // total size of the messages' text
+	slowConsumers atomic.Uint64 // users with many lines waiting to be written, as of the last check
+	listeners     atomic.Int64  // ports accepting clients, plain and TLS
+}
+
+// Registers GET /metrics, reading the queue from bus and the messages
+// integrations missed from processed, the broadcaster's output.
+func (m *serverMetrics) register(mux *http.ServeMux, bus *MessageBus, processed *MessageBus) {
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetric(w, "chat_queue_depth", "gauge", "Messages waiting to be broadcast.",
+			uint64(bus.pending()))
+		writeMetric(w, "chat_queue_overflow_total", "counter", "Messages dropped because the queue was full.",
+			m.queueOverflow.Load())
+		writeMetric(w, "chat_messages_total", "counter", "Messages broadcast.",
+			m.messages.Load())
+		writeMetric(w, "chat_bus_dropped_total", "counter", "Messages integrations such as Slack fell too far behind to get.",
+			processed.dropped.Load())
+		writeMetric(w, "chat_slow_consumers", "gauge", "Users with many lines waiting to be written to them.",
+			m.slowConsumers.Load())
+		writeMetric(w, "chat_listeners", "gauge", "Ports accepting clients.",
+			uint64(m.listeners.Load()))
+	})
+}
+
+func writeMetric(w http.ResponseWriter, name string, kind string, help string, value uint64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, help, name, kind, name, value)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+// A Middleware can inspect and rewrite each message after it is
+// received and before it is added to the history and broadcast.
+// Middleware runs in order on the broadcaster's goroutine, so
+// Process should be quick.
+type Middleware interface {
+	Process(packet *messagePacket)
+}
+
+// Expands emoji shortcodes such as :thumbsup: into the emoji
+// itself. Shortcodes not in the table are left as typed.
+type EmojiMiddleware struct {
+	codes    map[string]string
+	replacer *strings.Replacer
+}
+
+// Loads the shortcode table from a JSON object such as
+// {":thumbsup:": "👍"}. See emoji_codes.json for a sample.
+func newEmojiMiddleware(path string) (*EmojiMiddleware, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var codes map[string]string
+	if err := json.Unmarshal(data, &codes); err != nil {
+		return nil, err
+	}
+
+	pairs := make([]string, 0, 2*len(codes))
+	for code, emoji := range codes {
+		pairs = append(pairs, code, emoji)
+	}
+	return &EmojiMiddleware{codes: codes, replacer: strings.NewReplacer(pairs...)}, nil
+}
+
+func (e *EmojiMiddleware) Process(packet *messagePacket) {
+	packet.text = e.replacer.Replace(packet.text)
+}
+
+// Labels each message with a "sentiment" tag of positive, negative or
+// neutral, for moderation tools reading the tags. Words are counted
+// against two lexicons, positive_words.txt and negative_words.txt, of
+// one word per line; see the sentiment directory for samples. Whichever
+// kind of word appears more often decides the label.
+type SentimentPlugin struct {
+	positive map[string]bool
+	negative map[string]bool
+}
+
+// Loads the two lexicons from dir.
+func newSentimentPlugin(dir string) (*SentimentPlugin, error) {
+	positive, err := loadWordList(filepath.Join(dir, "positive_words.txt"))
+	if err != nil {
+		return nil, err
+	}
+	negative, err := loadWordList(filepath.Join(dir, "negative_words.txt"))
+	if err != nil {
+		return nil, err
+	}
+	return &SentimentPlugin{positive: positive, negative: negative}, nil
+}
+
+// Reads a file of words, one per line, skipping blank
+// lines and comments starting with #.
+func loadWordList(path string) (map[string]bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	words := make(map[string]bool)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		word := strings.ToLower(strings.TrimSpace(scanner.Text()))
+		if word != "" && !strings.HasPrefix(word, "#") {
+			words[word] = true
+		}
+	}
+	return words, scanner.Err()
+}
+
+func (s *SentimentPlugin) Process(packet *messagePacket) {
+	score := 0
+	words := strings.FieldsFunc(strings.ToLower(packet.text), func(r rune) bool {
+		return !unicode.IsLetter(r) && r != '\''
+	})
+	for _, word := range words {
+		if s.positive[word] {
+			score++
+		} else if s.negative[word] {
+			score--
+		}
+	}
+
+	sentiment := "neutral"
+	if score > 0 {
+		sentiment = "positive"
+	} else if score < 0 {
+		sentiment = "negative"
+	}
+	if packet.tags == nil {
+		packet.tags = make(map[string]string)
+	}
+	packet.tags["sentiment"] = sentiment
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEmojiMiddleware(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "emoji.json")
+	if err := os.WriteFile(path, []byte(`{":smile:": "😊", ":thumbsup:": "👍", ":+1:": "👍"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	emoji, err := newEmojiMiddleware(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"hello :smile:", "hello 😊"},
+		{":thumbsup::smile:", "👍😊"},
+		{"ok :+1: :+1:", "ok 👍 👍"},
+		{"not a code :shrug: or smile:", "not a code :shrug: or smile:"},
+		{"no codes at all", "no codes at all"},
+	}
+	for _, tt := range tests {
+		packet := messagePacket{text: tt.text}
+		emoji.Process(&packet)
+		if packet.text != tt.want {
+			t.Errorf("Process(%q) = %q, want %q", tt.text, packet.text, tt.want)
+		}
+	}
+}
+
+// The sample table shipped with the server loads.
+func TestEmojiMiddlewareSample(t *testing.T) {
+	emoji, err := newEmojiMiddleware("emoji_codes.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(emoji.codes) < 40 {
+		t.Errorf("sample has %d shortcodes", len(emoji.codes))
+	}
+	packet := messagePacket{text: ":smile:"}
+	emoji.Process(&packet)
+	if packet.text != "😊" {
+		t.Errorf(":smile: became %q", packet.text)
+	}
+}
+
+func TestEmojiMiddlewareBadFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "emoji.json")
+	if err := os.WriteFile(path, []byte(`[":smile:"]`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newEmojiMiddleware(path); err == nil {
+		t.Error("loaded a table that isn't a JSON object")
+	}
+	if _, err := newEmojiMiddleware(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("loaded a file that doesn't exist")
+	}
+}
+
+func TestSentimentPlugin(t *testing.T) {
+	sentiment, err := newSentimentPlugin("sentiment")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"I love this", "positive"},
+		{"LOVE it, great work!", "positive"},
+		{"I hate this, it's terrible", "negative"},
+		{"the build is done", "neutral"},
+		{"I love it but the docs are awful", "neutral"},
+		{"great, great, awful", "positive"},
+		{"", "neutral"},
+	}
+	for _, tt := range tests {
+		packet := messagePacket{text: tt.text}
+		sentiment.Process(&packet)
+		if got := packet.tags["sentiment"]; got != tt.want {
+			t.Errorf("Process(%q) tagged %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+// The sentiment is added to the tags the sender gave.
+func TestSentimentPluginKeepsTags(t *testing.T) {
+	sentiment, err := newSentimentPlugin("sentiment")
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet := messagePacket{text: "Build done, great", tags: map[string]string{"status": "ok"}}
+	sentiment.Process(&packet)
+	if packet.tags["status"] != "ok" || packet.tags["sentiment"] != "positive" {
+		t.Errorf("tags = %v, want status ok and sentiment positive", packet.tags)
+	}
+}
+
+func TestSentimentPluginMissingLexicon(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "positive_words.txt"), []byte("love\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newSentimentPlugin(dir); err == nil {
+		t.Error("loaded without negative_words.txt")
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Experimental UDP multicast transport for trusted LANs. With
+//
+//	chat server -transport multicast -multicast-group 239.0.0.1 -multicast-port 8012
+//
+// clients still connect over TCP for the handshake, history, presence
+// and sending, but broadcasts reach clients that support it as one
+// multicast datagram rather than a copy per connection. Clients list
+// "multicast" in their hello, and the server answers with
+//
+//	{"type":"command","action":"join_multicast","payload":"239.0.0.1:8012"}
+//
+// Once a client has joined the group it confirms with
+//
+//	{"type":"multicast_joined"}
+//
+// and only then does the server stop writing broadcasts to it over
+// TCP, so nothing is lost if the join fails or is slow. Each
+// datagram carries the sender's connection address, so that clients
+// can skip their own messages. Messages too large for one datagram go
+// over TCP as usual. UDP is unreliable, so messages can be lost.
+
+const multicastMaxPacket = 1400 // fits a typical Ethernet MTU
+
+type multicastPacket struct {
+	Source string `json:"source"`
+	Line   string `json:"line"`
+}
+
+type multicastJoinedPacket struct {
+	Type string `json:"type"`
+}
+
+// Reports whether a client's hello says it can receive multicast.
+func supportsMulticast(hello helloPacket) bool {
+	return slices.Contains(hello.SupportedFeatures, "multicast")
+}
+
+func multicastAddr(config serverConfig) string {
+	return net.JoinHostPort(config.multicastGroup, strconv.Itoa(config.multicastPort))
+}
+
+type multicastSender struct {
+	conn *net.UDPConn
+}
+
+func newMulticastSender(group string) (*multicastSender, error) {
+	addr, err := net.ResolveUDPAddr("udp4", group)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialUDP("udp4", nil, addr)
+	if err != nil {
+		return nil, err
+	}
+	return &multicastSender{conn: conn}, nil
+}
+
+// Multicasts a formatted broadcast line, returning false if it was too
+// large or couldn't be sent, so the caller should send it over TCP.
+func (m *multicastSender) send(source string, line string) bool {
+	datagram, err := json.Marshal(multicastPacket{Source: source, Line: line})
+	if err != nil || len(datagram) > multicastMaxPacket {
+		return false
+	}
+	if _, err := m.conn.Write(datagram); err != nil {
+		log.Print("Multicast: ", err)
+		return false
+	}
+	return true
+}
+
+// The client's side: joins the group the first time the server asks,
+// and prints the broadcasts that arrive, other than the client's own.
+type multicastReceiver struct {
+	mu     sync.Mutex
+	joined bool
+	local  string // this client's address as the server sees it
+}
+
+// Joins group, if not already joined. local is the address of the
+// client's current connection; after a redirect it is updated.
+func (m *multicastReceiver) join(group string, local string, config clientConfig, highlights *highlighter) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.local = local
+	if m.joined {
+		return nil
+	}
+
+	addr, err := net.ResolveUDPAddr("udp4", group)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenMulticastUDP("udp4", nil, addr)
+	if err != nil {
+		return err
+	}
+	m.joined = true
+	go m.receive(conn, config, highlights)
+	return nil
+}
+
+// Tells the server the client has joined the group, so it can stop
+// sending broadcasts over TCP.
+func confirmMulticastJoin(out *outbox) error {
+	line, err := json.Marshal(multicastJoinedPacket{Type: "multicast_joined"})
+	if err != nil {
+		return err
+	}
+	return out.send(string(line))
+}
+
+func (m *multicastReceiver) receive(conn *net.UDPConn, config clientConfig, highlights *highlighter) {
+	buffer := make([]byte, multicastMaxPacket)
+	for {
+		size, _, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			log.Print("Multicast: ", err)
+			return
+		}
+		var packet multicastPacket
+		if err := json.Unmarshal(buffer[:size], &packet); err != nil {
+			continue
+		}
+
+		m.mu.Lock()
+		own := packet.Source == m.local
+		m.mu.Unlock()
+		if !own {
+			printBroadcast(strings.TrimSpace(packet.Line), config, highlights)
+		}
+	}
+}
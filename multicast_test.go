@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Listens where the server multicasts to. Loopback interfaces can't
+// usually carry multicast, so the "group" is a unicast address on
+// 127.0.0.1, which the server sends to in just the same way.
+func listenMulticastGroup(t *testing.T) (*net.UDPConn, serverConfig) {
+	group, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { group.Close() })
+	addr := group.LocalAddr().(*net.UDPAddr)
+	return group, serverConfig{transport: "multicast", multicastGroup: "127.0.0.1", multicastPort: addr.Port}
+}
+
+func nextDatagram(t *testing.T, group *net.UDPConn) multicastPacket {
+	t.Helper()
+	group.SetReadDeadline(time.Now().Add(integrationTimeout))
+	buffer := make([]byte, multicastMaxPacket)
+	size, _, err := group.ReadFromUDP(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var packet multicastPacket
+	if err := json.Unmarshal(buffer[:size], &packet); err != nil {
+		t.Fatal(err)
+	}
+	return packet
+}
+
+// Broadcasts go over TCP until the client confirms it has joined the
+// group, and after that as datagrams only.
+func TestIntegration_Multicast(t *testing.T) {
+	group, config := listenMulticastGroup(t)
+	sender, err := newMulticastSender(multicastAddr(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := startTestServerWith(t, config, sender)
+	clientConfig := clientConfig{endpoint: s.addr()}
+
+	alice := connectTestClient(t, clientConfig, "alice")
+	alice.waitFor(t, `{"type":"command","action":"join_multicast","payload":"127.0.0.1:`+strconv.Itoa(config.multicastPort)+`"}`)
+	bob := dialTestClient(t, clientConfig, "bob")
+
+	bob.send(t, "before joining")
+	alice.waitFor(t, "BROADCAST bob: before joining")
+	packet := nextDatagram(t, group)
+	if want := bob.conn.LocalAddr().String(); packet.Source != want {
+		t.Errorf("datagram source %q, want bob's address %q", packet.Source, want)
+	}
+	if line := strings.TrimSpace(packet.Line); line != "BROADCAST bob: before joining" {
+		t.Errorf("datagram line %q", line)
+	}
+
+	alice.send(t, `{"type":"multicast_joined"}`)
+	for {
+		_, u, ok := s.pool.lookup("alice")
+		if ok && u.multicast.Load() {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	bob.send(t, "after joining")
+	if line := strings.TrimSpace(nextDatagram(t, group).Line); line != "BROADCAST bob: after joining" {
+		t.Errorf("datagram line %q", line)
+	}
+	// with alice back on TCP, the next broadcast she reads should be
+	// bob's next message, not the one she was sent as a datagram
+	_, u, _ := s.pool.lookup("alice")
+	u.multicast.Store(false)
+	bob.send(t, "over TCP again")
+	for line := range alice.lines {
+		if strings.HasPrefix(line, "BROADCAST") {
+			if line != "BROADCAST bob: over TCP again" {
+				t.Errorf("alice got %q over TCP after joining", line)
+			}
+			return
+		}
+	}
+	t.Fatal("alice's connection closed")
+}
+
+// Messages too large for one datagram are left to TCP.
+func TestMulticastMaxPacket(t *testing.T) {
+	group, config := listenMulticastGroup(t)
+	sender, err := newMulticastSender(multicastAddr(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sender.send("127.0.0.1:5000", strings.Repeat("x", multicastMaxPacket)+"\n") {
+		t.Error("oversized message reported as multicast")
+	}
+	if !sender.send("127.0.0.1:5000", "BROADCAST alice: hi\n") {
+		t.Fatal("message not multicast")
+	}
+	if packet := nextDatagram(t, group); packet.Source != "127.0.0.1:5000" {
+		t.Errorf("datagram source %q", packet.Source)
+	}
+}
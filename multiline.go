@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"text/template"
+)
+
+// Multi-line messages, for sharing code and other preformatted
+// text. In the client, a line consisting of <<< starts a block and
+// a line consisting of >>> ends it; the lines in between are sent
+// as a single message.
+//
+// Ordinary messages are broadcast as one line, "BROADCAST sender:
+// text" unless --message-format says otherwise. A message containing
+// newlines would be indistinguishable from several lines, so it is
+// instead sent as a JSON line:
+//
+//	{"type":"multiline","sender":"alice","text":"line1\nline2"}
+//
+// which the client draws as a box:
+//
+//	┌─ alice ───
+//	│ line1
+//	│ line2
+//	└──────────
+
+const (
+	multilineStart = "<<<"
+	multilineEnd   = ">>>"
+)
+
+type multilinePacket struct {
+	Type   string `json:"type"` // always "multiline"
+	Sender string `json:"sender"`
+	Text   string `json:"text"`
+}
+
+// Formats a message as the line broadcast to clients, using
+// format for messages that fit on one line.
+func formatBroadcast(format *template.Template, packet messagePacket) string {
+	if !strings.Contains(packet.text, "\n") {
+		// the format was checked at startup, so this doesn't fail
+		var line strings.Builder
+		format.Execute(&line, messageFields{Sender: packet.sender, Text: packet.text, Timestamp: packet.timestamp})
+		return line.String() + "\n"
+	}
+
+	line, _ := json.Marshal(multilinePacket{Type: "multiline", Sender: packet.sender, Text: packet.text})
+	return string(line) + "\n"
+}
+
+func renderMultiline(message multilinePacket) string {
+	var out strings.Builder
+	out.WriteString("┌─ " + message.Sender + " ───\n")
+	for _, line := range strings.Split(message.Text, "\n") {
+		out.WriteString("│ " + line + "\n")
+	}
+	out.WriteString("└──────────\n")
+	return out.String()
+}
+
+// Reads lines from the terminal up to the closing >>>, keeping
+// their indentation, and joins them into one message.
+func readMultiline() string {
+	var lines []string
+	for {
+		line, err := stdin.ReadString('\n')
+		line = strings.TrimRight(line, "\r\n")
+		if line == multilineEnd || err != nil {
+			break
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// Reads the lines up to >>> as one message, leaving the rest.
+func TestReadMultiline(t *testing.T) {
+	saved := stdin
+	t.Cleanup(func() { stdin = saved })
+	stdin = bufio.NewReader(strings.NewReader("func main() {\r\n\tfmt.Println(\"hi\")\n}\n>>>\nafter\n"))
+
+	if got, want := readMultiline(), "func main() {\n\tfmt.Println(\"hi\")\n}"; got != want {
+		t.Errorf("read %q, want %q", got, want)
+	}
+	if rest, _ := stdin.ReadString('\n'); rest != "after\n" {
+		t.Errorf("left %q, want the line after >>>", rest)
+	}
+}
+
+func TestRenderMultiline(t *testing.T) {
+	got := renderMultiline(multilinePacket{Sender: "alice", Text: "line1\nline2"})
+	if want := "┌─ alice ───\n│ line1\n│ line2\n└──────────\n"; got != want {
+		t.Errorf("rendered %q, want %q", got, want)
+	}
+}
+
+// A three-line message reaches others as one multiline packet.
+func TestIntegration_Multiline(t *testing.T) {
+	s := startTestServer(t)
+	config := clientConfig{endpoint: s.addr()}
+	alice := dialTestClient(t, config, "alice")
+	bob := dialTestClient(t, config, "bob")
+	alice.waitFor(t, strings.TrimSpace(formatPresence("join", "bob")))
+
+	alice.send(t, "line1\nline2\nline3")
+	for line := range bob.lines {
+		packetType, raw := decodePacket(line)
+		if packetType == "" {
+			t.Fatalf("bob got %q, want one multiline message", line)
+		}
+		if packetType != "multiline" {
+			continue
+		}
+		var message multilinePacket
+		json.Unmarshal(raw, &message)
+		if message.Sender != "alice" || message.Text != "line1\nline2\nline3" {
+			t.Errorf("bob got %+v", message)
+		}
+		return
+	}
+	t.Fatal("bob's connection closed")
+}
+
+// The client draws multiline packets as boxes and prints other
+// broadcasts as they are, both highlighted.
+func TestPrintBroadcast(t *testing.T) {
+	highlights := &highlighter{}
+	captureStdout(t, func() { highlights.command("add line2") })
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"BROADCAST alice: hi", "BROADCAST alice: hi\n"},
+		{`{"type":"multiline","sender":"alice","text":"line1\nline2"}`,
+			"┌─ alice ───\n│ line1\n│ " + ansiHighlight + "line2" + ansiReset + "\n└──────────\n"},
+	}
+	for _, tt := range tests {
+		if got := captureStdout(t, func() { printBroadcast(tt.text, clientConfig{}, highlights) }); got != tt.want {
+			t.Errorf("printed %q, want %q", got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// The client's side of the connection for sending. While the client
+// is reconnecting, after a redirect, messages the user types are held
+// in the outbox instead of being written to the old connection, then
+// sent in order once the new connection is up.
+
+const (
+	offlineBufferSize = 100
+
+	// The server treats each read as one message, so flushed
+	// messages are spaced out to keep them from running together.
+	offlineFlushGap = 50 * time.Millisecond
+)
+
+type outbox struct {
+	mu           sync.Mutex
+	conn         net.Conn
+	reconnecting bool
+	pending      []string
+}
+
+func newOutbox(conn net.Conn) *outbox {
+	return &outbox{conn: conn}
+}
+
+// Sends a message, or holds it if the client is reconnecting.
+func (o *outbox) send(text string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.reconnecting {
+		if len(o.pending) == offlineBufferSize {
+			fmt.Println("[offline buffer full, message dropped]")
+			return nil
+		}
+		o.pending = append(o.pending, text)
+		return nil
+	}
+	_, err := o.conn.Write([]byte(text))
+	return err
+}
+
+// Starts holding messages, ahead of a reconnect.
+func (o *outbox) disconnect() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.reconnecting = true
+}
+
+// Switches to a new connection, closing the old one, and
+// sends the messages held while reconnecting.
+func (o *outbox) reconnect(conn net.Conn) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.conn.Close()
+	o.conn = conn
+	o.reconnecting = false
+
+	pending := o.pending
+	o.pending = nil
+	for i, text := range pending {
+		if i > 0 {
+			time.Sleep(offlineFlushGap)
+		}
+		if _, err := conn.Write([]byte(text)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (o *outbox) close() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.conn.Close()
+}
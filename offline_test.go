@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+)
+
+// Messages sent while reconnecting are held, then sent in order on
+// the new connection, each as a write of its own.
+func TestOutboxHoldsWhileReconnecting(t *testing.T) {
+	old := newMockConn("10.0.0.1:8011")
+	out := newOutbox(old)
+	if err := out.send("before"); err != nil {
+		t.Fatal(err)
+	}
+
+	out.disconnect()
+	var want []string
+	for i := 1; i <= 5; i++ {
+		text := fmt.Sprint("message ", i)
+		want = append(want, text)
+		if err := out.send(text); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := old.written(); got != "before" {
+		t.Errorf("the old connection was written %q, want only what was sent before disconnecting", got)
+	}
+
+	server, client := net.Pipe()
+	defer server.Close()
+	reconnected := make(chan error, 1)
+	go func() { reconnected <- out.reconnect(client) }()
+
+	buffer := make([]byte, maxMessageSize)
+	for _, text := range want {
+		size, err := server.Read(buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(buffer[:size]); got != text {
+			t.Errorf("read %q, want %q", got, text)
+		}
+	}
+	if err := <-reconnected; err != nil {
+		t.Fatal(err)
+	}
+	if !old.isClosed() {
+		t.Error("the old connection wasn't closed")
+	}
+
+	// and new messages go straight out
+	go out.send("after")
+	size, err := server.Read(buffer)
+	if err != nil || string(buffer[:size]) != "after" {
+		t.Errorf("read %q, %v, want %q", buffer[:size], err, "after")
+	}
+}
+
+// Once offlineBufferSize messages are held, more are dropped and the
+// user told.
+func TestOutboxFull(t *testing.T) {
+	out := newOutbox(newMockConn("10.0.0.1:8011"))
+	out.disconnect()
+	for i := 0; i < offlineBufferSize; i++ {
+		out.send(fmt.Sprint("message ", i))
+	}
+
+	printed := captureStdout(t, func() {
+		if err := out.send("one too many"); err != nil {
+			t.Error(err)
+		}
+	})
+	if printed != "[offline buffer full, message dropped]\n" {
+		t.Errorf("printed %q", printed)
+	}
+	if n := len(out.pending); n != offlineBufferSize || out.pending[n-1] != fmt.Sprint("message ", offlineBufferSize-1) {
+		t.Errorf("holding %d messages, ending %q", n, out.pending[n-1])
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// Control packets. Besides chat lines, server and client exchange
+// single-line JSON objects whose "type" field says what they are,
+// such as
+//
+//	{"type":"presence","event":"join","username":"alice"}
+//
+// The receiver decodes a line's type with decodePacket, then the
+// whole line into the struct for that type. Lines that aren't JSON
+// objects with a type are chat text.
+
+type packetHeader struct {
+	Type string `json:"type"`
+}
+
+// Returns the type of a control packet and the packet itself, to be
+// decoded into the struct for its type. For any other line the type
+// is empty.
+func decodePacket(line string) (packetType string, raw json.RawMessage) {
+	if !strings.HasPrefix(line, "{") {
+		return "", nil
+	}
+	var header packetHeader
+	if err := json.Unmarshal([]byte(line), &header); err != nil {
+		return "", nil
+	}
+	return header.Type, json.RawMessage(line)
+}
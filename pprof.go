@@ -0,0 +1,98 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"path/filepath"
+	"runtime"
+	runtimepprof "runtime/pprof"
+	"sync/atomic"
+	"time"
+)
+
+// Live profiling on the admin API, with --enable-pprof. Besides the
+// standard net/http/pprof handlers under /debug/pprof/, two endpoints
+// write profiles to timestamped files in --pprof-dir, for when the
+// profile is wanted on the server rather than in the response:
+//
+//	GET  /debug/heap-snapshot                          a heap profile, after a GC
+//	POST /debug/set-cpu-profile-duration?duration=30s  a CPU profile, in the background
+//
+// Both answer with the name of the file written. Like the rest of the
+// admin API these have no authentication, and profiles show a lot about
+// the server, so keep the admin address private.
+
+const pprofTimeLayout = "20060102-150405"
+
+// Set while /debug/set-cpu-profile-duration is writing a profile.
+var cpuProfiling atomic.Bool
+
+func registerPprof(mux *http.ServeMux, dir string) {
+	mux.HandleFunc("GET /debug/pprof/", pprof.Index)
+	mux.HandleFunc("GET /debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("GET /debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("GET /debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("POST /debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("GET /debug/pprof/trace", pprof.Trace)
+
+	mux.HandleFunc("GET /debug/heap-snapshot", func(w http.ResponseWriter, r *http.Request) {
+		path := filepath.Join(dir, "heap-"+time.Now().Format(pprofTimeLayout)+".pprof")
+		file, err := os.Create(path)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer file.Close()
+
+		// so the profile shows what is live, not what is waiting to be freed
+		runtime.GC()
+		if err := runtimepprof.WriteHeapProfile(file); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"file": path})
+	})
+
+	mux.HandleFunc("POST /debug/set-cpu-profile-duration", func(w http.ResponseWriter, r *http.Request) {
+		duration, err := time.ParseDuration(r.URL.Query().Get("duration"))
+		if err != nil || duration <= 0 {
+			http.Error(w, "duration must be a positive duration, such as 30s", http.StatusBadRequest)
+			return
+		}
+
+		// checked before creating the file, which a second
+		// profile started in the same second would overwrite
+		if !cpuProfiling.CompareAndSwap(false, true) {
+			http.Error(w, "a CPU profile is already being written", http.StatusConflict)
+			return
+		}
+		path := filepath.Join(dir, "cpu-"+time.Now().Format(pprofTimeLayout)+".pprof")
+		file, err := os.Create(path)
+		if err != nil {
+			cpuProfiling.Store(false)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// fails if /debug/pprof/profile is running
+		if err := runtimepprof.StartCPUProfile(file); err != nil {
+			cpuProfiling.Store(false)
+			file.Close()
+			os.Remove(path)
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+
+		time.AfterFunc(duration, func() {
+			runtimepprof.StopCPUProfile()
+			cpuProfiling.Store(false)
+			if err := file.Close(); err != nil {
+				log.Print("Writing CPU profile: ", err)
+				return
+			}
+			log.Print("Wrote CPU profile to ", path)
+		})
+		writeJSON(w, http.StatusAccepted, map[string]string{"file": path})
+	})
+}
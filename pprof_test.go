@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestPprofMux(t *testing.T) (*http.ServeMux, string) {
+	dir := t.TempDir()
+	mux := http.NewServeMux()
+	registerPprof(mux, dir)
+	return mux, dir
+}
+
+func TestPprofGoroutine(t *testing.T) {
+	mux, _ := newTestPprofMux(t)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/debug/pprof/goroutine", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("status %d, want %d", w.Code, http.StatusOK)
+	}
+	if got := w.Header().Get("Content-Type"); got != "application/octet-stream" {
+		t.Errorf("Content-Type %q, want application/octet-stream", got)
+	}
+}
+
+// Decodes the name of the profile written, which should be in dir.
+func profileFile(t *testing.T, w *httptest.ResponseRecorder, dir string) string {
+	t.Helper()
+	var body struct {
+		File string `json:"file"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Dir(body.File) != dir {
+		t.Errorf("profile written to %q, want it in %q", body.File, dir)
+	}
+	return body.File
+}
+
+func TestPprofHeapSnapshot(t *testing.T) {
+	mux, dir := newTestPprofMux(t)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/debug/heap-snapshot", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	if info, err := os.Stat(profileFile(t, w, dir)); err != nil || info.Size() == 0 {
+		t.Errorf("heap profile not written: %v", err)
+	}
+}
+
+func TestPprofCPUProfile(t *testing.T) {
+	mux, dir := newTestPprofMux(t)
+	for _, duration := range []string{"", "soon", "-1s"} {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("POST", "/debug/set-cpu-profile-duration?duration="+duration, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("duration %q: status %d, want %d", duration, w.Code, http.StatusBadRequest)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("POST", "/debug/set-cpu-profile-duration?duration=100ms", nil))
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	path := profileFile(t, w, dir)
+
+	// one at a time
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("POST", "/debug/set-cpu-profile-duration?duration=100ms", nil))
+	if w.Code != http.StatusConflict {
+		t.Errorf("second profile: status %d, want %d", w.Code, http.StatusConflict)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for cpuProfiling.Load() {
+		if time.Now().After(deadline) {
+			t.Fatal("the CPU profile didn't finish")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if info, err := os.Stat(path); err != nil || info.Size() == 0 {
+		t.Errorf("CPU profile not written: %v", err)
+	}
+}
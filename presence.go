@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"slices"
+	"sync"
+)
+
+// Presence events, so clients know who is connected without asking.
+// When a user connects or disconnects, everyone else is sent
+//
+//	{"type":"presence","event":"join","username":"alice"}
+//	{"type":"presence","event":"leave","username":"alice"}
+//
+// and a newly connected client is sent a join for each user already
+// there, itself included. The client keeps the list up to date from
+// these events and shows it when the user types /users.
+
+const usersCommand = "/users"
+
+type presencePacket struct {
+	Type     string `json:"type"`  // always "presence"
+	Event    string `json:"event"` // "join" or "leave"
+	Username string `json:"username"`
+}
+
+func formatPresence(event string, username string) string {
+	line, _ := json.Marshal(presencePacket{Type: "presence", Event: event, Username: username})
+	return string(line) + "\n"
+}
+
+// Tells every connected user except the one at source that
+// username has joined or left.
+func broadcastPresence(pool *safePool, source string, event string, username string) {
+	line := []byte(formatPresence(event, username))
+	for _, u := range pool.snapshot() {
+		if u.connection.RemoteAddr().String() != source {
+			u.connection.Write(line)
+		}
+	}
+}
+
+// Sends a new connection a join event for every connected user.
+func sendPresenceList(conn net.Conn, pool *safePool) {
+	for _, u := range pool.snapshot() {
+		conn.Write([]byte(formatPresence("join", u.username)))
+	}
+}
+
+// The client's view of who is connected, updated by the receiving
+// goroutine and read when the user types /users.
+type presentUsers struct {
+	mu    sync.Mutex
+	users map[string]struct{}
+}
+
+func newPresentUsers() *presentUsers {
+	return &presentUsers{users: make(map[string]struct{})}
+}
+
+func (p *presentUsers) apply(event presencePacket) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch event.Event {
+	case "join":
+		p.users[event.Username] = struct{}{}
+	case "leave":
+		delete(p.users, event.Username)
+	}
+}
+
+// Forgets everyone, for when the client moves to another server.
+func (p *presentUsers) reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	clear(p.users)
+}
+
+// The connected users' names in alphabetical order.
+func (p *presentUsers) names() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	names := make([]string, 0, len(p.users))
+	for name := range p.users {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Applies a presence line as the client does.
+func applyPresenceLine(t *testing.T, present *presentUsers, line string) {
+	t.Helper()
+	packetType, raw := decodePacket(strings.TrimSpace(line))
+	if packetType != "presence" {
+		t.Fatalf("%q isn't a presence packet", line)
+	}
+	var event presencePacket
+	if err := json.Unmarshal(raw, &event); err != nil {
+		t.Fatal(err)
+	}
+	present.apply(event)
+}
+
+func TestPresentUsers(t *testing.T) {
+	present := newPresentUsers()
+	for _, line := range []string{
+		formatPresence("join", "carol"),
+		formatPresence("join", "alice"),
+		formatPresence("join", "bob"),
+		formatPresence("leave", "bob"),
+		formatPresence("leave", "dave"), // never joined
+	} {
+		applyPresenceLine(t, present, line)
+	}
+	if got := present.names(); !slices.Equal(got, []string{"alice", "carol"}) {
+		t.Errorf("names() = %v, want [alice carol]", got)
+	}
+
+	present.reset()
+	if got := present.names(); len(got) != 0 {
+		t.Errorf("names() = %v after reset, want none", got)
+	}
+}
+
+// A client's list follows others joining and leaving the server.
+func TestPresenceFromServer(t *testing.T) {
+	s := startTestServer(t)
+	config := clientConfig{endpoint: s.addr()}
+	alice := dialTestClient(t, config, "alice")
+	bob := dialTestClient(t, config, "bob")
+	dialTestClient(t, config, "carol")
+	bob.conn.Close()
+
+	present := newPresentUsers()
+	applyPresenceLine(t, present, formatPresence("join", "alice")) // read by dialTestClient
+	timeout := time.After(integrationTimeout)
+	for !slices.Equal(present.names(), []string{"alice", "carol"}) {
+		select {
+		case line := <-alice.lines:
+			applyPresenceLine(t, present, line)
+		case <-timeout:
+			t.Fatalf("alice sees %v, want [alice carol]", present.names())
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"container/ring"
+	"time"
+)
+
+// Per-connection rate limiting. With --rate-limit N, each client,
+// whether a TCP connection or a long-poll session, may send at most N
+// messages in any --rate-window, counted over a sliding window so
+// that, unlike a token bucket, no burst can go over N. Messages over
+// the limit are dropped and the client told so. Both can be changed
+// at runtime through PUT /api/config, which applies to each client
+// from its next message, starting a fresh window.
+
+// The error sent to a client whose message was over the limit.
+const rateLimitedText = "rate limit exceeded, message dropped"
+
+const (
+	defaultRateWindow = 10 * time.Second
+	maxRateLimit      = 10000 // each allowed message takes a ring element per connection
+)
+
+// Remembers when the last limit messages were allowed, in a ring
+// whose current element is the oldest of them.
+type slidingWindowLimiter struct {
+	limit  int
+	window time.Duration
+	times  *ring.Ring
+}
+
+func newSlidingWindowLimiter(limit int, window time.Duration) *slidingWindowLimiter {
+	return &slidingWindowLimiter{limit: limit, window: window, times: ring.New(limit)}
+}
+
+// Returns a limiter for the live rate limit, reusing current if the
+// settings haven't changed since it was made, or nil for no limit.
+func liveLimiter(current *slidingWindowLimiter, live *liveConfig) *slidingWindowLimiter {
+	settings := live.load()
+	limit, window := settings.rateLimit, settings.rateWindow
+	if limit <= 0 {
+		return nil
+	}
+	if current != nil && current.limit == limit && current.window == window {
+		return current
+	}
+	return newSlidingWindowLimiter(limit, window)
+}
+
+// Reports whether another message may be sent now, counting it if so.
+func (l *slidingWindowLimiter) Allow() bool {
+	now := time.Now()
+	// with limit messages already in the window, the oldest of them
+	// has to have left it before there's room for another
+	if oldest, ok := l.times.Value.(time.Time); ok && now.Sub(oldest) < l.window {
+		return false
+	}
+	l.times.Value = now
+	l.times = l.times.Next()
+	return true
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+	"testing/quick"
+	"time"
+)
+
+// However many messages are sent within the window, exactly the first
+// limit of them are allowed.
+func TestSlidingWindowLimiterAllowsLimit(t *testing.T) {
+	property := func(limit uint8, sent uint16) bool {
+		l := newSlidingWindowLimiter(int(limit)+1, time.Hour)
+		allowed := 0
+		for i := 0; i < int(sent%1000); i++ {
+			if l.Allow() {
+				if allowed != i {
+					return false // refused one, then allowed a later one
+				}
+				allowed++
+			}
+		}
+		return allowed == min(int(limit)+1, int(sent%1000))
+	}
+	if err := quick.Check(property, &quick.Config{MaxCount: 10000}); err != nil {
+		t.Error(err)
+	}
+}
+
+// Once the window has passed, the limit is available again.
+func TestSlidingWindowLimiterWindowPasses(t *testing.T) {
+	const window = 20 * time.Millisecond
+	l := newSlidingWindowLimiter(3, window)
+	for i := 0; i < 3; i++ {
+		if !l.Allow() {
+			t.Fatalf("message %d refused", i)
+		}
+	}
+	if l.Allow() {
+		t.Fatal("allowed a fourth message within the window")
+	}
+	time.Sleep(window)
+	for i := 0; i < 3; i++ {
+		if !l.Allow() {
+			t.Fatalf("message %d refused after the window passed", i)
+		}
+	}
+}
+
+// Allow is called for every message, so should stay well under 500ns.
+func BenchmarkSlidingWindowLimiterAllow(b *testing.B) {
+	b.Run("allowed", func(b *testing.B) {
+		// each message has left the window by the time of the next
+		l := newSlidingWindowLimiter(maxRateLimit, time.Nanosecond)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			l.Allow()
+		}
+	})
+	b.Run("refused", func(b *testing.B) {
+		l := newSlidingWindowLimiter(10, time.Hour)
+		for l.Allow() {
+		}
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			l.Allow()
+		}
+	})
+}
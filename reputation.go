@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// IP reputation. --ip-reputation-file names a JSON file mapping
+// networks to what is known about them:
+//
+//	{"1.2.3.0/24": "malicious", "5.6.7.0/24": "proxy"}
+//
+// Connections from a "malicious" network are refused before the
+// handshake. Any other label, such as "proxy", is logged and kept as
+// a flag on the user, shown by GET /api/users. Where networks overlap
+// the most specific one counts. The file is read at startup and again
+// on SIGHUP.
+
+const reputationMalicious = "malicious"
+
+type reputationEntry struct {
+	network netip.Prefix
+	label   string
+}
+
+type ipReputation struct {
+	mu      sync.RWMutex
+	entries []reputationEntry
+	path    string
+}
+
+// Loads the reputation file, or returns nil if path is empty.
+func loadReputation(path string) (*ipReputation, error) {
+	if path == "" {
+		return nil, nil
+	}
+	r := &ipReputation{path: path}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reads the file again, keeping the old data if it can't be read.
+func (r *ipReputation) reload() error {
+	data, err := os.ReadFile(r.path)
+	if err != nil {
+		return err
+	}
+	var labels map[string]string
+	if err := json.Unmarshal(data, &labels); err != nil {
+		return err
+	}
+
+	entries := make([]reputationEntry, 0, len(labels))
+	for cidr, label := range labels {
+		network, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, reputationEntry{network: network.Masked(), label: label})
+	}
+
+	r.mu.Lock()
+	r.entries = entries
+	r.mu.Unlock()
+	return nil
+}
+
+// Returns the label of the most specific network addr is in,
+// or "" if it is in none of them or there is no reputation data.
+func (r *ipReputation) lookup(addr net.Addr) string {
+	if r == nil {
+		return ""
+	}
+	addrPort, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return ""
+	}
+	ip := addrPort.Addr().Unmap()
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	label, bits := "", -1
+	for _, entry := range r.entries {
+		if entry.network.Bits() > bits && entry.network.Contains(ip) {
+			label, bits = entry.label, entry.network.Bits()
+		}
+	}
+	return label
+}
+
+// Reloads the reputation file on SIGHUP, forever.
+func (r *ipReputation) watchReload() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		if err := r.reload(); err != nil {
+			log.Print("Reloading IP reputation: ", err)
+			continue
+		}
+		log.Print("Reloaded IP reputation from ", r.path)
+	}
+}
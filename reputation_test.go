@@ -0,0 +1,139 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// Lists 1.2.3.0/24 as malicious and 5.6.7.0/24 as a proxy.
+const testReputationFile = "testdata/reputation.json"
+
+func writeReputationFile(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "reputation.json")
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReputationLookup(t *testing.T) {
+	path := writeReputationFile(t, `{
+		"1.2.3.0/24": "malicious",
+		"5.6.0.0/16": "proxy",
+		"5.6.7.0/24": "malicious",
+		"5.6.7.8/32": "tor",
+		"2001:db8::/32": "proxy"
+	}`)
+	r, err := loadReputation(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		addr string
+		want string
+	}{
+		{"1.2.3.4:5000", "malicious"},
+		{"1.2.4.4:5000", ""},
+		{"5.6.1.1:5000", "proxy"},
+		{"5.6.7.1:5000", "malicious"}, // the /24 within the /16
+		{"5.6.7.8:5000", "tor"},
+		{"[::ffff:1.2.3.4]:5000", "malicious"},
+		{"[2001:db8::1]:5000", "proxy"},
+		{"[2001:db9::1]:5000", ""},
+	}
+	for _, tt := range tests {
+		addr, err := net.ResolveTCPAddr("tcp", tt.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := r.lookup(addr); got != tt.want {
+			t.Errorf("lookup(%s) = %q, want %q", tt.addr, got, tt.want)
+		}
+	}
+
+	var none *ipReputation
+	if got := none.lookup(&net.TCPAddr{IP: net.IPv4(1, 2, 3, 4)}); got != "" {
+		t.Errorf("lookup with no reputation file = %q", got)
+	}
+}
+
+func TestReputationReload(t *testing.T) {
+	path := writeReputationFile(t, `{"1.2.3.0/24": "malicious"}`)
+	r, err := loadReputation(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := &net.TCPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 5000}
+
+	os.WriteFile(path, []byte(`{"1.2.3.0/24": "proxy"}`), 0600)
+	if err := r.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got := r.lookup(addr); got != "proxy" {
+		t.Errorf("after reloading, lookup = %q, want proxy", got)
+	}
+
+	// a bad file leaves the last good data in place
+	for _, contents := range []string{`{"1.2.3.0/33": "malicious"}`, `not json`} {
+		os.WriteFile(path, []byte(contents), 0600)
+		if err := r.reload(); err == nil {
+			t.Errorf("reloaded %s", contents)
+		}
+		if got := r.lookup(addr); got != "proxy" {
+			t.Errorf("after a failed reload, lookup = %q, want proxy", got)
+		}
+	}
+
+	if _, err := loadReputation(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("loaded a file that doesn't exist")
+	}
+}
+
+func TestHandleConnectionReputation(t *testing.T) {
+	reputation, err := loadReputation(testReputationFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("malicious", func(t *testing.T) {
+		c := newConnectionTest()
+		c.reputation = reputation
+		conn := newMockConn("1.2.3.4:5000", "alice\n", "hello\n")
+
+		c.handle(t, conn)
+
+		if got := conn.written(); got != `{"type":"error","text":"connection refused"}`+"\n" {
+			t.Errorf("got %q, want only a refusal", got)
+		}
+		if _, joined := c.audit.events("alice"); joined {
+			t.Error("alice was let in")
+		}
+	})
+
+	t.Run("proxy", func(t *testing.T) {
+		c := newConnectionTest()
+		c.reputation = reputation
+		conn := newMockConn("5.6.7.8:5000", "alice\n")
+		var flags []string
+		conn.beforeEOF = func() {
+			if _, u, ok := c.pool.lookup("alice"); ok {
+				flags = u.flags
+			}
+		}
+
+		c.handle(t, conn)
+
+		if !slices.Equal(flags, []string{"proxy"}) {
+			t.Errorf("alice's flags = %v, want [proxy]", flags)
+		}
+		if strings.Contains(conn.written(), `"type":"error"`) {
+			t.Errorf("alice was sent an error: %q", conn.written())
+		}
+	})
+}
@@ -0,0 +1,16 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// Restarting through SIGUSR2 is only supported on Unix systems.
+func watchRestart(ln net.Listener, tlsListener net.Listener) {}
+
+// As is --restart-exec.
+func execSelf() error {
+	return errors.New("restarting by exec is only supported on Unix systems")
+}
@@ -0,0 +1,129 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Zero-downtime restarts. When the server receives SIGUSR2 it
+// starts a fresh copy of its own binary, handing over the
+// listening sockets as file descriptors 3 and up (picked up by
+// the child through --inherit-fd and --inherit-tls-fd). The
+// parent then closes its listeners, waits for its remaining
+// clients to disconnect and exits.
+
+// ExtraFiles are numbered after stdin, stdout and stderr.
+const firstInheritedFD = 3
+
+// Watches for SIGUSR2. tlsListener may be nil when the
+// server has no TLS port.
+func watchRestart(ln net.Listener, tlsListener net.Listener) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR2)
+
+	go func() {
+		for range signals {
+			if err := restart(ln, tlsListener); err != nil {
+				log.Print("Restart failed: ", err)
+				continue
+			}
+			signal.Stop(signals)
+			ln.Close()
+			if tlsListener != nil {
+				tlsListener.Close()
+			}
+			return
+		}
+	}()
+}
+
+// Starts the replacement process with the listening sockets
+// attached. The caller stays responsible for closing them.
+func restart(ln net.Listener, tlsListener net.Listener) error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	args := restartArgs(os.Args[1:])
+	var files []*os.File
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+
+	for _, inherit := range []struct {
+		flag     string
+		listener net.Listener
+	}{{"-inherit-fd", ln}, {"-inherit-tls-fd", tlsListener}} {
+		if inherit.listener == nil {
+			continue
+		}
+		file, err := listenerFile(inherit.listener)
+		if err != nil {
+			return err
+		}
+		args = append(args, inherit.flag, strconv.Itoa(firstInheritedFD+len(files)))
+		files = append(files, file)
+	}
+
+	cmd := exec.Command(executable, args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	log.Print("Started new server process ", cmd.Process.Pid)
+	return nil
+}
+
+// Replaces this process with a fresh copy of its binary and command
+// line, keeping the PID. Only returns if that fails. The listeners are
+// closed on exec, so the new process opens its own.
+func execSelf() error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	log.Print("Restarting")
+	args := append([]string{executable}, restartArgs(os.Args[1:])...)
+	return syscall.Exec(executable, args, os.Environ())
+}
+
+func listenerFile(ln net.Listener) (*os.File, error) {
+	tcpListener, ok := ln.(*net.TCPListener)
+	if !ok {
+		return nil, errors.New("listener cannot be handed over")
+	}
+	return tcpListener.File()
+}
+
+// Copies the current command line for the child, dropping
+// any inherited descriptors left over from an earlier restart.
+func restartArgs(args []string) []string {
+	var result []string
+	for i := 0; i < len(args); i++ {
+		name := strings.TrimLeft(args[i], "-")
+		if name == "inherit-fd" || name == "inherit-tls-fd" {
+			i++ // skip the separate value
+			continue
+		} else if strings.HasPrefix(name, "inherit-fd=") || strings.HasPrefix(name, "inherit-tls-fd=") {
+			continue
+		}
+		result = append(result, args[i])
+	}
+	return result
+}
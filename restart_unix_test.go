@@ -0,0 +1,118 @@
+//go:build unix
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Set in the environment of the test binary that TestRestart starts
+// by SIGUSR2, which then plays the new server rather than running
+// the tests.
+const restartChildEnv = "CHAT_TEST_RESTART_CHILD"
+
+// The line the new server greets its connection with.
+const restartChildGreeting = "new server"
+
+func init() {
+	if os.Getenv(restartChildEnv) == "" {
+		return
+	}
+	// accept one connection on the inherited listener, as the
+	// restarted server would, and exit
+	for i, arg := range os.Args {
+		if arg != "-inherit-fd" || i+1 == len(os.Args) {
+			continue
+		}
+		fd, _ := strconv.Atoi(os.Args[i+1])
+		ln, err := listen("", 0, fd, 0, 0)
+		if err != nil {
+			os.Exit(2)
+		}
+		time.AfterFunc(integrationTimeout, func() { os.Exit(3) })
+		conn, err := ln.Accept()
+		if err != nil {
+			os.Exit(4)
+		}
+		conn.Write([]byte(restartChildGreeting + "\n"))
+		conn.Close()
+		os.Exit(0)
+	}
+	os.Exit(1)
+}
+
+// On SIGUSR2 the new process accepts connections on the same port,
+// while the old one stops accepting but keeps its clients.
+func TestRestart(t *testing.T) {
+	t.Setenv(restartChildEnv, "1")
+	ln, err := listen("127.0.0.1", 0, 0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	existing, err := net.DialTimeout("tcp", ln.Addr().String(), integrationTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer existing.Close()
+	accepted, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer accepted.Close()
+
+	watchRestart(ln, nil)
+	if err := syscall.Kill(os.Getpid(), syscall.SIGUSR2); err != nil {
+		t.Fatal(err)
+	}
+
+	ln.(*net.TCPListener).SetDeadline(time.Now().Add(integrationTimeout))
+	if _, err := ln.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("the old listener: %v, want it closed", err)
+	}
+
+	conn, err := net.DialTimeout("tcp", ln.Addr().String(), integrationTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(integrationTimeout))
+	if line, err := bufio.NewReader(conn).ReadString('\n'); line != restartChildGreeting+"\n" {
+		t.Fatalf("the new connection read %q, %v, want the new server's greeting", line, err)
+	}
+
+	// the old process still serves the connection it had
+	if _, err := existing.Write([]byte("still here\n")); err != nil {
+		t.Fatal(err)
+	}
+	accepted.SetReadDeadline(time.Now().Add(integrationTimeout))
+	if line, err := bufio.NewReader(accepted).ReadString('\n'); line != "still here\n" {
+		t.Errorf("the existing connection read %q, %v", line, err)
+	}
+}
+
+func TestRestartArgs(t *testing.T) {
+	tests := []struct {
+		args []string
+		want []string
+	}{
+		{[]string{"server", "-port", "8011"}, []string{"server", "-port", "8011"}},
+		{[]string{"server", "-inherit-fd", "3", "-port", "8011"}, []string{"server", "-port", "8011"}},
+		{[]string{"server", "--inherit-fd=3", "-inherit-tls-fd", "4"}, []string{"server"}},
+		{[]string{"server", "-inherit-tls-fd=4", "-tls-port", "8443"}, []string{"server", "-tls-port", "8443"}},
+	}
+	for _, tt := range tests {
+		if got := restartArgs(tt.args); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("restartArgs(%q) = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
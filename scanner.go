@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// A ContentScanner checks each message with an external service, such
+// as antivirus for links or data-loss prevention, before it is added
+// to the history and broadcast. The scanner can let a message through,
+// let it through with parts redacted, or block it, in which case the
+// sender is told why. Scanning runs on the broadcaster's goroutine, so
+// each scan is given scanTimeout. A scan that fails or times out
+// blocks the message, unless --content-scanner-fail-open is set to
+// keep the chat going while the scanner is down.
+//
+// With --content-scanner-url, messages are scanned by an HTTP service:
+// each one is POSTed to the URL as
+//
+//	{"text":"see http://example.com"}
+//
+// and the service answers 200 with
+//
+//	{"allowed":true,"reason":"","redacted_text":"see [link removed]"}
+//
+// where reason and redacted_text may be left out. Without it,
+// NoopScanner lets everything through.
+
+const scanTimeout = 200 * time.Millisecond
+
+type ScanResult struct {
+	Allowed      bool
+	Reason       string // why the message was blocked
+	RedactedText string // replaces the message's text, if set
+}
+
+type ContentScanner interface {
+	Scan(ctx context.Context, text string) (ScanResult, error)
+}
+
+// Allows every message unchanged; the scanner used until
+// a deployment has one of its own.
+type NoopScanner struct{}
+
+func (NoopScanner) Scan(ctx context.Context, text string) (ScanResult, error) {
+	return ScanResult{Allowed: true}, nil
+}
+
+// Lets messages through when the scanner it wraps fails, for
+// --content-scanner-fail-open.
+type failOpenScanner struct {
+	ContentScanner
+}
+
+func (s failOpenScanner) Scan(ctx context.Context, text string) (ScanResult, error) {
+	result, err := s.ContentScanner.Scan(ctx, text)
+	if err != nil {
+		log.Print("Content scanner failed, letting the message through: ", err)
+		return ScanResult{Allowed: true}, nil
+	}
+	return result, nil
+}
+
+// Scans messages with an HTTP service; see --content-scanner-url above.
+type HTTPScanner struct {
+	url    string
+	client *http.Client
+}
+
+func newHTTPScanner(url string) *HTTPScanner {
+	// the request is bounded by the context's scanTimeout
+	return &HTTPScanner{url: url, client: &http.Client{}}
+}
+
+func (s *HTTPScanner) Scan(ctx context.Context, text string) (ScanResult, error) {
+	body, err := json.Marshal(map[string]string{"text": text})
+	if err != nil {
+		return ScanResult{}, err
+	}
+	request, err := http.NewRequestWithContext(ctx, "POST", s.url, bytes.NewReader(body))
+	if err != nil {
+		return ScanResult{}, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(request)
+	if err != nil {
+		return ScanResult{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return ScanResult{}, fmt.Errorf("content scanner returned %s", resp.Status)
+	}
+
+	var result struct {
+		Allowed      bool   `json:"allowed"`
+		Reason       string `json:"reason"`
+		RedactedText string `json:"redacted_text"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return ScanResult{}, fmt.Errorf("content scanner: %w", err)
+	}
+	return ScanResult{Allowed: result.Allowed, Reason: result.Reason, RedactedText: result.RedactedText}, nil
+}
+
+// Scans a message, applying any redaction. Returns false if the
+// message was blocked, after telling the sender.
+func scanMessage(scanner ContentScanner, pool *safePool, packet *messagePacket) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), scanTimeout)
+	defer cancel()
+
+	result, err := scanner.Scan(ctx, packet.text)
+	if err != nil {
+		log.Print("Scanning message from ", packet.sender, ": ", err)
+		result = ScanResult{Reason: "content scanner unavailable"}
+	}
+	if !result.Allowed {
+		log.Print("Blocked message from ", packet.sender, ": ", result.Reason)
+		// long-poll senders aren't in the pool, and aren't told
+		if u, ok := pool.get(packet.source); ok {
+			sendError(u.connection, "message blocked: "+result.Reason)
+		}
+		return false
+	}
+	if result.RedactedText != "" {
+		packet.text = result.RedactedText
+	}
+	return true
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Blocks messages with plain HTTP links.
+type linkScanner struct{}
+
+func (linkScanner) Scan(ctx context.Context, text string) (ScanResult, error) {
+	if strings.Contains(text, "http://") {
+		return ScanResult{Reason: "insecure link"}, nil
+	}
+	return ScanResult{Allowed: true}, nil
+}
+
+func TestScanMessageBlocksAndTellsSender(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	pool := newSafePool()
+	pool.addIfAbsent("alice-addr", newTestUser(t, server, "alice"))
+
+	packet := messagePacket{text: "see http://example.com", source: "alice-addr", sender: "alice"}
+	blocked := make(chan bool)
+	go func() { blocked <- !scanMessage(linkScanner{}, pool, &packet) }()
+
+	line, err := bufio.NewReader(client).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !<-blocked {
+		t.Error("message with an http:// link was let through")
+	}
+	var message errorPacket
+	if packetType, raw := decodePacket(strings.TrimSpace(line)); packetType != "error" || json.Unmarshal(raw, &message) != nil {
+		t.Fatalf("sender got %q, want an error packet", line)
+	}
+	if message.Text != "message blocked: insecure link" {
+		t.Errorf("error text = %q", message.Text)
+	}
+
+	packet = messagePacket{text: "see https://example.com", source: "alice-addr", sender: "alice"}
+	if !scanMessage(linkScanner{}, pool, &packet) {
+		t.Error("message with an https:// link was blocked")
+	}
+}
+
+func TestHTTPScanner(t *testing.T) {
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			Text string `json:"text"`
+		}
+		json.NewDecoder(r.Body).Decode(&request)
+		switch request.Text {
+		case "secret":
+			w.Write([]byte(`{"allowed":false,"reason":"data leak"}`))
+		case "card 4111111111111111":
+			w.Write([]byte(`{"allowed":true,"redacted_text":"card ****"}`))
+		case "broken":
+			http.Error(w, "oops", http.StatusInternalServerError)
+		case "slow":
+			time.Sleep(2 * scanTimeout)
+			w.Write([]byte(`{"allowed":false}`))
+		default:
+			w.Write([]byte(`{"allowed":true}`))
+		}
+	}))
+	defer service.Close()
+	scanner := newHTTPScanner(service.URL)
+
+	tests := []struct {
+		text     string
+		failOpen bool
+		wantPass bool
+		wantText string
+	}{
+		{"hello", false, true, "hello"},
+		{"secret", false, false, "secret"},
+		{"card 4111111111111111", false, true, "card ****"},
+		{"broken", false, false, "broken"}, // a failed scan blocks the message
+		{"slow", false, false, "slow"},     // and so does one that times out
+		{"broken", true, true, "broken"},   // unless failing open
+		{"slow", true, true, "slow"},
+		{"secret", true, false, "secret"},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s fail open %v", tt.text, tt.failOpen), func(t *testing.T) {
+			var scanner ContentScanner = scanner
+			if tt.failOpen {
+				scanner = failOpenScanner{scanner}
+			}
+			packet := messagePacket{text: tt.text, sender: "lp-user", source: "lp:1"} // not in the pool
+			if pass := scanMessage(scanner, newSafePool(), &packet); pass != tt.wantPass {
+				t.Errorf("scanMessage = %v, want %v", pass, tt.wantPass)
+			}
+			if packet.text != tt.wantText {
+				t.Errorf("text = %q, want %q", packet.text, tt.wantText)
+			}
+		})
+	}
+}
+
+// Waits out the scan's timeout, as a scanner that has stopped
+// answering does.
+type hungScanner struct{}
+
+func (hungScanner) Scan(ctx context.Context, text string) (ScanResult, error) {
+	<-ctx.Done()
+	return ScanResult{}, ctx.Err()
+}
+
+// A scan that times out blocks the message, telling the sender why.
+func TestScanMessageTimeout(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	pool := newSafePool()
+	pool.addIfAbsent("alice-addr", newTestUser(t, server, "alice"))
+
+	packet := messagePacket{text: "hello", source: "alice-addr", sender: "alice"}
+	start := time.Now()
+	if scanMessage(hungScanner{}, pool, &packet) {
+		t.Error("message let through when the scan timed out")
+	}
+	if elapsed := time.Since(start); elapsed < scanTimeout || elapsed > 5*scanTimeout {
+		t.Errorf("scan took %v, want about %v", elapsed, scanTimeout)
+	}
+	line, err := bufio.NewReader(client).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"type":"error","text":"message blocked: content scanner unavailable"}` + "\n"; line != want {
+		t.Errorf("alice got %q, want %q", line, want)
+	}
+
+	packet = messagePacket{text: "hello", source: "alice-addr", sender: "alice"}
+	if !scanMessage(failOpenScanner{hungScanner{}}, pool, &packet) {
+		t.Error("message blocked although failing open")
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Scheduled messages, for reminders and bots that want a message
+// sent at a given time. Managed through the admin API:
+//
+//	POST /api/schedule
+//	     Body {"sender":"ci","text":"deploy window opens","send_at":"<RFC3339>"}
+//	     queues a message and returns it with its id.
+//	GET /api/schedule
+//	     lists pending messages, soonest first.
+//	DELETE /api/schedule/{id}
+//	     cancels a pending message.
+//
+// When its time comes, a message is injected into the message
+// channel and broadcast like any other.
+
+type scheduledMessage struct {
+	ID     string    `json:"id"`
+	Sender string    `json:"sender"`
+	Text   string    `json:"text"`
+	SendAt time.Time `json:"send_at"`
+
+	timer *time.Timer
+}
+
+type scheduleRunner struct {
+	mu       sync.Mutex
+	schedule []*scheduledMessage // sorted by SendAt
+	nextID   int
+	bus      *MessageBus
+}
+
+func newScheduleRunner(bus *MessageBus) *scheduleRunner {
+	return &scheduleRunner{bus: bus}
+}
+
+// Queues a message and starts its timer.
+func (s *scheduleRunner) add(sender string, text string, sendAt time.Time) *scheduledMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nextID++
+	message := &scheduledMessage{
+		ID:     strconv.Itoa(s.nextID),
+		Sender: sender,
+		Text:   text,
+		SendAt: sendAt,
+	}
+	// keep messages due at the same time in the order they were added
+	index := slices.IndexFunc(s.schedule, func(m *scheduledMessage) bool { return m.SendAt.After(sendAt) })
+	if index < 0 {
+		index = len(s.schedule)
+	}
+	s.schedule = slices.Insert(s.schedule, index, message)
+
+	message.timer = time.AfterFunc(time.Until(sendAt), func() {
+		if s.remove(message.ID) {
+			s.bus.publish(messagePacket{
+				text:   message.Text,
+				source: "schedule",
+				sender: message.Sender,
+			})
+		}
+	})
+	return message
+}
+
+// Takes a message off the schedule, stopping its timer. Reports
+// false if it was not pending, having fired or been cancelled.
+func (s *scheduleRunner) remove(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	index := slices.IndexFunc(s.schedule, func(m *scheduledMessage) bool { return m.ID == id })
+	if index < 0 {
+		return false
+	}
+	s.schedule[index].timer.Stop()
+	s.schedule = slices.Delete(s.schedule, index, index+1)
+	return true
+}
+
+func (s *scheduleRunner) pending() []scheduledMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	messages := make([]scheduledMessage, 0, len(s.schedule))
+	for _, message := range s.schedule {
+		messages = append(messages, *message)
+	}
+	return messages
+}
+
+func (s *scheduleRunner) register(mux *http.ServeMux) {
+	mux.HandleFunc("POST /api/schedule", func(w http.ResponseWriter, r *http.Request) {
+		var request scheduledMessage
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if request.Sender == "" || request.Text == "" || request.SendAt.IsZero() {
+			http.Error(w, "sender, text and send_at are required", http.StatusBadRequest)
+			return
+		}
+
+		message := s.add(request.Sender, request.Text, request.SendAt)
+		writeJSON(w, http.StatusCreated, message)
+	})
+
+	mux.HandleFunc("GET /api/schedule", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, s.pending())
+	})
+
+	mux.HandleFunc("DELETE /api/schedule/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if !s.remove(r.PathValue("id")) {
+			http.Error(w, "no pending message with that id", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
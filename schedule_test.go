@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestScheduleAPI() (*http.ServeMux, <-chan messagePacket) {
+	bus := newMessageBus(16)
+	published := bus.subscribe()
+	mux := http.NewServeMux()
+	newScheduleRunner(bus).register(mux)
+	return mux, published
+}
+
+func scheduleRequest(t *testing.T, mux *http.ServeMux, method string, path string, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+	return w
+}
+
+func listSchedule(t *testing.T, mux *http.ServeMux) []scheduledMessage {
+	t.Helper()
+	var messages []scheduledMessage
+	w := scheduleRequest(t, mux, "GET", "/api/schedule", "")
+	if err := json.NewDecoder(w.Body).Decode(&messages); err != nil {
+		t.Fatal(err)
+	}
+	return messages
+}
+
+func TestScheduleSendsOnTime(t *testing.T) {
+	mux, published := newTestScheduleAPI()
+	start := time.Now()
+	sendAt := start.Add(100 * time.Millisecond).Format(time.RFC3339Nano)
+
+	w := scheduleRequest(t, mux, "POST", "/api/schedule", `{"sender":"ci","text":"deploy window opens","send_at":"`+sendAt+`"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("POST returned %d: %s", w.Code, w.Body)
+	}
+	if pending := listSchedule(t, mux); len(pending) != 1 {
+		t.Fatalf("%d messages pending, want 1", len(pending))
+	}
+
+	select {
+	case packet := <-published:
+		if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+			t.Errorf("sent after %v, before it was due", elapsed)
+		}
+		if packet.sender != "ci" || packet.text != "deploy window opens" {
+			t.Errorf("sent %q from %q", packet.text, packet.sender)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the message wasn't sent")
+	}
+	if pending := listSchedule(t, mux); len(pending) != 0 {
+		t.Errorf("%d messages still pending after sending", len(pending))
+	}
+}
+
+func TestScheduleListAndCancel(t *testing.T) {
+	mux, published := newTestScheduleAPI()
+	now := time.Now()
+	for _, m := range []struct {
+		text string
+		in   time.Duration
+	}{
+		{"third", 3 * time.Hour},
+		{"first", time.Hour},
+		{"second", 2 * time.Hour},
+		{"soon", 50 * time.Millisecond},
+	} {
+		sendAt := now.Add(m.in).Format(time.RFC3339Nano)
+		scheduleRequest(t, mux, "POST", "/api/schedule", `{"sender":"bot","text":"`+m.text+`","send_at":"`+sendAt+`"}`)
+	}
+
+	pending := listSchedule(t, mux)
+	var texts []string
+	for _, m := range pending {
+		texts = append(texts, m.Text)
+	}
+	if got := strings.Join(texts, ","); got != "soon,first,second,third" {
+		t.Errorf("pending messages are %s, want soon,first,second,third", got)
+	}
+
+	if w := scheduleRequest(t, mux, "DELETE", "/api/schedule/"+pending[0].ID, ""); w.Code != http.StatusNoContent {
+		t.Errorf("DELETE returned %d, want %d", w.Code, http.StatusNoContent)
+	}
+	if w := scheduleRequest(t, mux, "DELETE", "/api/schedule/"+pending[0].ID, ""); w.Code != http.StatusNotFound {
+		t.Errorf("second DELETE returned %d, want %d", w.Code, http.StatusNotFound)
+	}
+	if n := len(listSchedule(t, mux)); n != 3 {
+		t.Errorf("%d messages pending after cancelling one, want 3", n)
+	}
+	select {
+	case packet := <-published:
+		t.Errorf("cancelled message %q was sent", packet.text)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestScheduleRejectsIncompleteRequests(t *testing.T) {
+	mux, _ := newTestScheduleAPI()
+	for _, body := range []string{
+		`{"text":"hello","send_at":"2030-01-01T00:00:00Z"}`,
+		`{"sender":"bot","send_at":"2030-01-01T00:00:00Z"}`,
+		`{"sender":"bot","text":"hello"}`,
+		`{"sender":"bot","text":"hello","send_at":"tomorrow"}`,
+		`not json`,
+	} {
+		if w := scheduleRequest(t, mux, "POST", "/api/schedule", body); w.Code != http.StatusBadRequest {
+			t.Errorf("POST %s returned %d, want %d", body, w.Code, http.StatusBadRequest)
+		}
+	}
+}
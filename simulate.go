@@ -0,0 +1,130 @@
+//go:build simulation
+
+package main
+
+import (
+	"flag"
+	"math"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Network latency simulation, for trying out multi-server setups
+// without a real WAN link. Only compiled in with -tags simulation,
+// which adds two server flags:
+//
+//	--simulate-latency <delay>
+//	     delay every write to a client by this long, without
+//	     holding up writes to other clients
+//	--simulate-jitter <stddev>
+//	     delay every read by a random, normally distributed
+//	     duration with this standard deviation
+
+var (
+	simulatedDelay  time.Duration
+	simulatedJitter time.Duration
+)
+
+func registerSimulationFlags(flags *flag.FlagSet) {
+	flags.DurationVar(&simulatedDelay, "simulate-latency", 0, "delay added to every write to a client")
+	flags.DurationVar(&simulatedJitter, "simulate-jitter", 0, "standard deviation of random delay added to every read")
+}
+
+// Wraps an accepted connection so it suffers the configured delays.
+func simulateLatency(conn net.Conn) net.Conn {
+	if simulatedDelay == 0 && simulatedJitter == 0 {
+		return conn
+	}
+	c := &delayedConn{Conn: conn, delay: simulatedDelay, jitter: simulatedJitter}
+	if c.delay > 0 {
+		c.writes = make(chan delayedWrite, delayedWriteQueue)
+		go c.writeDelayed()
+	}
+	return c
+}
+
+// Writes waiting out their delay on one connection. Once the queue
+// is full, Write blocks as it would on a full socket buffer.
+const delayedWriteQueue = 256
+
+type delayedWrite struct {
+	data []byte
+	due  time.Time
+}
+
+// Delays writes in a goroutine of its own rather than in Write, so
+// that the broadcaster, which writes to every client in turn, isn't
+// held up by each client's delay in series. Writes still arrive in
+// order, each delay after it was made.
+type delayedConn struct {
+	net.Conn
+	delay  time.Duration
+	jitter time.Duration
+
+	mu      sync.Mutex // held to queue a write, so Close can't close writes under it
+	writes  chan delayedWrite
+	closing bool
+
+	err atomic.Pointer[error] // the first failed write's error, returned by later writes
+}
+
+// The underlying connection, so that socket options can be set on it.
+func (c *delayedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *delayedConn) Write(b []byte) (int, error) {
+	if c.writes == nil {
+		return c.Conn.Write(b)
+	}
+	if err := c.err.Load(); err != nil {
+		return 0, *err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closing {
+		return 0, net.ErrClosed
+	}
+	c.writes <- delayedWrite{data: append([]byte(nil), b...), due: time.Now().Add(c.delay)}
+	return len(b), nil
+}
+
+// Sends the queued writes when they're due, then closes the
+// connection once Close has been called and the queue is empty.
+func (c *delayedConn) writeDelayed() {
+	defer c.Conn.Close()
+	for write := range c.writes {
+		time.Sleep(time.Until(write.due))
+		if _, err := c.Conn.Write(write.data); err != nil {
+			c.err.CompareAndSwap(nil, &err)
+		}
+	}
+}
+
+// Lets the writes already made arrive before the connection closes,
+// as they would over a slow link.
+func (c *delayedConn) Close() error {
+	if c.writes == nil {
+		return c.Conn.Close()
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closing {
+		return net.ErrClosed
+	}
+	c.closing = true
+	close(c.writes)
+	return nil
+}
+
+func (c *delayedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if c.jitter > 0 {
+		time.Sleep(time.Duration(math.Abs(rand.NormFloat64()) * float64(c.jitter)))
+	}
+	return n, err
+}
@@ -0,0 +1,17 @@
+//go:build !simulation
+
+package main
+
+import (
+	"flag"
+	"net"
+)
+
+// Latency simulation is only available in builds made
+// with -tags simulation.
+
+func registerSimulationFlags(flags *flag.FlagSet) {}
+
+func simulateLatency(conn net.Conn) net.Conn {
+	return conn
+}
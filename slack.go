@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+// Outbound integration with Slack-compatible incoming webhooks.
+// When the server is started with --slack-webhook-url, every
+// broadcast message is also posted to the webhook once the middleware
+// and content scanner have seen it, so blocked messages aren't posted
+// and the rest have their emoji expanded. Each is formatted as
+//
+//	{"text":"*alice*: hello","username":"chatbot","icon_emoji":":speech_balloon:"}
+//
+// with a "tags" object added for messages with tags, whether #key=value
+// tags from the sender or ones the middleware added.
+//
+// Failed deliveries (transport errors or non-2xx responses) are
+// retried with exponential backoff. The notifier subscribes to the
+// broadcaster's output lossily, so while a slow or failing webhook
+// holds it up, chat carries on and the messages it falls behind on
+// aren't posted.
+
+const (
+	slackUsername   = "chatbot"
+	slackIconEmoji  = ":speech_balloon:"
+	slackMaxRetries = 3
+)
+
+// Matches @mentions so they can be rewritten as <@name>.
+var slackMentionPattern = regexp.MustCompile(`@(\w+)`)
+
+type slackPayload struct {
+	Text      string            `json:"text"`
+	Username  string            `json:"username"`
+	IconEmoji string            `json:"icon_emoji"`
+	Channel   string            `json:"channel,omitempty"`
+	Tags      map[string]string `json:"tags,omitempty"`
+}
+
+type slackNotifier struct {
+	url     string
+	channel string // empty uses the webhook's default channel
+	client  *http.Client
+	backoff time.Duration // delay before the first retry, doubled each time
+}
+
+func newSlackNotifier(url string, channel string) *slackNotifier {
+	return &slackNotifier{
+		url:     url,
+		channel: channel,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		backoff: 500 * time.Millisecond,
+	}
+}
+
+// Builds the webhook text for a message, bolding the sender
+// and converting @mentions to Slack's <@name> form.
+func formatSlackText(packet messagePacket) string {
+	text := slackMentionPattern.ReplaceAllString(packet.text, "<@$1>")
+	return "*" + packet.sender + "*: " + text
+}
+
+// Posts a single message to the webhook, retrying up to
+// slackMaxRetries times before giving up.
+func (s *slackNotifier) send(packet messagePacket) error {
+	body, err := json.Marshal(slackPayload{
+		Text:      formatSlackText(packet),
+		Username:  slackUsername,
+		IconEmoji: slackIconEmoji,
+		Channel:   s.channel,
+		Tags:      packet.tags,
+	})
+	if err != nil {
+		return err
+	}
+
+	delay := s.backoff
+	for attempt := 0; ; attempt++ {
+		err = s.post(body)
+		if err == nil || attempt == slackMaxRetries {
+			return err
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// Posts each message the broadcaster passes on, one at a time,
+// until the channel is closed.
+func (s *slackNotifier) run(messages <-chan messagePacket) {
+	for packet := range messages {
+		if err := s.send(packet); err != nil {
+			log.Print(err)
+		}
+	}
+}
+
+func (s *slackNotifier) post(body []byte) error {
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("slack webhook returned %s", resp.Status)
+	}
+	return nil
+}
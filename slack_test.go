@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// A webhook that answers the first failures requests with 429, and
+// the rest with 200, keeping the last payload it was sent and passing
+// it to received, if set.
+type testWebhook struct {
+	failures int32
+	requests atomic.Int32
+	payload  slackPayload
+	received chan slackPayload
+}
+
+func (h *testWebhook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.requests.Add(1) <= h.failures {
+		http.Error(w, "rate limited", http.StatusTooManyRequests)
+		return
+	}
+	if r.Header.Get("Content-Type") != "application/json" {
+		http.Error(w, "not JSON", http.StatusBadRequest)
+		return
+	}
+	if err := json.NewDecoder(r.Body).Decode(&h.payload); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if h.received != nil {
+		h.received <- h.payload
+	}
+}
+
+func newTestSlackNotifier(t *testing.T, webhook *testWebhook, channel string) *slackNotifier {
+	server := httptest.NewServer(webhook)
+	t.Cleanup(server.Close)
+	slack := newSlackNotifier(server.URL, channel)
+	slack.backoff = time.Millisecond
+	return slack
+}
+
+func TestSlackPayload(t *testing.T) {
+	webhook := &testWebhook{}
+	slack := newTestSlackNotifier(t, webhook, "#builds")
+
+	if err := slack.send(messagePacket{sender: "alice", text: "done, thanks @bob", tags: map[string]string{"build_id": "42"}}); err != nil {
+		t.Fatal(err)
+	}
+	want := slackPayload{
+		Text:      "*alice*: done, thanks <@bob>",
+		Username:  "chatbot",
+		IconEmoji: ":speech_balloon:",
+		Channel:   "#builds",
+		Tags:      map[string]string{"build_id": "42"},
+	}
+	if !reflect.DeepEqual(webhook.payload, want) {
+		t.Errorf("payload = %+v, want %+v", webhook.payload, want)
+	}
+}
+
+func TestSlackRetries(t *testing.T) {
+	tests := []struct {
+		name         string
+		failures     int32
+		wantErr      bool
+		wantRequests int32
+	}{
+		{"first time", 0, false, 1},
+		{"after 429s", 2, false, 3},
+		{"on the last retry", slackMaxRetries, false, slackMaxRetries + 1},
+		{"gives up", slackMaxRetries + 1, true, slackMaxRetries + 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			webhook := &testWebhook{failures: tt.failures}
+			slack := newTestSlackNotifier(t, webhook, "")
+
+			err := slack.send(messagePacket{sender: "alice", text: "hello"})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("send() = %v, want error %v", err, tt.wantErr)
+			}
+			if n := webhook.requests.Load(); n != tt.wantRequests {
+				t.Errorf("webhook got %d requests, want %d", n, tt.wantRequests)
+			}
+		})
+	}
+}
+
+// Each retry waits twice as long as the one before.
+func TestSlackBackoffDoubles(t *testing.T) {
+	webhook := &testWebhook{failures: slackMaxRetries}
+	slack := newTestSlackNotifier(t, webhook, "")
+	slack.backoff = 10 * time.Millisecond
+
+	start := time.Now()
+	if err := slack.send(messagePacket{sender: "alice", text: "hello"}); err != nil {
+		t.Fatal(err)
+	}
+	// 10ms + 20ms + 40ms
+	if elapsed := time.Since(start); elapsed < 70*time.Millisecond {
+		t.Errorf("retries took %v, want at least 70ms", elapsed)
+	}
+}
+
+// Runs the broadcaster with middleware and scanner, posting what it
+// lets through to a test webhook as server() does, and returns the
+// channel to send messages on and the payloads the webhook receives.
+func startSlackBroadcaster(t *testing.T, middleware []Middleware, scanner ContentScanner) (chan<- messagePacket, <-chan slackPayload) {
+	webhook := &testWebhook{received: make(chan slackPayload, 10)}
+	slack := newTestSlackNotifier(t, webhook, "")
+	processed := newMessageBus(10)
+	go slack.run(processed.subscribeLossy())
+
+	messages := make(chan messagePacket)
+	runBroadcaster(t, newSafePool(), messages, processed, middleware, scanner, newDeadLetterQueue())
+	return messages, webhook.received
+}
+
+// Waits for the next payload posted to the webhook.
+func nextSlackPayload(t *testing.T, payloads <-chan slackPayload) slackPayload {
+	t.Helper()
+	select {
+	case payload := <-payloads:
+		return payload
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing was posted to the webhook")
+		return slackPayload{}
+	}
+}
+
+// Slack gets messages once the emoji middleware has expanded them.
+func TestSlackEmojiExpanded(t *testing.T) {
+	emoji, err := newEmojiMiddleware("emoji_codes.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages, payloads := startSlackBroadcaster(t, []Middleware{emoji}, NoopScanner{})
+
+	messages <- messagePacket{sender: "alice", text: "shipped :smile:", source: "10.0.0.1:5000"}
+	if got := nextSlackPayload(t, payloads).Text; got != "*alice*: shipped 😊" {
+		t.Errorf("posted %q, want the emoji expanded", got)
+	}
+}
+
+// The sentiment tag the middleware adds is posted with the sender's tags.
+func TestSlackSentimentTag(t *testing.T) {
+	sentiment, err := newSentimentPlugin("sentiment")
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages, payloads := startSlackBroadcaster(t, []Middleware{sentiment}, NoopScanner{})
+
+	messages <- messagePacket{sender: "alice", text: "I love this #build_id=42", source: "10.0.0.1:5000"}
+	payload := nextSlackPayload(t, payloads)
+	want := map[string]string{"build_id": "42", "sentiment": "positive"}
+	if !reflect.DeepEqual(payload.Tags, want) {
+		t.Errorf("posted tags %v, want %v", payload.Tags, want)
+	}
+}
+
+// Messages the content scanner blocks aren't posted.
+func TestSlackSkipsBlocked(t *testing.T) {
+	messages, payloads := startSlackBroadcaster(t, nil, linkScanner{})
+
+	messages <- messagePacket{sender: "alice", text: "see http://example.com", source: "10.0.0.1:5000"}
+	messages <- messagePacket{sender: "alice", text: "never mind", source: "10.0.0.1:5000"}
+	if got := nextSlackPayload(t, payloads).Text; got != "*alice*: never mind" {
+		t.Errorf("posted %q first, want only the message that was let through", got)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Slow consumers: clients whose connections can't keep up with what
+// is sent to them. Everything written to a user goes through a queue
+// of sendQueueSize lines, written out by a goroutine of the user's
+// own, so a client that stops reading only holds up itself. Each
+// write has writeTimeout to complete; lines that miss it are counted
+// as slow writes, and lines that don't fit in the queue are dropped.
+// Every slowConsumerCheckInterval the pool is scanned to update the
+// chat_slow_consumers gauge from the users' queue depths, and with
+// --auto-kick-slow-consumers, users with more than
+// --slow-consumer-threshold lines waiting are disconnected.
+
+const (
+	writeTimeout              = 5 * time.Second
+	sendQueueSize             = 256
+	slowConsumerCheckInterval = 5 * time.Minute
+	slowConsumerDepth         = 10 // lines waiting before a user counts as a slow consumer
+	defaultSlowThreshold      = 50
+)
+
+// The error a write to a user whose queue is full gets.
+var errSendQueueFull = errors.New("send queue full")
+
+type queuedWrite struct {
+	data      []byte
+	broadcast bool // counted in the user's stats once written
+}
+
+// A user's connection, whose writes are queued and written by
+// writeQueued so that one client that stops reading doesn't hold up
+// the broadcaster, or anyone writing presence or replies, for the
+// others. Writes arrive in order.
+type queuedConn struct {
+	net.Conn
+	stats *userStats
+
+	mu      sync.Mutex // held to queue a write, so Close can't close writes under it
+	writes  chan queuedWrite
+	closing time.Time // when Close was called, zero until then
+	done    chan struct{}
+}
+
+func newQueuedConn(conn net.Conn, stats *userStats) *queuedConn {
+	c := &queuedConn{
+		Conn:   conn,
+		stats:  stats,
+		writes: make(chan queuedWrite, sendQueueSize),
+		done:   make(chan struct{}),
+	}
+	go c.writeQueued()
+	return c
+}
+
+func (c *queuedConn) Write(b []byte) (int, error) {
+	if err := c.queue(b, false); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Queues a broadcast, which counts towards the user's messages
+// and bytes sent once it has been written.
+func (c *queuedConn) writeBroadcast(b []byte) error {
+	return c.queue(b, true)
+}
+
+func (c *queuedConn) queue(b []byte, broadcast bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.closing.IsZero() {
+		return net.ErrClosed
+	}
+	select {
+	case c.writes <- queuedWrite{data: append([]byte(nil), b...), broadcast: broadcast}:
+		return nil
+	default:
+		return errSendQueueFull
+	}
+}
+
+// The number of lines waiting to be written.
+func (c *queuedConn) depth() int {
+	return len(c.writes)
+}
+
+// Writes the queued lines in turn, then closes the connection once
+// Close has been called and the queue is empty.
+func (c *queuedConn) writeQueued() {
+	defer close(c.done)
+	defer c.Conn.Close()
+	broken := false
+	for write := range c.writes {
+		if broken {
+			continue
+		}
+		c.Conn.SetWriteDeadline(c.writeDeadline())
+		size, err := c.Conn.Write(write.data)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			count := c.stats.slowWrites.Add(1)
+			log.Print("Slow write to ", c.Conn.RemoteAddr(), " (", count, " so far)")
+		} else if err != nil {
+			// nothing more will get through, so close the
+			// connection for its handler to see and clean up
+			broken = true
+			c.Conn.Close()
+		} else if write.broadcast {
+			c.stats.sent(size)
+		}
+	}
+}
+
+// Each write gets writeTimeout, except that once the connection is
+// closing, whatever is left has writeTimeout from then to be written.
+func (c *queuedConn) writeDeadline() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.closing.IsZero() {
+		return c.closing.Add(writeTimeout)
+	}
+	return time.Now().Add(writeTimeout)
+}
+
+// Lets the lines already queued be written, giving them writeTimeout
+// at most, then closes the connection, returning once it is closed.
+func (c *queuedConn) Close() error {
+	c.mu.Lock()
+	if c.closing.IsZero() {
+		c.closing = time.Now()
+		close(c.writes)
+	}
+	c.mu.Unlock()
+	<-c.done
+	return nil
+}
+
+// Checks for slow consumers every slowConsumerCheckInterval.
+func watchSlowConsumers(pool *safePool, metrics *serverMetrics, autoKick bool, live *liveConfig, audit *userAuditLog) {
+	ticker := time.NewTicker(slowConsumerCheckInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		checkSlowConsumers(pool, metrics, autoKick, live, audit)
+	}
+}
+
+// Counts the slow consumers for the metrics and, if autoKick is set,
+// disconnects those with more lines waiting than the live threshold.
+func checkSlowConsumers(pool *safePool, metrics *serverMetrics, autoKick bool, live *liveConfig, audit *userAuditLog) {
+	var slow uint64
+	threshold := live.load().slowThreshold
+	for _, u := range pool.snapshot() {
+		depth := u.connection.depth()
+		if depth > slowConsumerDepth {
+			slow++
+		}
+		if autoKick && uint32(depth) > threshold {
+			log.Print("Disconnecting slow consumer ", u.username, " at ", u.connection.RemoteAddr())
+			audit.record(u.username, auditKicked, "slow consumer")
+			// the handler sees the closed connection and cleans
+			// up; closed in the background, as it can take
+			// writeTimeout to give up on the queue
+			go u.connection.Close()
+		}
+	}
+	metrics.slowConsumers.Store(slow)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// A client that stops reading doesn't hold up the broadcasts to the
+// others, nor is it disconnected unless auto-kick is on.
+func TestStalledReader(t *testing.T) {
+	const messages = 20
+	pool := newSafePool()
+	stalledServer, stalledClient := net.Pipe() // never read
+	defer stalledClient.Close()
+	stalled := newTestUser(t, stalledServer, "stalled")
+	pool.addIfAbsent("10.0.0.1:5000", stalled)
+
+	var readers []*bufio.Reader
+	for i := 0; i < 2; i++ {
+		server, client := net.Pipe()
+		defer client.Close()
+		pool.addIfAbsent(fmt.Sprintf("10.0.0.%d:5000", i+2), newTestUser(t, server, fmt.Sprintf("reader%d", i)))
+		readers = append(readers, bufio.NewReader(client))
+	}
+	sends := make(chan messagePacket)
+	startBroadcaster(t, pool, sends)
+
+	start := time.Now()
+	go func() {
+		for i := 0; i < messages; i++ {
+			sends <- messagePacket{sender: "alice", text: fmt.Sprint("message ", i), source: "10.0.1.1:5000"}
+		}
+	}()
+	for i, reader := range readers {
+		for j := 0; j < messages; j++ {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatalf("reader%d: %v", i, err)
+			}
+			if want := fmt.Sprintf("BROADCAST alice: message %d\n", j); line != want {
+				t.Fatalf("reader%d got %q, want %q", i, line, want)
+			}
+		}
+	}
+	if elapsed := time.Since(start); elapsed > writeTimeout/5 {
+		t.Errorf("readers took %v to get every message", elapsed)
+	}
+
+	// one line is being written, and the rest wait in the queue
+	if depth := stalled.connection.depth(); depth != messages-1 {
+		t.Errorf("stalled user's queue holds %d lines, want %d", depth, messages-1)
+	}
+
+	metrics := &serverMetrics{}
+	live := newLiveConfig(serverConfig{slowThreshold: 15})
+	audit := newUserAuditLog()
+	checkSlowConsumers(pool, metrics, false, live, audit)
+	if n := metrics.slowConsumers.Load(); n != 1 {
+		t.Errorf("counted %d slow consumers, want 1", n)
+	}
+	if _, kicked := audit.events("stalled"); kicked {
+		t.Error("stalled user was kicked without auto-kick")
+	}
+
+	checkSlowConsumers(pool, metrics, true, live, audit)
+	events, _ := audit.events("stalled")
+	if len(events) != 1 || events[0].Action != auditKicked {
+		t.Errorf("stalled user's audit events = %+v, want a kick", events)
+	}
+	for _, name := range []string{"reader0", "reader1"} {
+		if _, kicked := audit.events(name); kicked {
+			t.Errorf("%s was kicked", name)
+		}
+	}
+}
+
+// A full queue refuses writes rather than blocking.
+func TestQueuedConnFull(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	conn := newQueuedConn(server, newUserStats())
+	t.Cleanup(func() { conn.Close() })
+
+	var err error
+	for i := 0; i <= sendQueueSize+1 && err == nil; i++ {
+		_, err = conn.Write([]byte("hello\n"))
+	}
+	if err != errSendQueueFull {
+		t.Fatalf("writing past the queue's size: %v, want %v", err, errSendQueueFull)
+	}
+
+	client.SetReadDeadline(time.Now().Add(writeTimeout / 5))
+	if _, err := client.Read(make([]byte, 10)); err != nil {
+		t.Fatal("the first line wasn't written: ", err)
+	}
+	deadline := time.Now().Add(writeTimeout / 5)
+	for conn.depth() == sendQueueSize {
+		if time.Now().After(deadline) {
+			t.Fatal("the next line wasn't taken from the queue")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := conn.Write([]byte("hello\n")); err != nil {
+		t.Error("couldn't queue again once there was room: ", err)
+	}
+}
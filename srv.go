@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Server discovery through DNS. Given --srv-domain example.com, the
+// client looks up _chat._tcp.example.com and connects to the servers
+// it names, trying them in the order RFC 2782 sets out: lowest
+// priority first, and by weighted random choice among servers of the
+// same priority. If a server can't be reached the next one is tried.
+
+const defaultSRVTimeout = 5 * time.Second
+
+// What the client needs from a DNS resolver; *net.Resolver has it,
+// and tests can stand in their own.
+type srvResolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+// Looks up the chat servers for a domain, returning their
+// addresses in the order they should be tried.
+func lookupEndpoints(resolver srvResolver, domain string, timeout time.Duration) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// the records come back sorted by priority and shuffled by weight
+	_, records, err := resolver.LookupSRV(ctx, "chat", "tcp", domain)
+	if err != nil {
+		return nil, err
+	}
+
+	var endpoints []string
+	for _, record := range records {
+		if record.Target == "." {
+			continue // the domain explicitly has no chat service
+		}
+		host := strings.TrimSuffix(record.Target, ".")
+		endpoints = append(endpoints, net.JoinHostPort(host, strconv.Itoa(int(record.Port))))
+	}
+	if len(endpoints) == 0 {
+		return nil, errors.New("no chat servers listed for " + domain)
+	}
+	return endpoints, nil
+}
+
+// Connects to the first of the endpoints that answers, returning
+// the connection and the config updated with its endpoint.
+func connectAny(config clientConfig, endpoints []string, username string) (net.Conn, clientConfig, error) {
+	var err error
+	for _, endpoint := range endpoints {
+		config.endpoint = endpoint
+		var conn net.Conn
+		conn, err = connect(config, username)
+		if err == nil {
+			return conn, config, nil
+		}
+		log.Print("Couldn't connect to ", endpoint, ": ", err)
+	}
+	return nil, config, err
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+// Answers SRV lookups from a table, as a DNS server would after
+// sorting the records.
+type fakeResolver struct {
+	records map[string][]*net.SRV
+	err     error
+	block   bool // wait for the lookup to time out
+}
+
+func (r fakeResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	if r.block {
+		<-ctx.Done()
+		return "", nil, ctx.Err()
+	}
+	if r.err != nil {
+		return "", nil, r.err
+	}
+	cname := "_" + service + "._" + proto + "." + name
+	return cname, r.records[cname], nil
+}
+
+func TestLookupEndpoints(t *testing.T) {
+	resolver := fakeResolver{records: map[string][]*net.SRV{
+		"_chat._tcp.example.com": {
+			{Target: "chat1.example.com.", Port: 8011, Priority: 10, Weight: 60},
+			{Target: "chat2.example.com.", Port: 8011, Priority: 10, Weight: 40},
+			{Target: "backup.example.net.", Port: 9000, Priority: 20},
+		},
+		"_chat._tcp.nochat.example.com": {
+			{Target: ".", Port: 0},
+		},
+	}}
+
+	endpoints, err := lookupEndpoints(resolver, "example.com", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"chat1.example.com:8011", "chat2.example.com:8011", "backup.example.net:9000"}
+	if !slices.Equal(endpoints, want) {
+		t.Errorf("endpoints = %v, want %v", endpoints, want)
+	}
+
+	for _, domain := range []string{"nochat.example.com", "unknown.example.com"} {
+		if endpoints, err := lookupEndpoints(resolver, domain, time.Second); err == nil {
+			t.Errorf("lookupEndpoints(%q) = %v, want an error", domain, endpoints)
+		}
+	}
+}
+
+func TestLookupEndpointsErrors(t *testing.T) {
+	lookupFailed := errors.New("no such host")
+	if _, err := lookupEndpoints(fakeResolver{err: lookupFailed}, "example.com", time.Second); !errors.Is(err, lookupFailed) {
+		t.Errorf("got %v, want the resolver's error", err)
+	}
+
+	start := time.Now()
+	_, err := lookupEndpoints(fakeResolver{block: true}, "example.com", 50*time.Millisecond)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want a timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("lookup took %v despite a 50ms timeout", elapsed)
+	}
+}
+
+// A server that can't be reached is skipped for the next one.
+func TestConnectAny(t *testing.T) {
+	s := startTestServer(t)
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unreachable := ln.Addr().String()
+	ln.Close()
+
+	conn, config, err := connectAny(clientConfig{}, []string{unreachable, s.addr()}, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if config.endpoint != s.addr() {
+		t.Errorf("connected to %s, want %s", config.endpoint, s.addr())
+	}
+
+	if _, _, err := connectAny(clientConfig{}, []string{unreachable}, "bob"); err == nil {
+		t.Error("connected with no reachable server")
+	}
+}
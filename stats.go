@@ -0,0 +1,164 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Periodic sampling of server statistics, so operators can see
+// trends rather than just current values. The last statsSamples
+// samples are kept and served on the admin API as
+//
+//	GET /api/stats/timeseries?metric=messages&window=5m
+//
+// which returns [{"timestamp":...,"value":...}, ...] for the
+// samples taken within the window (default: all of them).
+// The metrics are connections, messages (sent during the
+// interval), avg_message_size and queue_depth.
+
+const statsSamples = 360 // an hour at the default 10 second interval
+
+type statsSample struct {
+	timestamp      time.Time
+	connections    int
+	messages       uint64
+	avgMessageSize float64
+	queueDepth     int
+}
+
+type statsCollector struct {
+	pool    *safePool
+	bus     *MessageBus
+	metrics *serverMetrics
+
+	mu      sync.Mutex
+	samples [statsSamples]statsSample // circular, oldest at head
+	head    int
+	count   int
+}
+
+func newStatsCollector(pool *safePool, bus *MessageBus, metrics *serverMetrics) *statsCollector {
+	return &statsCollector{pool: pool, bus: bus, metrics: metrics}
+}
+
+// Takes a sample every interval, forever.
+func (s *statsCollector) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	lastMessages := s.metrics.messages.Load()
+	lastBytes := s.metrics.messageBytes.Load()
+	for now := range ticker.C {
+		messages := s.metrics.messages.Load()
+		bytes := s.metrics.messageBytes.Load()
+
+		sample := statsSample{
+			timestamp:   now,
+			connections: len(s.pool.snapshot()),
+			messages:    messages - lastMessages,
+			queueDepth:  s.bus.pending(),
+		}
+		if sample.messages > 0 {
+			sample.avgMessageSize = float64(bytes-lastBytes) / float64(sample.messages)
+		}
+		s.add(sample)
+
+		lastMessages, lastBytes = messages, bytes
+	}
+}
+
+func (s *statsCollector) add(sample statsSample) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.count < statsSamples {
+		s.samples[(s.head+s.count)%statsSamples] = sample
+		s.count++
+	} else {
+		s.samples[s.head] = sample
+		s.head = (s.head + 1) % statsSamples
+	}
+}
+
+// Returns the samples taken since a given time, oldest first.
+func (s *statsCollector) since(start time.Time) []statsSample {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var samples []statsSample
+	for i := 0; i < s.count; i++ {
+		sample := s.samples[(s.head+i)%statsSamples]
+		if !sample.timestamp.Before(start) {
+			samples = append(samples, sample)
+		}
+	}
+	return samples
+}
+
+// Picks a metric out of a sample by its API name.
+func statsMetric(name string) (func(statsSample) float64, bool) {
+	switch name {
+	case "connections":
+		return func(s statsSample) float64 { return float64(s.connections) }, true
+	case "messages":
+		return func(s statsSample) float64 { return float64(s.messages) }, true
+	case "avg_message_size":
+		return func(s statsSample) float64 { return s.avgMessageSize }, true
+	case "queue_depth":
+		return func(s statsSample) float64 { return float64(s.queueDepth) }, true
+	}
+	return nil, false
+}
+
+func (s *statsCollector) register(mux *http.ServeMux) {
+	type point struct {
+		Timestamp time.Time `json:"timestamp"`
+		Value     float64   `json:"value"`
+	}
+
+	// current totals, with how many users run each client
+	// version ("unknown" for clients that sent no hello)
+	mux.HandleFunc("GET /api/stats", func(w http.ResponseWriter, r *http.Request) {
+		users := s.pool.snapshot()
+		versions := map[string]int{}
+		for _, u := range users {
+			version := u.clientVersion
+			if version == "" {
+				version = "unknown"
+			}
+			versions[version]++
+		}
+		writeJSON(w, http.StatusOK, map[string]any{
+			"connections":     len(users),
+			"messages":        s.metrics.messages.Load(),
+			"queue_depth":     s.bus.pending(),
+			"listeners":       s.metrics.listeners.Load(),
+			"client_versions": versions,
+		})
+	})
+
+	mux.HandleFunc("GET /api/stats/timeseries", func(w http.ResponseWriter, r *http.Request) {
+		metric, ok := statsMetric(r.URL.Query().Get("metric"))
+		if !ok {
+			http.Error(w, "metric must be connections, messages, avg_message_size or queue_depth", http.StatusBadRequest)
+			return
+		}
+
+		var start time.Time
+		if window := r.URL.Query().Get("window"); window != "" {
+			duration, err := time.ParseDuration(window)
+			if err != nil {
+				http.Error(w, "invalid window: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			start = time.Now().Add(-duration)
+		}
+
+		points := []point{}
+		for _, sample := range s.since(start) {
+			points = append(points, point{Timestamp: sample.timestamp, Value: metric(sample)})
+		}
+		writeJSON(w, http.StatusOK, points)
+	})
+}
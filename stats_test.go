@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newTestStatsCollector() *statsCollector {
+	return newStatsCollector(newSafePool(), newMessageBus(16), &serverMetrics{})
+}
+
+// Each sample has the messages sent since the one before.
+func TestStatsCollectorSamples(t *testing.T) {
+	s := newTestStatsCollector()
+	go s.run(10 * time.Millisecond)
+	// counted from the first sample, once run has started
+	for len(s.since(time.Time{})) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	s.metrics.messages.Add(3)
+	s.metrics.messageBytes.Add(30)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		samples := s.since(time.Time{})
+		var total uint64
+		for _, sample := range samples {
+			total += sample.messages
+			if sample.messages == 3 && sample.avgMessageSize != 10 {
+				t.Fatalf("average message size %v, want 10", sample.avgMessageSize)
+			}
+		}
+		if total > 3 {
+			t.Fatalf("%d messages sampled, want 3", total)
+		}
+		if total == 3 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d samples with %d messages", len(samples), total)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Only the last statsSamples samples are kept, oldest first.
+func TestStatsCollectorKeepsLastSamples(t *testing.T) {
+	s := newTestStatsCollector()
+	start := time.Now()
+	for i := 0; i < statsSamples+10; i++ {
+		s.add(statsSample{timestamp: start.Add(time.Duration(i) * time.Second), connections: i})
+	}
+
+	samples := s.since(time.Time{})
+	if len(samples) != statsSamples {
+		t.Fatalf("kept %d samples, want %d", len(samples), statsSamples)
+	}
+	for i, sample := range samples {
+		if sample.connections != i+10 {
+			t.Fatalf("sample %d is number %d, want %d", i, sample.connections, i+10)
+		}
+	}
+
+	if n := len(s.since(start.Add(time.Duration(statsSamples) * time.Second))); n != 10 {
+		t.Errorf("%d samples in the last 10 seconds, want 10", n)
+	}
+}
+
+func TestStatsTimeseriesAPI(t *testing.T) {
+	s := newTestStatsCollector()
+	now := time.Now()
+	for i := 10; i > 0; i-- {
+		s.add(statsSample{timestamp: now.Add(-time.Duration(i) * time.Minute), messages: uint64(i)})
+	}
+	mux := http.NewServeMux()
+	s.register(mux)
+
+	tests := []struct {
+		query      string
+		wantStatus int
+		wantValues []float64
+	}{
+		{"?metric=messages", http.StatusOK, []float64{10, 9, 8, 7, 6, 5, 4, 3, 2, 1}},
+		{"?metric=messages&window=3m30s", http.StatusOK, []float64{3, 2, 1}},
+		{"?metric=connections&window=2m30s", http.StatusOK, []float64{0, 0}},
+		{"?metric=rooms", http.StatusBadRequest, nil},
+		{"?metric=messages&window=soon", http.StatusBadRequest, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, httptest.NewRequest("GET", "/api/stats/timeseries"+tt.query, nil))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status %d, want %d", w.Code, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			var points []struct {
+				Value float64 `json:"value"`
+			}
+			if err := json.NewDecoder(w.Body).Decode(&points); err != nil {
+				t.Fatal(err)
+			}
+			if len(points) != len(tt.wantValues) {
+				t.Fatalf("got %d points, want %d", len(points), len(tt.wantValues))
+			}
+			for i, point := range points {
+				if point.Value != tt.wantValues[i] {
+					t.Errorf("point %d is %v, want %v", i, point.Value, tt.wantValues[i])
+				}
+			}
+		})
+	}
+}
+
+func TestStatsAPI(t *testing.T) {
+	s := newTestStatsCollector()
+	s.pool.addIfAbsent("10.0.0.1:5000", user{username: "alice", clientVersion: "1.2.3"})
+	s.pool.addIfAbsent("10.0.0.2:5000", user{username: "bob"})
+	s.metrics.messages.Add(5)
+	s.metrics.listeners.Add(2)
+	mux := http.NewServeMux()
+	s.register(mux)
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/api/stats", nil))
+	var stats struct {
+		Connections    int            `json:"connections"`
+		Messages       uint64         `json:"messages"`
+		Listeners      int64          `json:"listeners"`
+		ClientVersions map[string]int `json:"client_versions"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Connections != 2 || stats.Messages != 5 || stats.Listeners != 2 {
+		t.Errorf("stats = %+v", stats)
+	}
+	if stats.ClientVersions["1.2.3"] != 1 || stats.ClientVersions["unknown"] != 1 {
+		t.Errorf("client versions = %v", stats.ClientVersions)
+	}
+}
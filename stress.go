@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Load testing. The stress subcommand connects a number of clients to
+// a running server, has each send messages at a steady rate for a
+// while, and reports what happened:
+//
+//	chat stress -server 127.0.0.1:8011 -clients 100 -duration 30s -rate 50
+//
+// Once a second, each client sends a ping_echo in place of a message
+// to measure round-trip times. The server's default limit of five
+// connections per IP turns most of the clients away, so start it with
+// -max-connections-per-ip 0 first.
+//
+// The server treats each read as one message, so at high rates some
+// messages arrive merged and are counted as lost.
+
+const (
+	stressPingInterval = time.Second
+	stressDrainTime    = 2 * time.Second // for messages still in flight at the end
+)
+
+type stressConfig struct {
+	server       string
+	clients      int
+	duration     time.Duration
+	rate         float64 // messages per second, per client
+	maxErrorRate float64
+}
+
+type stressCounters struct {
+	connected atomic.Uint64
+	sent      atomic.Uint64
+	received  atomic.Uint64 // broadcasts of this run's messages
+	dropped   atomic.Uint64 // messages the server said it dropped
+	errors    atomic.Uint64
+
+	mu         sync.Mutex
+	rtts       []time.Duration
+	firstError string
+}
+
+func (c *stressCounters) fail(err string) {
+	c.errors.Add(1)
+	c.mu.Lock()
+	if c.firstError == "" {
+		c.firstError = err
+	}
+	c.mu.Unlock()
+}
+
+// Runs the load test and prints a report, returning false if
+// the error rate was over config.maxErrorRate.
+func stress(config stressConfig) bool {
+	// messages are marked with the run's ID, so that history
+	// from earlier runs isn't counted as received
+	id := make([]byte, 3)
+	rand.Read(id)
+	runID := hex.EncodeToString(id)
+
+	var counters stressCounters
+	stop := make(chan struct{})
+	var group sync.WaitGroup
+
+	fmt.Printf("Starting %d clients against %s for %v\n", config.clients, config.server, config.duration)
+	start := time.Now()
+	for i := 0; i < config.clients; i++ {
+		group.Add(1)
+		go func() {
+			defer group.Done()
+			stressClient(config, fmt.Sprintf("stress-%s-%d", runID, i), runID, &counters, stop)
+		}()
+	}
+
+	time.Sleep(config.duration)
+	close(stop)
+	group.Wait()
+
+	return stressReport(config, &counters, time.Since(start))
+}
+
+// One simulated client: connects, sends messages and pings until
+// stop is closed, and counts what it sends and receives.
+func stressClient(config stressConfig, name string, runID string, counters *stressCounters, stop <-chan struct{}) {
+	conn, err := net.Dial("tcp", config.server)
+	if err != nil {
+		counters.fail(err.Error())
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(name + "\n")); err != nil {
+		counters.fail(err.Error())
+		return
+	}
+	counters.connected.Add(1)
+
+	var reading sync.WaitGroup
+	reading.Add(1)
+	go func() {
+		defer reading.Done()
+		stressRead(conn, runID, counters)
+	}()
+
+	// pings take a message's turn rather than being sent alongside,
+	// since two writes close together can reach the server as one
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / config.rate))
+	defer ticker.Stop()
+	lastPing := time.Now()
+
+	for n := 0; ; {
+		var text string
+		select {
+		case now := <-ticker.C:
+			if now.Sub(lastPing) >= stressPingInterval {
+				lastPing = now
+				line, _ := json.Marshal(pingPacket{Type: "ping_echo", Payload: runID, SentAt: now})
+				text = string(line)
+			} else {
+				n++
+				text = "stress " + runID + " " + strconv.Itoa(n)
+			}
+		case <-stop:
+			// let the last broadcasts arrive before hanging up
+			conn.SetReadDeadline(time.Now().Add(stressDrainTime))
+			reading.Wait()
+			return
+		}
+
+		if _, err := conn.Write([]byte(text)); err != nil {
+			counters.fail(err.Error())
+			return
+		}
+		if !strings.HasPrefix(text, "{") {
+			counters.sent.Add(1)
+		}
+	}
+}
+
+func stressRead(conn net.Conn, runID string, counters *stressCounters) {
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			if !isTimeout(err) {
+				counters.fail(err.Error())
+			}
+			return
+		}
+		line = strings.TrimSpace(line)
+
+		switch packetType, raw := decodePacket(line); packetType {
+		case "pong_echo":
+			var pong pongPacket
+			json.Unmarshal(raw, &pong)
+			counters.mu.Lock()
+			counters.rtts = append(counters.rtts, time.Since(pong.SentAt))
+			counters.mu.Unlock()
+		case "error":
+			var message errorPacket
+			json.Unmarshal(raw, &message)
+			if message.Text == serverBusyText {
+				counters.dropped.Add(1)
+			} else {
+				counters.fail(message.Text)
+			}
+		case "":
+			if strings.Contains(line, "stress "+runID+" ") {
+				counters.received.Add(1)
+			}
+		}
+	}
+}
+
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+func stressReport(config stressConfig, counters *stressCounters, elapsed time.Duration) bool {
+	sent := counters.sent.Load()
+	errors := counters.errors.Load()
+	connected := counters.connected.Load()
+
+	// every message should reach every other connected client
+	expected := sent*max(connected, 1) - sent
+
+	fmt.Printf("Ran for %v with %d of %d clients connected\n", elapsed.Round(time.Millisecond), connected, config.clients)
+	fmt.Printf("Messages sent:     %d (%.0f/s)\n", sent, float64(sent)/config.duration.Seconds())
+	fmt.Printf("Messages received: %d of %d expected\n", counters.received.Load(), expected)
+	fmt.Printf("Messages dropped:  %d\n", counters.dropped.Load())
+	fmt.Printf("Errors:            %d\n", errors)
+
+	counters.mu.Lock()
+	defer counters.mu.Unlock()
+	if len(counters.rtts) > 0 {
+		slices.Sort(counters.rtts)
+		percentile := func(p float64) time.Duration {
+			return counters.rtts[int(p*float64(len(counters.rtts)-1))]
+		}
+		fmt.Printf("Round trip:        p50 %v, p99 %v, p99.9 %v\n", percentile(0.5), percentile(0.99), percentile(0.999))
+	}
+	if counters.firstError != "" {
+		fmt.Println("First error:      ", counters.firstError)
+	}
+
+	errorRate := float64(errors) / float64(max(sent+errors, 1))
+	if errorRate > config.maxErrorRate {
+		fmt.Printf("Error rate %.2f%% is over the %.2f%% allowed\n", errorRate*100, config.maxErrorRate*100)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// A short run against an in-process server goes without errors.
+func TestStress(t *testing.T) {
+	s := startTestServer(t)
+	config := stressConfig{
+		server:       s.addr(),
+		clients:      5,
+		duration:     stressPingInterval + 200*time.Millisecond, // long enough for a ping
+		rate:         10,
+		maxErrorRate: 0.01,
+	}
+
+	var ok bool
+	report := captureStdout(t, func() { ok = stress(config) })
+	if !ok {
+		t.Errorf("stress failed:\n%s", report)
+	}
+	for _, want := range []string{"with 5 of 5 clients connected", "Errors:            0\n", "Round trip:"} {
+		if !strings.Contains(report, want) {
+			t.Errorf("report doesn't include %q:\n%s", want, report)
+		}
+	}
+}
+
+func TestStressReportErrorRate(t *testing.T) {
+	tests := []struct {
+		sent   uint64
+		errors uint64
+		want   bool
+	}{
+		{100, 0, true},
+		{999, 1, true},
+		{98, 2, false},
+	}
+	for _, tt := range tests {
+		var counters stressCounters
+		counters.sent.Store(tt.sent)
+		counters.errors.Store(tt.errors)
+		var ok bool
+		captureStdout(t, func() {
+			ok = stressReport(stressConfig{clients: 1, duration: time.Second, maxErrorRate: 0.01}, &counters, time.Second)
+		})
+		if ok != tt.want {
+			t.Errorf("%d errors in %d sends: passed %v, want %v", tt.errors, tt.sent, ok, tt.want)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// Machine-readable tags, for bots posting build results and the like.
+// "#key=value" words in a message are taken out of the text and kept
+// as tags, so "Build done #build_id=42 #status=ok" is shown as
+// "Build done" and tagged build_id=42 and status=ok. Long-poll clients
+// and the Slack webhook receive the tags alongside the text, and
+//
+//	GET /api/history?tag_key=status&tag_value=failed
+//
+// on the admin API lists the messages with a given tag.
+
+var tagPattern = regexp.MustCompile(`(^|[ \t])#(\w+)=(\S+)`)
+
+// Splits the tags out of a message's text, returning the text without
+// them and the tags, or nil if there were none.
+func extractTags(text string) (string, map[string]string) {
+	matches := tagPattern.FindAllStringSubmatch(text, -1)
+	if matches == nil {
+		return text, nil
+	}
+	tags := make(map[string]string, len(matches))
+	for _, match := range matches {
+		tags[match[2]] = match[3]
+	}
+	return strings.TrimSpace(tagPattern.ReplaceAllString(text, "")), tags
+}
+
+// Lists the message history on GET /api/history, optionally only
+// the messages whose tag_key tag is tag_value. With tag_key alone,
+// any message with that tag matches.
+func registerHistoryAPI(mux *http.ServeMux, history *messageHistory) {
+	mux.HandleFunc("GET /api/history", func(w http.ResponseWriter, r *http.Request) {
+		key := r.URL.Query().Get("tag_key")
+		value := r.URL.Query().Get("tag_value")
+		if key == "" && value != "" {
+			http.Error(w, "tag_value requires tag_key", http.StatusBadRequest)
+			return
+		}
+
+		messages := []wireMessage{}
+		for _, packet := range history.snapshot() {
+			if key != "" {
+				tag, ok := packet.tags[key]
+				if !ok || (value != "" && tag != value) {
+					continue
+				}
+			}
+			messages = append(messages, wireMessage{
+				Seq:         packet.seq,
+				Sender:      packet.sender,
+				Text:        packet.text,
+				ContentType: packet.contentType,
+				Tags:        packet.tags,
+			})
+		}
+		writeJSON(w, http.StatusOK, messages)
+	})
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bufio"
+	"maps"
+	"net"
+	"testing"
+)
+
+func TestExtractTags(t *testing.T) {
+	tests := []struct {
+		text     string
+		wantText string
+		wantTags map[string]string
+	}{
+		{"Build done #build_id=42 #status=ok", "Build done", map[string]string{"build_id": "42", "status": "ok"}},
+		{"#status=failed tests broke", "tests broke", map[string]string{"status": "failed"}},
+		{"no tags here", "no tags here", nil},
+		{"a #hashtag and an#inline=tag", "a #hashtag and an#inline=tag", nil},
+		{"#status=ok #status=failed", "", map[string]string{"status": "failed"}},
+	}
+	for _, tt := range tests {
+		text, tags := extractTags(tt.text)
+		if text != tt.wantText || !maps.Equal(tags, tt.wantTags) {
+			t.Errorf("extractTags(%q) = %q, %v, want %q, %v", tt.text, text, tags, tt.wantText, tt.wantTags)
+		}
+	}
+}
+
+// Recipients see the message without its tags, which are kept with it
+// in the history.
+func TestBroadcastStripsTags(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	pool := newSafePool()
+	pool.addIfAbsent("10.0.0.1:5000", newTestUser(t, server, "alice"))
+	messages := make(chan messagePacket)
+	history := startBroadcaster(t, pool, messages)
+
+	messages <- messagePacket{sender: "ci", text: "Build done #build_id=42 #status=ok", source: "10.0.0.2:5000"}
+	line, err := bufio.NewReader(client).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "BROADCAST ci: Build done\n" {
+		t.Errorf("alice got %q, want the text without its tags", line)
+	}
+	snapshot := history.snapshot()
+	if want := map[string]string{"build_id": "42", "status": "ok"}; len(snapshot) != 1 || !maps.Equal(snapshot[0].tags, want) {
+		t.Errorf("history holds %+v, want the message tagged %v", snapshot, want)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// TLS policy for the TLS port. --tls-min-version refuses clients that
+// can't speak at least the given version, and --tls-ciphers limits the
+// cipher suites to a comma-separated list of their standard names,
+// such as TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384. Go doesn't allow the
+// TLS 1.3 suites to be chosen, so the list only applies to TLS 1.2.
+
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func parseTLSVersion(version string) (uint16, error) {
+	id, ok := tlsVersions[version]
+	if !ok {
+		return 0, fmt.Errorf("unsupported TLS version %q, want 1.2 or 1.3", version)
+	}
+	return id, nil
+}
+
+// Returns the IDs of the named cipher suites, or nil for Go's
+// defaults if the list is empty.
+func parseCipherSuites(list string) ([]uint16, error) {
+	if list == "" {
+		return nil, nil
+	}
+	secure := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		secure[suite.Name] = suite.ID
+	}
+	insecure := make(map[string]bool)
+	for _, suite := range tls.InsecureCipherSuites() {
+		insecure[suite.Name] = true
+	}
+
+	var ids []uint16
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if insecure[name] {
+			return nil, fmt.Errorf("cipher suite %s is insecure", name)
+		}
+		id, ok := secure[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// Logs the negotiated version and cipher suite of a TLS connection.
+// Called once the handshake is done.
+func logTLSState(conn *tls.Conn) {
+	state := conn.ConnectionState()
+	log.Print(tls.VersionName(state.Version), " with ", tls.CipherSuiteName(state.CipherSuite), " from ", conn.RemoteAddr())
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"slices"
+	"testing"
+)
+
+func TestParseTLSVersion(t *testing.T) {
+	tests := []struct {
+		version string
+		want    uint16
+		wantErr bool
+	}{
+		{"1.2", tls.VersionTLS12, false},
+		{"1.3", tls.VersionTLS13, false},
+		{"1.1", 0, true},
+		{"1.0", 0, true},
+		{"", 0, true},
+		{"TLS1.2", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseTLSVersion(tt.version)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseTLSVersion(%q) = %v, %v, want %v (error %v)", tt.version, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestParseCipherSuites(t *testing.T) {
+	tests := []struct {
+		list    string
+		want    []uint16
+		wantErr bool
+	}{
+		{"", nil, false},
+		{"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384", []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384}, false},
+		{
+			"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384, TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256",
+			[]uint16{tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384, tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256},
+			false,
+		},
+		{"TLS_RSA_WITH_RC4_128_SHA", nil, true}, // insecure
+		{"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,TLS_NOT_A_SUITE", nil, true},
+		{"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseCipherSuites(tt.list)
+		if (err != nil) != tt.wantErr || !slices.Equal(got, tt.want) {
+			t.Errorf("parseCipherSuites(%q) = %v, %v, want %v (error %v)", tt.list, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+// With --tls-min-version 1.2, older clients can't connect, and with
+// --tls-ciphers, TLS 1.2 clients get one of the suites listed.
+func TestTLSPolicy(t *testing.T) {
+	s := startTestServer(t)
+	cert, caFile := testCertificate(t)
+	minVersion, err := parseTLSVersion("1.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cipherSuites, err := parseCipherSuites("TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := s.listen(t, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   minVersion,
+		CipherSuites: cipherSuites,
+	})
+
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(pem)
+
+	tests := []struct {
+		name        string
+		client      *tls.Config
+		wantVersion uint16 // 0 if the handshake should fail
+		wantSuite   uint16
+	}{
+		{
+			name:   "TLS 1.1",
+			client: &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS10, MaxVersion: tls.VersionTLS11},
+		},
+		{
+			name:        "TLS 1.2",
+			client:      &tls.Config{RootCAs: roots, MaxVersion: tls.VersionTLS12},
+			wantVersion: tls.VersionTLS12,
+			wantSuite:   tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+		},
+		{
+			name: "TLS 1.2 without the listed suite",
+			client: &tls.Config{RootCAs: roots, MaxVersion: tls.VersionTLS12,
+				CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}},
+		},
+		{
+			name:        "TLS 1.3",
+			client:      &tls.Config{RootCAs: roots},
+			wantVersion: tls.VersionTLS13,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := tls.Dial("tcp", addr, tt.client)
+			if tt.wantVersion == 0 {
+				if err == nil {
+					conn.Close()
+					t.Fatal("connected")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			state := conn.ConnectionState()
+			if state.Version != tt.wantVersion {
+				t.Errorf("negotiated %s, want %s", tls.VersionName(state.Version), tls.VersionName(tt.wantVersion))
+			}
+			if tt.wantSuite != 0 && state.CipherSuite != tt.wantSuite {
+				t.Errorf("negotiated %s, want %s", tls.CipherSuiteName(state.CipherSuite), tls.CipherSuiteName(tt.wantSuite))
+			}
+		})
+	}
+}
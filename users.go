@@ -0,0 +1,250 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	maxUsernameLength = 32
+	awayAfter         = 10 * time.Minute // silence before a user is marked away
+	awayCheckInterval = time.Minute
+)
+
+var (
+	ErrUsernameEmpty   = errors.New("username must not be empty")
+	ErrUsernameTooLong = fmt.Errorf("username must be at most %d characters", maxUsernameLength)
+	ErrUsernameInvalid = errors.New("username may not contain spaces or control characters")
+	ErrUsernameTaken   = errors.New("username is already taken")
+)
+
+// The pool of connected users, keyed by connection address.
+// Connection handlers add and remove users while the broadcaster
+// reads the pool, so all access goes through the mutex.
+type safePool struct {
+	mu    sync.Mutex
+	users map[string]user
+}
+
+func newSafePool() *safePool {
+	return &safePool{users: make(map[string]user)}
+}
+
+// Adds a user unless another connection already goes by their
+// name, returning ErrUsernameTaken if one does. Checking and adding
+// under one lock stops two clients claiming the same name at once.
+func (p *safePool) addIfAbsent(address string, u user) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, other := range p.users {
+		if other.username == u.username {
+			return ErrUsernameTaken
+		}
+	}
+	p.users[address] = u
+	return nil
+}
+
+func (p *safePool) remove(address string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.users, address)
+}
+
+// Finds a connected user by their connection address.
+func (p *safePool) get(address string) (user, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	u, ok := p.users[address]
+	return u, ok
+}
+
+// Finds a connected user by name, returning their address.
+func (p *safePool) lookup(name string) (address string, u user, ok bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for address, u := range p.users {
+		if u.username == name {
+			return address, u, true
+		}
+	}
+	return "", user{}, false
+}
+
+// Reports whether a connected user already goes by name.
+func (p *safePool) hasUsername(name string) bool {
+	_, _, ok := p.lookup(name)
+	return ok
+}
+
+// Returns a copy of the connected users, so callers can
+// write to them without holding the lock.
+func (p *safePool) snapshot() []user {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	users := make([]user, 0, len(p.users))
+	for _, u := range p.users {
+		users = append(users, u)
+	}
+	return users
+}
+
+// Activity counters for one connection. The connection's handler
+// and the broadcaster both update them, so all fields are atomic.
+type userStats struct {
+	connectedAt   time.Time
+	lastMessageAt atomic.Int64 // unix nanoseconds
+	messageCount  atomic.Uint64
+	bytesSent     atomic.Uint64
+	bytesReceived atomic.Uint64
+	away          atomic.Bool
+	slowWrites    atomic.Uint32 // lines that missed their write deadline
+}
+
+func newUserStats() *userStats {
+	stats := &userStats{connectedAt: time.Now()}
+	stats.lastMessageAt.Store(stats.connectedAt.UnixNano())
+	return stats
+}
+
+// Records a message read from the user.
+func (s *userStats) received(size int) {
+	s.bytesReceived.Add(uint64(size))
+	s.lastMessageAt.Store(time.Now().UnixNano())
+	s.away.Store(false)
+}
+
+// Records a message written to the user.
+func (s *userStats) sent(size int) {
+	s.bytesSent.Add(uint64(size))
+	s.messageCount.Add(1)
+}
+
+func (s *userStats) status() string {
+	if s.away.Load() {
+		return "away"
+	}
+	return "online"
+}
+
+// Marks users as away once they have been silent for awayAfter.
+// Sending a message marks them online again.
+func watchAway(pool *safePool) {
+	ticker := time.NewTicker(awayCheckInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		for _, u := range pool.snapshot() {
+			lastMessageAt := time.Unix(0, u.stats.lastMessageAt.Load())
+			if time.Since(lastMessageAt) > awayAfter && !u.stats.away.Swap(true) {
+				log.Print(u.username, " is now away")
+			}
+		}
+	}
+}
+
+// Lists connected users and their activity on GET /api/users.
+// POST /api/users/{username}/migrate with {"address":"host:port"}
+// moves a user to another server instance.
+func registerUsersAPI(mux *http.ServeMux, pool *safePool, audit *userAuditLog) {
+	type userInfo struct {
+		Username      string    `json:"username"`
+		Address       string    `json:"address"`
+		Status        string    `json:"status"`
+		ConnectedAt   time.Time `json:"connected_at"`
+		LastMessageAt time.Time `json:"last_message_at"`
+		MessageCount  uint64    `json:"message_count"`
+		BytesSent     uint64    `json:"bytes_sent"`
+		BytesReceived uint64    `json:"bytes_received"`
+		ClientVersion string    `json:"client_version,omitempty"`
+		Flags         []string  `json:"flags,omitempty"`
+	}
+
+	mux.HandleFunc("GET /api/users", func(w http.ResponseWriter, r *http.Request) {
+		users := []userInfo{}
+		for _, u := range pool.snapshot() {
+			users = append(users, userInfo{
+				Username:      u.username,
+				Address:       u.connection.RemoteAddr().String(),
+				Status:        u.stats.status(),
+				ConnectedAt:   u.stats.connectedAt,
+				LastMessageAt: time.Unix(0, u.stats.lastMessageAt.Load()),
+				MessageCount:  u.stats.messageCount.Load(),
+				BytesSent:     u.stats.bytesSent.Load(),
+				BytesReceived: u.stats.bytesReceived.Load(),
+				ClientVersion: u.clientVersion,
+				Flags:         u.flags,
+			})
+		}
+		writeJSON(w, http.StatusOK, users)
+	})
+
+	mux.HandleFunc("POST /api/users/{username}/migrate", func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			Address string `json:"address"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Address == "" {
+			http.Error(w, "address is required", http.StatusBadRequest)
+			return
+		}
+
+		err := migrateClient(pool, r.PathValue("username"), request.Address)
+		if errors.Is(err, errNoSuchUser) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		audit.record(r.PathValue("username"), auditMigrated, "to "+request.Address)
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// Picks an unused name like "Guest-7f3a" for an anonymous user.
+func guestName(pool *safePool) string {
+	for {
+		suffix := make([]byte, 2)
+		rand.Read(suffix)
+		name := "Guest-" + hex.EncodeToString(suffix)
+		if !pool.hasUsername(name) {
+			return name
+		}
+	}
+}
+
+// Checks that a requested username is well formed and not
+// already in use by another connection. Names may use any
+// printable Unicode characters except whitespace. The name
+// can still be taken before the user is added, so add them
+// with safePool.addIfAbsent.
+func validateUsername(name string, pool *safePool) error {
+	if name == "" {
+		return ErrUsernameEmpty
+	}
+	if !utf8.ValidString(name) {
+		return ErrUsernameInvalid
+	}
+	if utf8.RuneCountInString(name) > maxUsernameLength {
+		return ErrUsernameTooLong
+	}
+	for _, r := range name {
+		if unicode.IsSpace(r) || unicode.IsControl(r) {
+			return ErrUsernameInvalid
+		}
+	}
+	if pool.hasUsername(name) {
+		return ErrUsernameTaken
+	}
+	return nil
+}
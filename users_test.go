@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestValidateUsername(t *testing.T) {
+	pool := newSafePool()
+	if err := pool.addIfAbsent("10.0.0.1:5000", user{username: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		username string
+		want     error
+	}{
+		{"empty", "", ErrUsernameEmpty},
+		{"too long", strings.Repeat("a", maxUsernameLength+1), ErrUsernameTooLong},
+		{"longest allowed", strings.Repeat("a", maxUsernameLength), nil},
+		{"contains spaces", "bob smith", ErrUsernameInvalid},
+		{"contains a tab", "bob\tsmith", ErrUsernameInvalid},
+		{"null byte", "bob\x00", ErrUsernameInvalid},
+		{"invalid UTF-8", "bob\xff", ErrUsernameInvalid},
+		{"valid ASCII", "bob_42", nil},
+		{"valid Unicode", "zoë-東京", nil},
+		{"duplicate in pool", "alice", ErrUsernameTaken},
+		{"first time in pool", "carol", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateUsername(tt.username, pool); !errors.Is(err, tt.want) {
+				t.Errorf("validateUsername(%q) = %v, want %v", tt.username, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestAddIfAbsent(t *testing.T) {
+	pool := newSafePool()
+	if err := pool.addIfAbsent("10.0.0.1:5000", user{username: "alice"}); err != nil {
+		t.Fatalf("first add: %v", err)
+	}
+	if err := pool.addIfAbsent("10.0.0.2:5000", user{username: "alice"}); !errors.Is(err, ErrUsernameTaken) {
+		t.Fatalf("second add = %v, want %v", err, ErrUsernameTaken)
+	}
+	if _, ok := pool.get("10.0.0.2:5000"); ok {
+		t.Error("rejected user was added to the pool")
+	}
+
+	pool.remove("10.0.0.1:5000")
+	if err := pool.addIfAbsent("10.0.0.2:5000", user{username: "alice"}); err != nil {
+		t.Errorf("add after the name was freed: %v", err)
+	}
+}
+
+// Many clients claiming one name at once must leave exactly one of
+// them connected.
+func TestAddIfAbsentConcurrent(t *testing.T) {
+	pool := newSafePool()
+	const clients = 50
+
+	var wg sync.WaitGroup
+	errs := make(chan error, clients)
+	for i := range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			address := "10.0.0.1:" + strconv.Itoa(5000+i)
+			errs <- pool.addIfAbsent(address, user{username: "alice"})
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	added := 0
+	for err := range errs {
+		if err == nil {
+			added++
+		} else if !errors.Is(err, ErrUsernameTaken) {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+	if added != 1 {
+		t.Errorf("%d clients got the name, want 1", added)
+	}
+	if n := len(pool.snapshot()); n != 1 {
+		t.Errorf("pool has %d users, want 1", n)
+	}
+}
+
+// Only broadcasts that were written count towards a user's stats.
+func TestMessageCountOnlyDelivered(t *testing.T) {
+	pool := newSafePool()
+	working := newTestUser(t, newMockConn("10.0.0.1:5000"), "alice")
+	brokenConn := newMockConn("10.0.0.2:5000")
+	brokenConn.Close()
+	broken := newTestUser(t, brokenConn, "bob")
+	pool.addIfAbsent("10.0.0.1:5000", working)
+	pool.addIfAbsent("10.0.0.2:5000", broken)
+	messages := make(chan messagePacket)
+	startBroadcaster(t, pool, messages)
+
+	for i := 0; i < 2; i++ {
+		messages <- messagePacket{sender: "carol", text: "hello", source: "10.0.0.3:5000"}
+	}
+	// the first message has been tried on everyone once alice has both
+	deadline := time.Now().Add(5 * time.Second)
+	for working.stats.messageCount.Load() < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("alice got %d messages, want 2", working.stats.messageCount.Load())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if n, size := broken.stats.messageCount.Load(), broken.stats.bytesSent.Load(); n != 0 || size != 0 {
+		t.Errorf("bob, whose writes all failed, counts %d messages of %d bytes", n, size)
+	}
+}
+
+// With --allow-anonymous, an empty username gets a guest name, and
+// the guest's messages are marked as theirs.
+func TestAnonymousUser(t *testing.T) {
+	guestNamePattern := regexp.MustCompile(`^Guest-[0-9a-f]{4}$`)
+
+	t.Run("allowed", func(t *testing.T) {
+		c := newConnectionTest()
+		c.config.allowAnonymous = true
+		published := c.bus.subscribe()
+		conn := newMockConn("10.0.0.1:5000", "\n", "hello\n")
+
+		c.handle(t, conn)
+
+		select {
+		case packet := <-published:
+			if packet.text != "[guest] hello" || !guestNamePattern.MatchString(packet.sender) {
+				t.Errorf("published %q from %q, want a guest's prefixed message", packet.text, packet.sender)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("the guest's message wasn't published")
+		}
+	})
+
+	t.Run("not allowed", func(t *testing.T) {
+		c := newConnectionTest()
+		conn := newMockConn("10.0.0.1:5000", "\n", "hello\n")
+
+		c.handle(t, conn)
+
+		if got, want := conn.written(), `{"type":"error","text":"`+ErrUsernameEmpty.Error()+`"}`+"\n"; got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	})
+}
+
+func TestGuestNameUnused(t *testing.T) {
+	pool := newSafePool()
+	for i := 0; i < 100; i++ {
+		name := guestName(pool)
+		if err := pool.addIfAbsent(strconv.Itoa(i), user{username: name}); err != nil {
+			t.Fatalf("guest name %q: %v", name, err)
+		}
+	}
+}
+
+func TestUsersAPI(t *testing.T) {
+	pool := newSafePool()
+	alice := newTestUser(t, newMockConn("10.0.0.1:5000"), "alice")
+	alice.clientVersion = "1.2.3"
+	alice.stats.received(5)
+	pool.addIfAbsent("10.0.0.1:5000", alice)
+	bob := newTestUser(t, newMockConn("10.0.0.2:5000"), "bob")
+	bob.stats.away.Store(true)
+	pool.addIfAbsent("10.0.0.2:5000", bob)
+	audit := newUserAuditLog()
+	mux := http.NewServeMux()
+	registerUsersAPI(mux, pool, audit)
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/api/users", nil))
+	type userInfo struct {
+		Username      string `json:"username"`
+		Address       string `json:"address"`
+		Status        string `json:"status"`
+		BytesReceived uint64 `json:"bytes_received"`
+		ClientVersion string `json:"client_version"`
+	}
+	var users []userInfo
+	if err := json.NewDecoder(w.Body).Decode(&users); err != nil {
+		t.Fatal(err)
+	}
+	slices.SortFunc(users, func(a, b userInfo) int { return strings.Compare(a.Username, b.Username) })
+	if len(users) != 2 || users[0].Address != "10.0.0.1:5000" || users[0].Status != "online" || users[0].BytesReceived != 5 ||
+		users[0].ClientVersion != "1.2.3" || users[1].Status != "away" {
+		t.Errorf("users = %+v", users)
+	}
+
+	tests := []struct {
+		name   string
+		user   string
+		body   string
+		status int
+	}{
+		{"no address", "alice", `{}`, http.StatusBadRequest},
+		{"unknown user", "carol", `{"address":"server2:8011"}`, http.StatusNotFound},
+		{"migrated", "alice", `{"address":"server2:8011"}`, http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("POST", "/api/users/"+tt.user+"/migrate", strings.NewReader(tt.body)))
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.status)
+		}
+	}
+	if events, _ := audit.events("alice"); len(events) != 1 || events[0].Action != auditMigrated || events[0].Detail != "to server2:8011" {
+		t.Errorf("alice's audit events = %+v, want the migration", events)
+	}
+}
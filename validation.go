@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Checks on a message's text, shared by the client, which checks
+// before sending so it doesn't waste a trip to the server, and the
+// server, which can't trust that it did.
+
+// The most the server reads as one message.
+const maxMessageSize = 1024
+
+type ValidationRule func(text string) error
+
+var (
+	ErrEmptyMessage   = errors.New("message cannot be empty")
+	ErrMessageTooLong = fmt.Errorf("message too long (max %d bytes)", maxMessageSize)
+	ErrNullByte       = errors.New("message cannot contain null bytes")
+)
+
+var DefaultRules = []ValidationRule{
+	func(text string) error {
+		if strings.TrimSpace(text) == "" {
+			return ErrEmptyMessage
+		}
+		return nil
+	},
+	func(text string) error {
+		if len(text) > maxMessageSize {
+			return ErrMessageTooLong
+		}
+		return nil
+	},
+	func(text string) error {
+		if strings.ContainsRune(text, 0) {
+			return ErrNullByte
+		}
+		return nil
+	},
+}
+
+// Returns the error from the first rule the text breaks, if any.
+func validateMessage(text string, rules []ValidationRule) error {
+	for _, rule := range rules {
+		if err := rule(text); err != nil {
+			return err
+		}
+	}
+	return nil
+}
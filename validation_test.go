@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestValidateMessage(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want error
+	}{
+		{"ordinary", "hello", nil},
+		{"empty", "", ErrEmptyMessage},
+		{"only whitespace", " \t\n", ErrEmptyMessage},
+		{"at the limit", strings.Repeat("a", maxMessageSize), nil},
+		{"over the limit", strings.Repeat("a", maxMessageSize+1), ErrMessageTooLong},
+		{"multi-byte over the limit", strings.Repeat("é", maxMessageSize/2+1), ErrMessageTooLong},
+		{"null byte", "hel\x00lo", ErrNullByte},
+		{"first rule broken wins", strings.Repeat("\x00", maxMessageSize+1), ErrMessageTooLong},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateMessage(tt.text, DefaultRules); !errors.Is(err, tt.want) {
+				t.Errorf("validateMessage() = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateMessageCustomRules(t *testing.T) {
+	errShouting := errors.New("no shouting")
+	rules := append(slices.Clone(DefaultRules), func(text string) error {
+		if text == strings.ToUpper(text) {
+			return errShouting
+		}
+		return nil
+	})
+	if err := validateMessage("HELLO", rules); !errors.Is(err, errShouting) {
+		t.Errorf("got %v, want %v", err, errShouting)
+	}
+	if err := validateMessage("", rules); !errors.Is(err, ErrEmptyMessage) {
+		t.Errorf("got %v, want %v", err, ErrEmptyMessage)
+	}
+	if err := validateMessage("hello", nil); err != nil {
+		t.Errorf("no rules, but got %v", err)
+	}
+}
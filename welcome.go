@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"strings"
+	"text/template"
+)
+
+// A greeting for each new user, set with --welcome-message as a
+// text/template and sent to them alone once the history has been
+// replayed, so they can see where the old messages end. The fields
+// available are
+//
+//	{{.Username}}       the new user's name
+//	{{.UserCount}}      how many users are connected, counting them
+//	{{.ServerVersion}}  the server's version
+//
+// It is sent as a system packet:
+//
+//	{"type":"system","text":"Welcome alice, 3 users online"}
+
+type welcomeFields struct {
+	Username      string
+	UserCount     int
+	ServerVersion string
+}
+
+type systemPacket struct {
+	Type string `json:"type"` // always "system"
+	Text string `json:"text"`
+}
+
+// Parses a --welcome-message template, trying it on a sample user.
+// An empty message gives a nil template, and no welcome is sent.
+func parseWelcomeMessage(text string) (*template.Template, error) {
+	if text == "" {
+		return nil, nil
+	}
+	tmpl, err := template.New("welcome-message").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	if err := tmpl.Execute(io.Discard, welcomeFields{}); err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+// Sends the welcome message to a user who has just joined.
+func sendWelcome(conn net.Conn, welcome *template.Template, username string, pool *safePool) error {
+	if welcome == nil {
+		return nil
+	}
+	var text strings.Builder
+	fields := welcomeFields{Username: username, UserCount: len(pool.snapshot()), ServerVersion: Version}
+	if err := welcome.Execute(&text, fields); err != nil {
+		return err
+	}
+	line, err := json.Marshal(systemPacket{Type: "system", Text: text.String()})
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(append(line, '\n'))
+	return err
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseWelcomeMessage(t *testing.T) {
+	tests := []struct {
+		text    string
+		wantNil bool
+		wantErr bool
+	}{
+		{"", true, false},
+		{"Welcome {{.Username}}, {{.UserCount}} users online", false, false},
+		{"Running {{.ServerVersion}}", false, false},
+		{"Welcome to {{.Room}}", false, true},
+		{"Welcome {{.Username", false, true},
+	}
+	for _, tt := range tests {
+		welcome, err := parseWelcomeMessage(tt.text)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseWelcomeMessage(%q) error = %v, want error %v", tt.text, err, tt.wantErr)
+		}
+		if err == nil && (welcome == nil) != tt.wantNil {
+			t.Errorf("parseWelcomeMessage(%q) = %v, want nil %v", tt.text, welcome, tt.wantNil)
+		}
+	}
+}
+
+// The welcome follows the history, and counts the new user.
+func TestHandleConnectionWelcome(t *testing.T) {
+	c := newConnectionTest()
+	var err error
+	c.welcome, err = parseWelcomeMessage("Welcome {{.Username}}, {{.UserCount}} users online")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.pool.addIfAbsent("10.0.0.2:5000", newTestUser(t, newMockConn("10.0.0.2:5000"), "bob"))
+	c.history.append(messagePacket{sender: "bob", text: "earlier", timestamp: time.Now()})
+	conn := newMockConn("10.0.0.1:5000", "alice\n")
+
+	c.handle(t, conn)
+
+	lines := strings.Split(strings.TrimSpace(conn.written()), "\n")
+	if len(lines) < 2 || lines[0] != "BROADCAST bob: earlier" {
+		t.Fatalf("got %q, want the history first", lines)
+	}
+	packetType, raw := decodePacket(lines[1])
+	var message systemPacket
+	if packetType != "system" || json.Unmarshal(raw, &message) != nil {
+		t.Fatalf("got %q after the history, want a system packet", lines[1])
+	}
+	if message.Text != "Welcome alice, 2 users online" {
+		t.Errorf("welcome = %q", message.Text)
+	}
+}
+
+// Without --welcome-message nothing is sent.
+func TestSendWelcomeNone(t *testing.T) {
+	conn := newMockConn("10.0.0.1:5000")
+	if err := sendWelcome(conn, nil, "alice", newSafePool()); err != nil {
+		t.Fatal(err)
+	}
+	if got := conn.written(); got != "" {
+		t.Errorf("sent %q", got)
+	}
+}